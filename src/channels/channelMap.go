@@ -0,0 +1,77 @@
+package elev
+
+//The lab hardware has four floors. Buildings of any other size only exist in
+//the simulator and the fake driver, and get their channels generated above
+//virtualChannelBase, eight channels per floor. The last channel of a floor is
+//a bit of the floor indicator.
+const HardwareNumFloors = 4
+const virtualChannelBase = 0x400
+const virtualChannelsPerFloor = 8
+
+var hardwareButtons = [HardwareNumFloors][3]int{
+	{BUTTON_UP1, BUTTON_DOWN1, BUTTON_COMMAND1},
+	{BUTTON_UP2, BUTTON_DOWN2, BUTTON_COMMAND2},
+	{BUTTON_UP3, BUTTON_DOWN3, BUTTON_COMMAND3},
+	{BUTTON_UP4, BUTTON_DOWN4, BUTTON_COMMAND4},
+}
+
+var hardwareLamps = [HardwareNumFloors][3]int{
+	{LIGHT_UP1, LIGHT_DOWN1, LIGHT_COMMAND1},
+	{LIGHT_UP2, LIGHT_DOWN2, LIGHT_COMMAND2},
+	{LIGHT_UP3, LIGHT_DOWN3, LIGHT_COMMAND3},
+	{LIGHT_UP4, LIGHT_DOWN4, LIGHT_COMMAND4},
+}
+
+var hardwareFloorSensors = [HardwareNumFloors]int{
+	SENSOR_FLOOR1,
+	SENSOR_FLOOR2,
+	SENSOR_FLOOR3,
+	SENSOR_FLOOR4,
+}
+
+//ChannelMap holds the channel of every button, lamp and floor sensor in the shaft.
+//Buttons and Lamps are indexed [floor][BUTTON_CALL_UP, BUTTON_CALL_DOWN, BUTTON_COMMAND].
+//Non-existing buttons (down at the bottom, up at the top) have channel -1.
+//FloorIndicator is the bits of the floor indicator, the most significant first,
+//as many as it takes to show the top floor.
+type ChannelMap struct {
+	Buttons        [][3]int
+	Lamps          [][3]int
+	FloorSensors   []int
+	FloorIndicator []int
+}
+
+func NewChannelMap(numFloors int) ChannelMap {
+	m := ChannelMap{
+		Buttons:      make([][3]int, numFloors),
+		Lamps:        make([][3]int, numFloors),
+		FloorSensors: make([]int, numFloors),
+	}
+	if numFloors == HardwareNumFloors {
+		for floor := 0; floor < numFloors; floor++ {
+			m.Buttons[floor] = hardwareButtons[floor]
+			m.Lamps[floor] = hardwareLamps[floor]
+			m.FloorSensors[floor] = hardwareFloorSensors[floor]
+		}
+		m.FloorIndicator = []int{LIGHT_FLOOR_IND1, LIGHT_FLOOR_IND2}
+		return m
+	}
+	for floor := 0; floor < numFloors; floor++ {
+		base := virtualChannelBase + floor*virtualChannelsPerFloor
+		for button := 0; button < 3; button++ {
+			m.Buttons[floor][button] = base + button
+			m.Lamps[floor][button] = base + 3 + button
+		}
+		m.FloorSensors[floor] = base + 6
+	}
+	for top := numFloors - 1; top > 0; top >>= 1 {
+		m.FloorIndicator = append([]int{virtualChannelBase + len(m.FloorIndicator)*virtualChannelsPerFloor + 7}, m.FloorIndicator...)
+	}
+	m.Buttons[0][1], m.Lamps[0][1] = -1, -1
+	m.Buttons[numFloors-1][0], m.Lamps[numFloors-1][0] = -1, -1
+	return m
+}
+
+func (m ChannelMap) NumFloors() int {
+	return len(m.FloorSensors)
+}
@@ -6,30 +6,72 @@ import (
 	"log"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const debug = false
-const stopTimeInFloor int = 3
-const travelTime int = 2
 
-func AssignNewOrder(knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [N_FLOORS][2]ElevOrder, Floor, Type int) (string, error) {
+//CostFunction estimates what it costs the elevator ID to take the order at floor. The lower, the better.
+//Every elevator must come to the same answer from the same state, so a CostFunction keeps no state of its own.
+//Costs that are times are in milliseconds, from the TimingModel each elevator sends with its state.
+type CostFunction interface {
+	Cost(ID string, knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder, floor, button int) int
+}
+
+const Default = "heuristic"
+
+//Functions are the cost functions that can be chosen by name
+var Functions = map[string]CostFunction{
+	"heuristic":   Heuristic{},
+	"timetoidle":  TimeToIdle{},
+	"destination": Destination{},
+	"nearest":     NearestCar{},
+	"leastloaded": LeastLoaded{},
+}
+
+func Lookup(name string) (CostFunction, error) {
+	if costFunction, ok := Functions[name]; ok {
+		return costFunction, nil
+	}
+	return nil, errors.New("COST:\t Unknown cost function " + name + ". Choose one of " + strings.Join(Names(), ", "))
+}
+
+//Names returns the names of the cost functions in alphabetical order
+func Names() []string {
+	names := []string{}
+	for name := range Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//AssignNewOrder gives the order to the active elevator that is not degraded with the lowest cost.
+//Ties go to the lowest ID.
+func AssignNewOrder(costFunction CostFunction, knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder, Floor, Type int) (string, error) {
 	numOfActiveElvators := len(activeElevators)
-	printDebug("NumOfActiveElvators" + string(numOfActiveElvators))
+	printDebug("NumOfActiveElvators" + strconv.Itoa(numOfActiveElvators))
 	if numOfActiveElvators == 0 {
 		return "", errors.New("COST:\t Can not AssignNewOrder with zero active elevators")
 	}
 	cost := elevCosts{}
-	for IP, _ := range activeElevators {
-		elevator := ExtendedElevState{knownElevators[IP].State, externalOrderMatrix}
-		numOfFloors, numStops := elevator.LengthToOrder(Floor, Type)
-		costToOrder := numOfFloors*travelTime + numStops*stopTimeInFloor
-		printDebug("Elevator: " + IP + " has cost: " + strconv.Itoa(costToOrder))
-		cost = append(cost, elevCost{costToOrder, IP})
+	for ID, _ := range activeElevators {
+		if knownElevators[ID].State.Degraded {
+			printDebug("Elevator: " + ID + " is degraded")
+			continue
+		}
+		costToOrder := costFunction.Cost(ID, knownElevators, activeElevators, externalOrderMatrix, Floor, Type)
+		printDebug("Elevator: " + ID + " has cost: " + strconv.Itoa(costToOrder))
+		cost = append(cost, elevCost{costToOrder, ID})
+	}
+	if len(cost) == 0 {
+		return "", errors.New("COST:\t Can not AssignNewOrder when every active elevator is degraded")
 	}
 	sort.Sort(cost)
-	if lowestIP := cost[0].IP; lowestIP != "" {
-		log.Println("COST:\t Assigning new order to " + lowestIP)
-		return lowestIP, nil
+	if lowestID := cost[0].ID; lowestID != "" {
+		log.Println("COST:\t Assigning new order to " + lowestID)
+		return lowestID, nil
 	} else {
 		return "", errors.New("COST:\t Something went wrong in AssignNewOrder()")
 	}
@@ -39,7 +81,7 @@ type elevCosts []elevCost
 
 type elevCost struct {
 	Cost int
-	IP   string
+	ID   string
 }
 
 func (slice elevCosts) Len() int {
@@ -50,7 +92,7 @@ func (slice elevCosts) Less(i, j int) bool {
 	if slice[i].Cost != slice[j].Cost {
 		return slice[i].Cost < slice[j].Cost
 	}
-	return slice[i].IP < slice[j].IP
+	return slice[i].ID < slice[j].ID
 }
 
 func (slice elevCosts) Swap(i, j int) {
@@ -59,7 +101,7 @@ func (slice elevCosts) Swap(i, j int) {
 
 func (slice elevCosts) Print() {
 	for _, e := range slice {
-		log.Println("COST:\t IP", e.IP, "has cost ", e.Cost)
+		log.Println("COST:\t ID", e.ID, "has cost ", e.Cost)
 	}
 }
 
@@ -68,3 +110,7 @@ func printDebug(s string) {
 		log.Println("COST:\t", s)
 	}
 }
+
+func milliseconds(d time.Duration) int {
+	return int(d / time.Millisecond)
+}
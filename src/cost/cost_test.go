@@ -0,0 +1,89 @@
+package cost
+
+import (
+	. "../typedef"
+	"testing"
+)
+
+const testFloors = 4
+
+//newTestElevators is A idle at floor 0 and B idle at floor 3 with a cab call to floor 1
+func newTestElevators() map[string]*Elevator {
+	B := NewElevState("B", 3, testFloors)
+	B.Behaviour = ElevIdle
+	B.InternalOrders[1] = true
+	A := NewElevState("A", 0, testFloors)
+	A.Behaviour = ElevIdle
+	return map[string]*Elevator{"A": ResolveElevator(A), "B": ResolveElevator(B)}
+}
+
+//TestFunctions gives the down call on floor 2 to A or B with every cost function
+func TestFunctions(t *testing.T) {
+	assignedTo := map[string]string{
+		"heuristic":   "B", //closest, and going there anyway
+		"timetoidle":  "A", //B would also have its cab call to serve before it is idle
+		"destination": "B", //on the way to the cab call, so it adds the least
+		"nearest":     "B",
+		"leastloaded": "A", //B has a cab call
+	}
+	for _, name := range Names() {
+		want, ok := assignedTo[name]
+		if !ok {
+			t.Errorf("the cost function %s is not tested", name)
+			continue
+		}
+		costFunction, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ID, err := AssignNewOrder(costFunction, newTestElevators(), map[string]bool{"A": true, "B": true}, NewExternalOrderMatrix(testFloors), 2, BUTTON_CALL_DOWN)
+		if err != nil || ID != want {
+			t.Errorf("%s: the order is assigned to %q (%v), want %q", name, ID, err, want)
+		}
+	}
+}
+
+func TestAssignNewOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		degraded   []string
+		active     []string
+		setup      func(knownElevators map[string]*Elevator)
+		assignedTo string //"" for an error
+	}{
+		{name: "the lowest cost wins", active: []string{"A", "B"}, assignedTo: "B"},
+		{name: "an elevator that is not active is not assigned", active: []string{"A"}, assignedTo: "A"},
+		{name: "a degraded elevator is skipped", degraded: []string{"B"}, active: []string{"A", "B"}, assignedTo: "A"},
+		{name: "every active elevator is degraded", degraded: []string{"A", "B"}, active: []string{"A", "B"}},
+		{name: "no active elevators"},
+		{
+			name:   "ties go to the lowest ID",
+			active: []string{"A", "B"},
+			setup: func(knownElevators map[string]*Elevator) {
+				knownElevators["A"].State = knownElevators["B"].State.Copy()
+				knownElevators["A"].State.ID = "A"
+			},
+			assignedTo: "A",
+		},
+	}
+	for _, test := range tests {
+		knownElevators := newTestElevators()
+		if test.setup != nil {
+			test.setup(knownElevators)
+		}
+		for _, ID := range test.degraded {
+			knownElevators[ID].State.Degraded = true
+		}
+		activeElevators := make(map[string]bool)
+		for _, ID := range test.active {
+			activeElevators[ID] = true
+		}
+		ID, err := AssignNewOrder(Heuristic{}, knownElevators, activeElevators, NewExternalOrderMatrix(testFloors), 2, BUTTON_CALL_DOWN)
+		switch {
+		case test.assignedTo == "" && err == nil:
+			t.Errorf("%s: the order is assigned to %q, want an error", test.name, ID)
+		case test.assignedTo != "" && (err != nil || ID != test.assignedTo):
+			t.Errorf("%s: the order is assigned to %q (%v), want %q", test.name, ID, err, test.assignedTo)
+		}
+	}
+}
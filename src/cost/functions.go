@@ -0,0 +1,156 @@
+package cost
+
+import (
+	. "../typedef"
+)
+
+//Heuristic counts the floors the elevator has to travel and the stops it has to make on the way,
+//and weighs them with how long the elevator takes to pass a floor and to stop
+type Heuristic struct{}
+
+func (Heuristic) Cost(ID string, knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder, floor, button int) int {
+	elevator := ExtendedElevState{LocalState: knownElevators[ID].State, ExternalOrders: externalOrderMatrix}
+	timing := elevator.LocalState.TimingModel()
+	numOfFloors, numStops := elevator.LengthToOrder(floor, button)
+	return numOfFloors*milliseconds(timing.FloorTime()) + numStops*milliseconds(timing.StopTime())
+}
+
+//TimeToIdle simulates the elevator with the order added until it has served all of its orders,
+//and counts how long that takes
+type TimeToIdle struct{}
+
+func (TimeToIdle) Cost(ID string, knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder, floor, button int) int {
+	return simulate(withOrder(ID, knownElevators, externalOrderMatrix, floor, button, true), ID)
+}
+
+//Destination is the time the order adds to the time to idle of the elevator. It is meant for
+//destination dispatch, where the elevator also has to take the passengers it picks up to their
+//destinations. A passenger adds little to an elevator that already stops on the way and where the
+//passenger is going, so the passengers with the same destinations are put in the same car.
+type Destination struct{}
+
+func (Destination) Cost(ID string, knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder, floor, button int) int {
+	with := simulate(withOrder(ID, knownElevators, externalOrderMatrix, floor, button, true), ID)
+	without := simulate(withOrder(ID, knownElevators, externalOrderMatrix, floor, button, false), ID)
+	return with - without
+}
+
+//withOrder copies the state of the elevator ID and the matrix, with the order at floor, button
+//assigned to ID if add is set and left out otherwise
+func withOrder(ID string, knownElevators map[string]*Elevator, externalOrderMatrix [][2]ElevOrder, floor, button int, add bool) ExtendedElevState {
+	elevator := ExtendedElevState{LocalState: knownElevators[ID].State.Copy(), ExternalOrders: make([][2]ElevOrder, len(externalOrderMatrix))}
+	for f := range externalOrderMatrix {
+		for b := range externalOrderMatrix[f] {
+			order := externalOrderMatrix[f][b]
+			elevator.ExternalOrders[f][b] = ElevOrder{Status: order.Status, AssignedTo: order.AssignedTo, Destinations: order.Destinations}
+		}
+	}
+	if add {
+		elevator.ExternalOrders[floor][button] = ElevOrder{Status: UnderExecution, AssignedTo: ID, Destinations: externalOrderMatrix[floor][button].Destinations}
+	} else {
+		elevator.ExternalOrders[floor][button] = ElevOrder{}
+	}
+	return elevator
+}
+
+//simulate runs the elevator ID until it has served all of its orders, and returns how long it took
+//in milliseconds. The orders of the elevator are cleared on the way.
+func simulate(elevator ExtendedElevState, ID string) int {
+	numFloors := elevator.LocalState.NumFloors()
+	timing := elevator.LocalState.TimingModel()
+	floorTime, stopTime := milliseconds(timing.FloorTime()), milliseconds(timing.StopTime())
+	duration := 0
+	switch {
+	case elevator.LocalState.IsMoving() && elevator.LocalState.Direction != STOP:
+		elevator.LocalState.LastFloor += elevator.LocalState.Direction
+		duration += floorTime / 2
+	case elevator.LocalState.DoorIsOpen():
+		duration -= milliseconds(timing.DoorWait) / 2
+	}
+	//Every floor is passed at most twice before the elevator turns for good
+	for step := 0; step < 4*numFloors; step++ {
+		if elevator.LocalState.LastFloor < 0 || elevator.LocalState.LastFloor >= numFloors {
+			break
+		}
+		if elevator.ShouldStop() {
+			if elevator.HaveOrdersAtCurrentFloor() {
+				clearOrdersAtFloor(elevator, ID)
+				duration += stopTime
+			}
+			if elevator.LocalState.Direction = elevator.GetNextDirection(); elevator.LocalState.Direction == STOP {
+				return duration
+			}
+		}
+		elevator.LocalState.LastFloor += elevator.LocalState.Direction
+		duration += floorTime
+	}
+	printDebug("The simulation of " + ID + " did not become idle")
+	return duration + 4*numFloors*floorTime
+}
+
+//clearOrdersAtFloor does what the elevator does when it opens the doors. The passengers it picks up
+//give it their destinations.
+func clearOrdersAtFloor(elevator ExtendedElevState, ID string) {
+	floor := elevator.LocalState.LastFloor
+	elevator.LocalState.InternalOrders[floor] = false
+	for button := range elevator.ExternalOrders[floor] {
+		order := &elevator.ExternalOrders[floor][button]
+		if order.AssignedTo != ID {
+			continue
+		}
+		for _, destination := range order.Destinations.Floors() {
+			if destination < len(elevator.LocalState.InternalOrders) {
+				elevator.LocalState.InternalOrders[destination] = true
+			}
+		}
+		order.Status = NotActive
+		order.Destinations = 0
+	}
+}
+
+//NearestCar is the figure of suitability of the nearest car algorithm, turned into a cost.
+//An elevator moving towards the order in the direction of the order suits best, then an idle
+//elevator or one moving towards the order in the other direction, by distance. An elevator
+//moving away from the order suits least.
+type NearestCar struct{}
+
+func (NearestCar) Cost(ID string, knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder, floor, button int) int {
+	state := knownElevators[ID].State
+	maxDistance := state.NumFloors() - 1
+	distance := floor - state.LastFloor
+	direction := UP
+	if distance < 0 {
+		distance, direction = -distance, DOWN
+	}
+	suitability := maxDistance + 1 - distance
+	switch {
+	case state.Direction == STOP || distance == 0:
+	case state.Direction != direction:
+		suitability = 1
+	case (direction == UP && button == BUTTON_CALL_UP) || (direction == DOWN && button == BUTTON_CALL_DOWN):
+		suitability++
+	}
+	return maxDistance + 2 - suitability
+}
+
+//LeastLoaded spreads the orders evenly. It gives the order to the elevator with the fewest orders,
+//internal and under execution. It does not rotate: between elevators that are equally busy the order
+//goes to the lowest ID, like every tie.
+type LeastLoaded struct{}
+
+func (LeastLoaded) Cost(ID string, knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder, floor, button int) int {
+	orders := 0
+	for _, internal := range knownElevators[ID].State.InternalOrders {
+		if internal {
+			orders++
+		}
+	}
+	for f := range externalOrderMatrix {
+		for _, order := range externalOrderMatrix[f] {
+			if order.Status == UnderExecution && order.AssignedTo == ID {
+				orders++
+			}
+		}
+	}
+	return orders
+}
@@ -0,0 +1,155 @@
+package cost
+
+import (
+	. "../typedef"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const DefaultHysteresis = 4 * time.Second
+
+//maxSearch bounds the number of partial assignments GlobalAssigner looks at. The best one found
+//so far is used when it runs out, so a big building gets a good assignment instead of a late one.
+const maxSearch = 100000
+
+//Move tells that the order at Floor, Type should go from one elevator to another
+type Move struct {
+	Floor int
+	Type  int
+	From  string
+	To    string
+}
+
+//GlobalAssigner looks for the assignment of every hall order under execution that lets the
+//elevators finish their orders soonest, counted as the sum of their time to idle. It uses
+//time to idle whatever the cost function, as it needs the cost of a whole set of orders.
+type GlobalAssigner struct {
+	Hysteresis time.Duration //how much sooner the elevators must finish before orders are moved
+}
+
+type hallCall struct {
+	floor, button int
+	assignedTo    int //index into the elevators
+	destinations  FloorSet
+}
+
+//Reassign returns the orders that should move to another elevator. Orders assigned to an elevator that
+//is lost or degraded are left out, they are reassigned as soon as that is noticed. Nothing is moved
+//unless the new assignment beats the current one by more than the hysteresis.
+func (g GlobalAssigner) Reassign(knownElevators map[string]*Elevator, activeElevators map[string]bool, externalOrderMatrix [][2]ElevOrder) []Move {
+	elevators := []string{}
+	for ID := range activeElevators {
+		if elevator, ok := knownElevators[ID]; ok && !elevator.State.Degraded {
+			elevators = append(elevators, ID)
+		}
+	}
+	sort.Strings(elevators)
+	index := make(map[string]int)
+	for i, ID := range elevators {
+		index[ID] = i
+	}
+	calls := []hallCall{}
+	for floor := range externalOrderMatrix {
+		for button, order := range externalOrderMatrix[floor] {
+			if i, ok := index[order.AssignedTo]; ok && order.Status == UnderExecution {
+				calls = append(calls, hallCall{floor, button, i, order.Destinations})
+			}
+		}
+	}
+	if len(elevators) < 2 || len(calls) == 0 {
+		return nil
+	}
+
+	search := assignmentSearch{
+		knownElevators: knownElevators,
+		elevators:      elevators,
+		calls:          calls,
+		numFloors:      len(externalOrderMatrix),
+		assignment:     make([]int, len(calls)),
+		costs:          make([]int, len(elevators)),
+	}
+	current := make([]int, len(calls))
+	for i, call := range calls {
+		current[i] = call.assignedTo
+	}
+	currentCost := search.total(current)
+	search.best, search.bestCost = current, currentCost
+	for e := range elevators {
+		search.costs[e] = search.timeToIdle(e, 0)
+	}
+	search.branch(0)
+	if currentCost-search.bestCost <= milliseconds(g.Hysteresis) {
+		return nil
+	}
+	printDebug("Found an assignment finishing in " + strconv.Itoa(search.bestCost) + "ms instead of " + strconv.Itoa(currentCost) + "ms")
+	moves := []Move{}
+	for i, call := range calls {
+		if to := search.best[i]; to != call.assignedTo {
+			moves = append(moves, Move{Floor: call.floor, Type: call.button, From: elevators[call.assignedTo], To: elevators[to]})
+		}
+	}
+	return moves
+}
+
+//assignmentSearch is a branch and bound over the assignments of the calls, one call at a time.
+//A branch is cut when the elevators already take longer than the best assignment so far. Giving
+//an elevator another order hardly ever makes it finish sooner, so little is lost by cutting.
+type assignmentSearch struct {
+	knownElevators map[string]*Elevator
+	elevators      []string
+	calls          []hallCall
+	numFloors      int
+	assignment     []int //the elevator of each of the first calls
+	costs          []int //the time to idle of each elevator with the calls assigned so far
+	best           []int
+	bestCost       int
+	searched       int
+}
+
+func (s *assignmentSearch) branch(next int) {
+	s.searched++
+	if s.searched > maxSearch {
+		return
+	}
+	total := 0
+	for _, cost := range s.costs {
+		total += cost
+	}
+	if total >= s.bestCost {
+		return
+	}
+	if next == len(s.calls) {
+		s.best, s.bestCost = append([]int(nil), s.assignment...), total
+		return
+	}
+	for e := range s.elevators {
+		s.assignment[next] = e
+		previous := s.costs[e]
+		s.costs[e] = s.timeToIdle(e, next+1)
+		s.branch(next + 1)
+		s.costs[e] = previous
+	}
+}
+
+func (s *assignmentSearch) total(assignment []int) int {
+	copy(s.assignment, assignment)
+	total := 0
+	for e := range s.elevators {
+		total += s.timeToIdle(e, len(assignment))
+	}
+	return total
+}
+
+//timeToIdle simulates elevator e with the first numCalls calls that are assigned to it
+func (s *assignmentSearch) timeToIdle(e, numCalls int) int {
+	ID := s.elevators[e]
+	elevator := ExtendedElevState{LocalState: s.knownElevators[ID].State.Copy(), ExternalOrders: make([][2]ElevOrder, s.numFloors)}
+	for i := 0; i < numCalls; i++ {
+		if s.assignment[i] == e {
+			call := s.calls[i]
+			elevator.ExternalOrders[call.floor][call.button] = ElevOrder{Status: UnderExecution, AssignedTo: ID, Destinations: call.destinations}
+		}
+	}
+	return simulate(elevator, ID)
+}
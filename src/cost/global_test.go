@@ -0,0 +1,48 @@
+package cost
+
+import (
+	. "../typedef"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReassign(t *testing.T) {
+	const numFloors = 6
+	//A at floor 0 has the down call on floor 5, where B is. Giving it to B saves A the five floors.
+	gain := 5 * DefaultTimingModel.FloorTime()
+	tests := []struct {
+		name       string
+		floorA     int
+		assignedTo string
+		hysteresis time.Duration
+		moves      []Move
+	}{
+		{name: "the gain is below the hysteresis", assignedTo: "A", hysteresis: gain + time.Second},
+		{name: "the gain is the hysteresis", assignedTo: "A", hysteresis: gain},
+		{
+			name:       "the gain is above the hysteresis",
+			assignedTo: "A",
+			hysteresis: gain - time.Second,
+			moves:      []Move{{Floor: 5, Type: BUTTON_CALL_DOWN, From: "A", To: "B"}},
+		},
+		{name: "the order is assigned to the best elevator already", assignedTo: "B"},
+		{name: "the elevators have the same cost, and the order is assigned to A", floorA: 5, assignedTo: "A"},
+		{name: "the elevators have the same cost, and the order is assigned to B", floorA: 5, assignedTo: "B"},
+	}
+	for _, test := range tests {
+		A, B := NewElevState("A", test.floorA, numFloors), NewElevState("B", 5, numFloors)
+		A.Behaviour, B.Behaviour = ElevIdle, ElevIdle
+		knownElevators := map[string]*Elevator{"A": ResolveElevator(A), "B": ResolveElevator(B)}
+		activeElevators := map[string]bool{"A": true, "B": true}
+		matrix := NewExternalOrderMatrix(numFloors)
+		matrix[5][BUTTON_CALL_DOWN] = ElevOrder{Status: UnderExecution, AssignedTo: test.assignedTo}
+		g := GlobalAssigner{Hysteresis: test.hysteresis}
+		for i := 0; i < 10; i++ { //the elevators are found in a map, in any order
+			if moves := g.Reassign(knownElevators, activeElevators, matrix); !reflect.DeepEqual(moves, test.moves) {
+				t.Errorf("%s: got the moves %+v, want %+v", test.name, moves, test.moves)
+				break
+			}
+		}
+	}
+}
@@ -4,31 +4,69 @@ package driver
 #include "io.h"
 */
 import ("C")
-import("errors")
+import(
+	"errors"
+	"strconv"
+)
 
-func IOInit() error {
+//The lab elevators have four floors
+const numHardwareFloors = 4
+
+//Comedi is the IODriver for the physical elevator in the real time lab
+type Comedi struct{}
+
+func New() *Comedi {
+	return &Comedi{}
+}
+
+func (c *Comedi) Init(numFloors int) error {
+	if numFloors != numHardwareFloors {
+		return errors.New("The lab elevator has " + strconv.Itoa(numHardwareFloors) + " floors, not " + strconv.Itoa(numFloors))
+	}
 	if err := int(C.io_init()); err == 0 {
 		return errors.New("Could not initialise Comedy!")
 	}
 	return nil
 }
 
-func IO_set_bit(channel int) {
+func (c *Comedi) SetBit(channel int) {
 	C.io_set_bit(C.int(channel))
 }
 
-func IO_clear_bit(channel int) {
+func (c *Comedi) ClearBit(channel int) {
 	C.io_clear_bit(C.int(channel))
 }
 
-func IO_write_analog(channel, value int) {
+func (c *Comedi) WriteAnalog(channel, value int) {
 	C.io_write_analog(C.int(channel), C.int(value))
 }
 
-func IO_read_bit(channel int) bool {
+func (c *Comedi) ReadBit(channel int) bool {
 	return bool(int(C.io_read_bit(C.int(channel))) != 0)
 }
 
-func IO_read_analog(channel int) int {
+//ReadBits reads the channels in one comedi call per subdevice instead of one per channel.
+//Channels io_read_bits can not read in a batch are read one by one.
+func (c *Comedi) ReadBits(channels []int, values []bool) {
+	if len(channels) == 0 {
+		return
+	}
+	cChannels := make([]C.int, len(channels))
+	cValues := make([]C.int, len(channels))
+	for i, channel := range channels {
+		cChannels[i] = C.int(channel)
+	}
+	if int(C.io_read_bits(&cChannels[0], &cValues[0], C.int(len(channels)))) == 0 {
+		for i, channel := range channels {
+			values[i] = c.ReadBit(channel)
+		}
+		return
+	}
+	for i := range channels {
+		values[i] = cValues[i] != 0
+	}
+}
+
+func (c *Comedi) ReadAnalog(channel int) int {
 	return int(C.io_read_analog(C.int(channel)))
 }
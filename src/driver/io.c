@@ -48,6 +48,28 @@ int io_read_bit(int channel) {
     return (int)data;
 }
 
+// Reads n channels with one comedi call per subdevice.
+// Returns 0, and reads nothing, if a channel is not among the first 32 of one of the first 16 subdevices.
+int io_read_bits(const int *channels, int *values, int n) {
+    unsigned int bits[16] = {0};
+    int read[16] = {0};
+    int i = 0;
+
+    for (i = 0; i < n; i++) {
+        if (channels[i] < 0 || (channels[i] >> 8) >= 16 || (channels[i] & 0xff) >= 32)
+            return 0;
+    }
+    for (i = 0; i < n; i++) {
+        int subdevice = (channels[i] >> 8) & 0xf;
+        if (!read[subdevice]) {
+            comedi_dio_bitfield2(it_g, subdevice, 0, &bits[subdevice], 0);
+            read[subdevice] = 1;
+        }
+        values[i] = (bits[subdevice] >> (channels[i] & 0xff)) & 1;
+    }
+    return 1;
+}
+
 int io_read_analog(int channel) {
     lsampl_t data = 0;
     comedi_data_read(it_g, channel >> 8, channel & 0xff, 0, AREF_GROUND, &data);
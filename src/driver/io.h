@@ -8,6 +8,8 @@ void io_set_bit(int channel);
 void io_clear_bit(int channel);
 void io_write_analog(int channel, int value);
 int io_read_bit(int channel);
+// Returns 0 if a channel can not be read in a batch
+int io_read_bits(const int *channels, int *values, int n);
 int io_read_analog(int channel);
 
 #endif
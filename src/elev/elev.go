@@ -2,8 +2,6 @@ package elev
 
 import (
 	. "../channels"
-	. "../driver"
-	//. "../simulatorCore"
 	. "../typedef"
 	"log"
 	"math"
@@ -14,24 +12,26 @@ const debug = false
 const maxSpeed int = 14 //Valid speeds = 0-14
 const ElevatorStopDelay = 50 * time.Millisecond
 
-var lampMatrix = [N_FLOORS][3]int{
-	{LIGHT_UP1, LIGHT_DOWN1, LIGHT_COMMAND1},
-	{LIGHT_UP2, LIGHT_DOWN2, LIGHT_COMMAND2},
-	{LIGHT_UP3, LIGHT_DOWN3, LIGHT_COMMAND3},
-	{LIGHT_UP4, LIGHT_DOWN4, LIGHT_COMMAND4},
+//IODriver is the hardware abstraction elev runs on top of. It is implemented by
+//the comedi driver, the simulator and the in-memory fake driver.
+type IODriver interface {
+	Init(numFloors int) error
+	SetBit(channel int)
+	ClearBit(channel int)
+	ReadBit(channel int) bool
+	WriteAnalog(channel, value int)
+	ReadAnalog(channel int) int
 }
 
-var buttonMatrix = [N_FLOORS][3]int{
-	{BUTTON_UP1, BUTTON_DOWN1, BUTTON_COMMAND1},
-	{BUTTON_UP2, BUTTON_DOWN2, BUTTON_COMMAND2},
-	{BUTTON_UP3, BUTTON_DOWN3, BUTTON_COMMAND3},
-	{BUTTON_UP4, BUTTON_DOWN4, BUTTON_COMMAND4},
+//Lamps is every lamp but the floor indicator, which follows the floor sensor
+type Lamps struct {
+	Buttons [][3]bool //[floor][button type], the lamps a floor does not have are ignored
+	Door    bool
+	Stop    bool
 }
 
-type ElevLight struct {
-	Type   int
-	Floor  int
-	Active bool
+func NewLamps(numFloors int) Lamps {
+	return Lamps{Buttons: make([][3]bool, numFloors)}
 }
 
 type ElevButton struct {
@@ -39,18 +39,30 @@ type ElevButton struct {
 	Floor int
 }
 
-func Init(buttonChannel chan<- ElevButton, lightChannel <-chan ElevLight, motorChannel chan int, floorChannel chan<- int, pollDelay time.Duration) error {
-	if err := IOInit(); err != nil {
+//FloorEvent is the sensor of Floor turning on, or the car leaving the sensor it was on when Floor is -1
+type FloorEvent struct {
+	Floor int
+	Time  time.Time //when the sensor changed, see InputEdge
+}
+
+//Init drives the car to a floor if it is between floors, and starts reading the inputs. The buttons and
+//switches must be read at a new level for debounce before the change is believed, the floor sensors not.
+func Init(io IODriver, numFloors int, buttonChannel chan<- ElevButton, lampChannel <-chan Lamps, motorChannel chan int, floorChannel chan<- FloorEvent, obstructionChannel chan<- bool, motorFaultChannel chan<- MotorFault, pollDelay, debounce time.Duration) error {
+	if err := io.Init(numFloors); err != nil {
 		log.Println("ELEV:\t IOInit error")
 		return err
 	}
-	resetAllLights()
-	go lightController(lightChannel)
-	go motorController(motorChannel)
-	if getFloorSensor() == -1 {
+	channels := NewChannelMap(numFloors)
+	resetAllLights(io, channels)
+	motionChannel := make(chan int)
+	sensorChannel := make(chan FloorEvent)
+	go runMotorWatchdog(motionChannel, sensorChannel, motorFaultChannel, pollDelay)
+	go lightController(io, channels, lampChannel)
+	go motorController(io, motorChannel, motionChannel)
+	if getFloorSensor(io, channels) == -1 {
 		motorChannel <- DOWN
 		for {
-			if getFloorSensor() != -1 {
+			if getFloorSensor(io, channels) != -1 {
 				motorChannel <- STOP
 				break
 			} else {
@@ -58,152 +70,184 @@ func Init(buttonChannel chan<- ElevButton, lightChannel <-chan ElevLight, motorC
 			}
 		}
 	}
-	go readInputs(buttonChannel, pollDelay)
-	go readFloorSensor(floorChannel, pollDelay)
+	scanner := NewInputScanner(io, pollDelay)
+	inputs := []int{STOP_BUTTON, OBSTRUCTION}
+	for Floor := 0; Floor < channels.NumFloors(); Floor++ {
+		for Type := BUTTON_CALL_UP; Type <= BUTTON_COMMAND; Type++ {
+			if channels.Buttons[Floor][Type] != -1 {
+				inputs = append(inputs, channels.Buttons[Floor][Type])
+			}
+		}
+	}
+	for _, channel := range inputs {
+		scanner.SetDebounce(channel, debounce)
+	}
+	inputEdges := scanner.Subscribe(inputs...)
+	floorEdges := scanner.Subscribe(channels.FloorSensors...)
+	scanner.Start()
+	go readInputs(channels, inputEdges, buttonChannel, obstructionChannel)
+	go readFloorSensor(io, channels, floorEdges, floorChannel, sensorChannel)
 	return nil
 }
 
-func readInputs(buttonChannel chan<- ElevButton, pollDelay time.Duration) {
-	inputMatrix := [N_FLOORS][3]bool{}
-	var stopButton bool = false
-	for {
+//readInputs sends the buttons when they are pressed, and the obstruction switch whenever it changes
+func readInputs(channels ChannelMap, edges <-chan InputEdge, buttonChannel chan<- ElevButton, obstructionChannel chan<- bool) {
+	buttons := make(map[int]ElevButton)
+	for Floor := 0; Floor < channels.NumFloors(); Floor++ {
 		for Type := BUTTON_CALL_UP; Type <= BUTTON_COMMAND; Type++ {
-			for Floor := 0; Floor < N_FLOORS; Floor++ {
-				tempButton := IO_read_bit(buttonMatrix[Floor][Type])
-				if tempButton { //Button pressed
-					if !inputMatrix[Floor][Type] { // and first time
-						inputMatrix[Floor][Type] = true
-						buttonChannel <- ElevButton{Type, Floor}
-					}
-				} else {
-					inputMatrix[Floor][Type] = false
-				}
+			if channels.Buttons[Floor][Type] != -1 {
+				buttons[channels.Buttons[Floor][Type]] = ElevButton{Type, Floor}
 			}
 		}
-		if IO_read_bit(STOP_BUTTON) {
-			if !stopButton {
-				stopButton = true
-				buttonChannel <- ElevButton{Type: BUTTON_STOP}
-			}
-		} else {
-			stopButton = false
+	}
+	for edge := range edges {
+		switch {
+		case edge.Channel == OBSTRUCTION:
+			obstructionChannel <- edge.Active
+		case !edge.Active: //Released
+		case edge.Channel == STOP_BUTTON:
+			buttonChannel <- ElevButton{Type: BUTTON_STOP}
+		default:
+			buttonChannel <- buttons[edge.Channel]
 		}
-		time.Sleep(pollDelay)
 	}
 }
 
-func readFloorSensor(floorChannel chan<- int, pollDelay time.Duration) {
-	var lastFloor int = -1
-	for {
-		tempFloor := getFloorSensor()
-		if (tempFloor != -1) && (tempFloor != lastFloor) {
-			lastFloor = tempFloor
-			setFloorIndicator(tempFloor)
-			floorChannel <- tempFloor
+//readFloorSensor sends the floor when a floor is reached, and -1 when the sensor of a floor is left.
+//Coming back to the floor that was left counts as reaching it. Every change is also sent to the motor watchdog.
+func readFloorSensor(io IODriver, channels ChannelMap, edges <-chan InputEdge, floorChannel chan<- FloorEvent, sensorChannel chan<- FloorEvent) {
+	floors := make(map[int]int)
+	for floor, channel := range channels.FloorSensors {
+		floors[channel] = floor
+	}
+	var onFloor int = -1
+	for edge := range edges {
+		event := FloorEvent{Floor: floors[edge.Channel], Time: edge.Time}
+		if edge.Active {
+			onFloor = event.Floor
+			setFloorIndicator(io, channels, event.Floor)
+		} else if event.Floor == onFloor {
+			onFloor = -1
+			event.Floor = -1
+		} else {
+			continue
 		}
-		time.Sleep(pollDelay)
+		sensorChannel <- event
+		floorChannel <- event
 	}
 }
 
-func lightController(lightChannel <-chan ElevLight) {
-	var command ElevLight
-	for {
-		select {
-		case command = <-lightChannel:
-			switch command.Type {
-			case BUTTON_STOP:
-				if command.Active {
-					IO_set_bit(LIGHT_STOP)
-				} else {
-					IO_clear_bit(LIGHT_STOP)
-				}
-			case BUTTON_CALL_UP, BUTTON_CALL_DOWN, BUTTON_COMMAND:
-				if command.Active {
-					IO_set_bit(lampMatrix[command.Floor][command.Type])
-				} else {
-					IO_clear_bit(lampMatrix[command.Floor][command.Type])
-				}
-			case INDICATOR_DOOR:
-				if command.Active {
-					IO_set_bit(LIGHT_DOOR_OPEN)
-				} else {
-					IO_clear_bit(LIGHT_DOOR_OPEN)
+//lightController is sent the lamps as they should be. It reads the lamps back from the hardware and
+//writes the ones that differ, so a lamp that has been changed behind its back is put right the next time.
+func lightController(io IODriver, channels ChannelMap, lampChannel <-chan Lamps) {
+	lampChannels := []int{LIGHT_DOOR_OPEN, LIGHT_STOP}
+	for Floor := 0; Floor < channels.NumFloors(); Floor++ {
+		for Type := BUTTON_CALL_UP; Type <= BUTTON_COMMAND; Type++ {
+			if channels.Lamps[Floor][Type] != -1 {
+				lampChannels = append(lampChannels, channels.Lamps[Floor][Type])
+			}
+		}
+	}
+	wanted := make([]bool, len(lampChannels))
+	lit := make([]bool, len(lampChannels))
+	for lamps := range lampChannel {
+		if len(lamps.Buttons) != channels.NumFloors() {
+			log.Println("ELEV:\t Got button lamps for", len(lamps.Buttons), "floors, there are", channels.NumFloors())
+			continue
+		}
+		wanted = append(wanted[:0], lamps.Door, lamps.Stop)
+		for Floor := 0; Floor < channels.NumFloors(); Floor++ {
+			for Type := BUTTON_CALL_UP; Type <= BUTTON_COMMAND; Type++ {
+				if channels.Lamps[Floor][Type] != -1 {
+					wanted = append(wanted, lamps.Buttons[Floor][Type])
 				}
-			default:
-				log.Println("ELEV:\t You tried to torch a non-light item")
+			}
+		}
+		readBits(io, lampChannels, lit)
+		for i, channel := range lampChannels {
+			if wanted[i] != lit[i] {
+				writeLamp(io, channel, wanted[i])
 			}
 		}
 	}
 }
 
-func motorController(motorChannel <-chan int) {
+//motorController runs the motor, and tells the motor watchdog every command it has carried out
+func motorController(io IODriver, motorChannel <-chan int, motionChannel chan<- int) {
 	for {
 		select {
 		case command := <-motorChannel:
 			switch command {
 			case STOP:
 				time.Sleep(ElevatorStopDelay)
-				IO_write_analog(MOTOR, 0)
+				io.WriteAnalog(MOTOR, 0)
 			case UP:
-				IO_clear_bit(MOTORDIR)
-				IO_write_analog(MOTOR, 200*int(math.Abs(float64(maxSpeed))))
+				io.ClearBit(MOTORDIR)
+				io.WriteAnalog(MOTOR, 200*int(math.Abs(float64(maxSpeed))))
 			case DOWN:
-				IO_set_bit(MOTORDIR)
-				IO_write_analog(MOTOR, 200*int(math.Abs(float64(maxSpeed))))
+				io.SetBit(MOTORDIR)
+				io.WriteAnalog(MOTOR, 200*int(math.Abs(float64(maxSpeed))))
 			default:
 				log.Println("ELEV:\t Invalid motor command: ", command)
+				continue
 			}
+			motionChannel <- command
 		}
 	}
 }
 
 //---------------SubFunctions-------------------
-func setFloorIndicator(floor int) {
-	if floor >= N_FLOORS {
-		floor = N_FLOORS - 1
-		log.Println("ELEV:\t Prøvde å sette etasjelys over", N_FLOORS-1)
+func setFloorIndicator(io IODriver, channels ChannelMap, floor int) {
+	if floor >= channels.NumFloors() {
+		floor = channels.NumFloors() - 1
+		log.Println("ELEV:\t Prøvde å sette etasjelys over", channels.NumFloors()-1)
 	} else if floor < 0 {
 		floor = 0
 		log.Println("ELEV:\t Prøvde å sette etasjelys under 0")
 	}
-	if bool((floor & 0x02) != 0) {
-		IO_set_bit(LIGHT_FLOOR_IND1)
-	} else {
-		IO_clear_bit(LIGHT_FLOOR_IND1)
+	width := len(channels.FloorIndicator)
+	for i, channel := range channels.FloorIndicator {
+		if floor&(1<<uint(width-1-i)) != 0 {
+			io.SetBit(channel)
+		} else {
+			io.ClearBit(channel)
+		}
 	}
-	if bool((floor & 0x01) != 0) {
-		IO_set_bit(LIGHT_FLOOR_IND2)
+}
+
+func writeLamp(io IODriver, channel int, lit bool) {
+	if lit {
+		io.SetBit(channel)
 	} else {
-		IO_clear_bit(LIGHT_FLOOR_IND2)
+		io.ClearBit(channel)
 	}
 }
 
-func getFloorSensor() int {
-	if IO_read_bit(SENSOR_FLOOR1) {
-		return 0
-	} else if IO_read_bit(SENSOR_FLOOR2) {
-		return 1
-	} else if IO_read_bit(SENSOR_FLOOR3) {
-		return 2
-	} else if IO_read_bit(SENSOR_FLOOR4) {
-		return 3
-	} else {
-		return -1
+func getFloorSensor(io IODriver, channels ChannelMap) int {
+	for floor, channel := range channels.FloorSensors {
+		if io.ReadBit(channel) {
+			return floor
+		}
 	}
+	return -1
 }
 
-func resetAllLights() {
+func resetAllLights(io IODriver, channels ChannelMap) {
 	for Type := BUTTON_CALL_UP; Type <= BUTTON_COMMAND; Type++ {
-		for Floor := 0; Floor < N_FLOORS; Floor++ {
-			IO_clear_bit(lampMatrix[Floor][Type])
+		for Floor := 0; Floor < channels.NumFloors(); Floor++ {
+			if channels.Lamps[Floor][Type] != -1 {
+				io.ClearBit(channels.Lamps[Floor][Type])
+			}
 		}
 	}
-	IO_clear_bit(LIGHT_DOOR_OPEN)
-	IO_clear_bit(LIGHT_STOP)
+	io.ClearBit(LIGHT_DOOR_OPEN)
+	io.ClearBit(LIGHT_STOP)
 }
 
-func printFloorSensors() {
-	log.Printf("ELEV:\t FloorSensors: \t0:%v \t1:%v \t2:%v \t3:%v\n",
-		IO_read_bit(SENSOR_FLOOR1), IO_read_bit(SENSOR_FLOOR2),
-		IO_read_bit(SENSOR_FLOOR3), IO_read_bit(SENSOR_FLOOR4))
+func printFloorSensors(io IODriver, channels ChannelMap) {
+	sensors := make([]bool, channels.NumFloors())
+	for floor, channel := range channels.FloorSensors {
+		sensors[floor] = io.ReadBit(channel)
+	}
+	log.Printf("ELEV:\t FloorSensors: %v\n", sensors)
 }
@@ -0,0 +1,43 @@
+package elev
+
+import (
+	. "../channels"
+	"../fakeDriver"
+	"testing"
+)
+
+//TestFloorIndicator shows every floor and reads it back from the indicator
+func TestFloorIndicator(t *testing.T) {
+	tests := []struct {
+		numFloors int
+		width     int
+	}{
+		{2, 1},
+		{3, 2},
+		{HardwareNumFloors, 2},
+		{5, 3},
+		{8, 3},
+		{9, 4},
+	}
+	for _, test := range tests {
+		channels := NewChannelMap(test.numFloors)
+		if len(channels.FloorIndicator) != test.width {
+			t.Errorf("%d floors: the indicator is %d bits wide, want %d", test.numFloors, len(channels.FloorIndicator), test.width)
+			continue
+		}
+		io := fakeDriver.New()
+		for floor := 0; floor < test.numFloors; floor++ {
+			setFloorIndicator(io, channels, floor)
+			shown := 0
+			for _, channel := range channels.FloorIndicator {
+				shown <<= 1
+				if io.ReadBit(channel) {
+					shown |= 1
+				}
+			}
+			if shown != floor {
+				t.Errorf("%d floors: floor %d is shown as %d", test.numFloors, floor, shown)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package elev
+
+import (
+	"time"
+)
+
+//BatchReader is an IODriver that can read many input bits in one call.
+//The InputScanner reads every input with it when the driver has it, and bit by bit otherwise.
+type BatchReader interface {
+	ReadBits(channels []int, values []bool)
+}
+
+//InputEdge is an input channel changing level. Time is when the new level was first read, and has
+//the monotonic clock reading of time.Now, so edges can be timed against each other.
+type InputEdge struct {
+	Channel int
+	Active  bool //true when pressed, false when released
+	Time    time.Time
+}
+
+//InputScanner reads every subscribed input channel once per scan, debounces them and sends the
+//edges to the subscribers. Inputs that are active at the first scan are sent as pressed.
+//A subscriber that falls behind gets every edge later, and holds up neither the scan nor the others.
+type InputScanner struct {
+	io          IODriver
+	scanDelay   time.Duration
+	channels    []int
+	inputs      map[int]*input
+	subscribers map[int][]chan InputEdge
+}
+
+type input struct {
+	debounce  time.Duration
+	level     bool
+	changing  bool //the input has been read at the other level since changedAt
+	changedAt time.Time
+}
+
+func NewInputScanner(io IODriver, scanDelay time.Duration) *InputScanner {
+	return &InputScanner{
+		io:          io,
+		scanDelay:   scanDelay,
+		inputs:      make(map[int]*input),
+		subscribers: make(map[int][]chan InputEdge),
+	}
+}
+
+//Subscribe returns the edges of the channels, in the order they happened. It must be called before Start.
+func (s *InputScanner) Subscribe(channels ...int) <-chan InputEdge {
+	queue := make(chan InputEdge)
+	edges := make(chan InputEdge)
+	go forwardEdges(queue, edges)
+	for _, channel := range channels {
+		s.add(channel)
+		s.subscribers[channel] = append(s.subscribers[channel], queue)
+	}
+	return edges
+}
+
+//SetDebounce sets how long the channel must be read at a new level before the edge is sent.
+//The edge has the time the new level was first read.
+func (s *InputScanner) SetDebounce(channel int, debounce time.Duration) {
+	s.add(channel).debounce = debounce
+}
+
+func (s *InputScanner) Start() {
+	go s.run()
+}
+
+func (s *InputScanner) add(channel int) *input {
+	if in, ok := s.inputs[channel]; ok {
+		return in
+	}
+	in := &input{}
+	s.inputs[channel] = in
+	s.channels = append(s.channels, channel)
+	return in
+}
+
+func (s *InputScanner) run() {
+	values := make([]bool, len(s.channels))
+	for {
+		readBits(s.io, s.channels, values)
+		now := time.Now()
+		for i, channel := range s.channels {
+			if edge, ok := s.inputs[channel].scan(values[i], now); ok {
+				edge.Channel = channel
+				for _, subscriber := range s.subscribers[channel] {
+					subscriber <- edge
+				}
+			}
+		}
+		time.Sleep(s.scanDelay)
+	}
+}
+
+//forwardEdges keeps the edges from the scanner until the subscriber has taken them
+func forwardEdges(queue <-chan InputEdge, edges chan<- InputEdge) {
+	pending := []InputEdge{}
+	for {
+		var next InputEdge
+		var out chan<- InputEdge //nil, and never ready, while there is nothing to send
+		if len(pending) != 0 {
+			next, out = pending[0], edges
+		}
+		select {
+		case edge := <-queue:
+			pending = append(pending, edge)
+		case out <- next:
+			pending = pending[1:]
+		}
+	}
+}
+
+//readBits reads the channels in one call when the driver can
+func readBits(io IODriver, channels []int, values []bool) {
+	if batch, ok := io.(BatchReader); ok {
+		batch.ReadBits(channels, values)
+		return
+	}
+	for i, channel := range channels {
+		values[i] = io.ReadBit(channel)
+	}
+}
+
+//scan debounces a new reading of the input, and returns the edge when the input has changed level
+func (in *input) scan(value bool, now time.Time) (InputEdge, bool) {
+	if value == in.level {
+		in.changing = false
+		return InputEdge{}, false
+	}
+	if !in.changing {
+		in.changing, in.changedAt = true, now
+	}
+	if now.Sub(in.changedAt) < in.debounce {
+		return InputEdge{}, false
+	}
+	in.level, in.changing = value, false
+	return InputEdge{Active: value, Time: in.changedAt}, true
+}
@@ -0,0 +1,127 @@
+package elev
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScanDebounce(t *testing.T) {
+	type reading struct {
+		value bool
+		at    time.Duration //since the first reading
+	}
+	type edge struct {
+		active bool
+		at     time.Duration
+	}
+	tests := []struct {
+		name     string
+		debounce time.Duration
+		readings []reading
+		edges    []edge
+	}{
+		{
+			name:     "no debounce",
+			readings: []reading{{true, 0}, {false, 10 * time.Millisecond}},
+			edges:    []edge{{true, 0}, {false, 10 * time.Millisecond}},
+		},
+		{
+			name:     "pressed for the debounce",
+			debounce: 20 * time.Millisecond,
+			readings: []reading{{true, 0}, {true, 10 * time.Millisecond}, {true, 20 * time.Millisecond}, {true, 30 * time.Millisecond}},
+			edges:    []edge{{true, 0}},
+		},
+		{
+			name:     "pressed for less than the debounce",
+			debounce: 20 * time.Millisecond,
+			readings: []reading{{true, 0}, {true, 10 * time.Millisecond}, {false, 15 * time.Millisecond}, {false, 40 * time.Millisecond}},
+			edges:    nil,
+		},
+		{
+			name:     "bouncing",
+			debounce: 20 * time.Millisecond,
+			readings: []reading{{true, 0}, {false, 5 * time.Millisecond}, {true, 10 * time.Millisecond}, {true, 25 * time.Millisecond}, {true, 30 * time.Millisecond}},
+			edges:    []edge{{true, 10 * time.Millisecond}},
+		},
+		{
+			name:     "pressed and released",
+			debounce: 20 * time.Millisecond,
+			readings: []reading{{true, 0}, {true, 20 * time.Millisecond}, {false, 50 * time.Millisecond}, {false, 60 * time.Millisecond}, {false, 70 * time.Millisecond}},
+			edges:    []edge{{true, 0}, {false, 50 * time.Millisecond}},
+		},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		in := &input{debounce: test.debounce}
+		var edges []edge
+		for _, r := range test.readings {
+			if e, ok := in.scan(r.value, start.Add(r.at)); ok {
+				edges = append(edges, edge{e.Active, e.Time.Sub(start)})
+			}
+		}
+		if len(edges) != len(test.edges) {
+			t.Errorf("%s: got the edges %v, want %v", test.name, edges, test.edges)
+			continue
+		}
+		for i := range edges {
+			if edges[i] != test.edges[i] {
+				t.Errorf("%s: got the edges %v, want %v", test.name, edges, test.edges)
+				break
+			}
+		}
+	}
+}
+
+//bits is an IODriver with only the inputs
+type bits struct {
+	mutex  sync.Mutex
+	values map[int]bool
+}
+
+func (b *bits) Init(numFloors int) error       { return nil }
+func (b *bits) SetBit(channel int)             { b.set(channel, true) }
+func (b *bits) ClearBit(channel int)           { b.set(channel, false) }
+func (b *bits) WriteAnalog(channel, value int) {}
+func (b *bits) ReadAnalog(channel int) int     { return 0 }
+
+func (b *bits) ReadBit(channel int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.values[channel]
+}
+
+func (b *bits) set(channel int, value bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.values[channel] = value
+}
+
+func TestSlowSubscriberHoldsUpNobody(t *testing.T) {
+	const slowChannel, channel = 1, 2
+	io := &bits{values: make(map[int]bool)}
+	scanner := NewInputScanner(io, time.Millisecond)
+	slow := scanner.Subscribe(slowChannel)
+	edges := scanner.Subscribe(channel)
+	scanner.Start()
+
+	const toggles = 100
+	for i := 0; i < toggles; i++ {
+		active := i%2 == 0
+		io.set(slowChannel, active)
+		io.set(channel, active)
+		select {
+		case edge := <-edges:
+			if edge.Channel != channel || edge.Active != active {
+				t.Fatalf("toggle %d: got %+v, want channel %d active %v", i, edge, channel, active)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("toggle %d: the scanner is held up by the subscriber that is not reading", i)
+		}
+	}
+	for i := 0; i < toggles; i++ {
+		if edge := <-slow; edge.Active != (i%2 == 0) {
+			t.Fatalf("the slow subscriber got %+v as edge %d", edge, i)
+		}
+	}
+}
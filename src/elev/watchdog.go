@@ -0,0 +1,145 @@
+package elev
+
+import (
+	. "../typedef"
+	"log"
+	"strconv"
+	"time"
+)
+
+//Motor fault types
+const (
+	MotorStuck   = iota //the motor runs, but no floor is reached
+	MotorRunaway        //a floor sensor changes while the motor is stopped
+)
+
+var MotorFaultType = []string{
+	"MotorStuck",
+	"MotorRunaway",
+}
+
+type MotorFault struct {
+	Type      int
+	Direction int //the last motor command
+	Floor     int //the last floor reached
+}
+
+func (f MotorFault) String() string {
+	return MotorFaultType[f.Type] + " with the motor at " + MotorCommands[f.Direction+1] + ", the last floor was " + strconv.Itoa(f.Floor)
+}
+
+//defaultFloorTime is the time between two floors until it has been measured. It is on the slow side,
+//so a slow shaft is not taken for a stuck motor.
+const defaultFloorTime = 5 * time.Second
+
+//watchdogMargin is how many floor times a motor can run without reaching a floor
+const watchdogMargin = 2
+
+//runawayGrace is how long the car may still move after the motor has been stopped
+const runawayGrace = 500 * time.Millisecond
+
+//motorWatchdog supervises the motor from the floor sensor. It measures the time between two floors
+//while the car is moving, and raises a MotorFault if no floor is reached within watchdogMargin
+//times that after the motor is started, or a floor sensor changes while the motor is stopped.
+type motorWatchdog struct {
+	direction int
+	floor     int
+	since     time.Time     //the motor was last started, stopped or a floor reached
+	reachedAt time.Time     //the last floor was reached while the motor was running
+	floorTime time.Duration //zero until the first sample
+	tripped   bool          //a fault has been raised, and not another until the motor is commanded again
+}
+
+//runMotorWatchdog keeps the faults until they are received, so the motor is never held up by a fault
+//the node has not got round to yet
+func runMotorWatchdog(motionChannel <-chan int, sensorChannel <-chan FloorEvent, motorFaultChannel chan<- MotorFault, pollDelay time.Duration) {
+	w := motorWatchdog{direction: STOP, floor: -1, since: time.Now()}
+	ticker := time.NewTicker(pollDelay)
+	defer ticker.Stop()
+	pending := []MotorFault{}
+	for {
+		var fault *MotorFault
+		var faultChannel chan<- MotorFault //nil, and never ready, while there is nothing to send
+		if len(pending) != 0 {
+			faultChannel = motorFaultChannel
+		}
+		select {
+		case direction := <-motionChannel:
+			w.motorCommanded(direction, time.Now())
+		case event := <-sensorChannel:
+			fault = w.sensorChanged(event.Floor, event.Time)
+		case <-ticker.C:
+			fault = w.check(time.Now())
+		case faultChannel <- firstFault(pending):
+			pending = pending[1:]
+		}
+		if fault != nil {
+			log.Println("ELEV:\t Motor watchdog:", fault.String())
+			pending = append(pending, *fault)
+		}
+	}
+}
+
+func firstFault(pending []MotorFault) MotorFault {
+	if len(pending) == 0 {
+		return MotorFault{}
+	}
+	return pending[0]
+}
+
+func (w *motorWatchdog) window() time.Duration {
+	if w.floorTime == 0 {
+		return watchdogMargin * defaultFloorTime
+	}
+	return watchdogMargin * w.floorTime
+}
+
+func (w *motorWatchdog) motorCommanded(direction int, now time.Time) {
+	if direction == w.direction {
+		return
+	}
+	w.direction = direction
+	w.since = now
+	w.reachedAt = time.Time{}
+	w.tripped = false
+}
+
+func (w *motorWatchdog) sensorChanged(floor int, now time.Time) *MotorFault {
+	if w.floor == -1 { //the floor the elevator has been initialised at
+		w.floor = floor
+		return nil
+	}
+	if w.direction == STOP {
+		if now.Sub(w.since) < runawayGrace || w.tripped {
+			return nil
+		}
+		w.tripped = true
+		return &MotorFault{Type: MotorRunaway, Direction: STOP, Floor: w.floor}
+	}
+	if floor == -1 {
+		return nil
+	}
+	if !w.reachedAt.IsZero() {
+		w.sample(now.Sub(w.reachedAt))
+	}
+	w.floor, w.since, w.reachedAt = floor, now, now
+	return nil
+}
+
+func (w *motorWatchdog) check(now time.Time) *MotorFault {
+	if w.direction == STOP || w.tripped || now.Sub(w.since) < w.window() {
+		return nil
+	}
+	w.tripped = true
+	return &MotorFault{Type: MotorStuck, Direction: w.direction, Floor: w.floor}
+}
+
+//sample follows a slower floor time at once, and a faster one slowly. A shaft that slows down
+//does not trip the watchdog, and one slow trip keeps the window wide for a while.
+func (w *motorWatchdog) sample(d time.Duration) {
+	if d > w.floorTime {
+		w.floorTime = d
+	} else {
+		w.floorTime += (d - w.floorTime) / 4
+	}
+}
@@ -0,0 +1,83 @@
+package fakeDriver
+
+import (
+	. "../channels"
+	"log"
+	"strconv"
+	"sync"
+)
+
+const debug = false
+
+//FakeDriver is an in-memory IODriver. It does not simulate any motor dynamics,
+//every channel simply holds the last value written to it.
+type FakeDriver struct {
+	mutex   *sync.Mutex
+	bits    map[int]bool
+	analogs map[int]int
+}
+
+func New() *FakeDriver {
+	return &FakeDriver{
+		mutex:   &sync.Mutex{},
+		bits:    make(map[int]bool),
+		analogs: make(map[int]int),
+	}
+}
+
+func (f *FakeDriver) Init(numFloors int) error {
+	log.Println("FAKEDRIVER:\t Starting fake driver with", numFloors, "floors")
+	f.mutex.Lock()
+	f.bits[NewChannelMap(numFloors).FloorSensors[0]] = true
+	f.mutex.Unlock()
+	return nil
+}
+
+func (f *FakeDriver) SetBit(channel int) {
+	f.SetInput(channel, true)
+}
+
+func (f *FakeDriver) ClearBit(channel int) {
+	f.SetInput(channel, false)
+}
+
+func (f *FakeDriver) ReadBit(channel int) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.bits[channel]
+}
+
+func (f *FakeDriver) ReadBits(channels []int, values []bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, channel := range channels {
+		values[i] = f.bits[channel]
+	}
+}
+
+func (f *FakeDriver) WriteAnalog(channel, value int) {
+	f.mutex.Lock()
+	f.analogs[channel] = value
+	f.mutex.Unlock()
+	printDebug("Writing " + strconv.Itoa(value) + " on analog channel " + strconv.Itoa(channel))
+}
+
+func (f *FakeDriver) ReadAnalog(channel int) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.analogs[channel]
+}
+
+//SetInput lets a test drive an input channel (button, floor sensor...) directly
+func (f *FakeDriver) SetInput(channel int, value bool) {
+	f.mutex.Lock()
+	f.bits[channel] = value
+	f.mutex.Unlock()
+	printDebug("Setting channel " + strconv.Itoa(channel) + " to " + strconv.FormatBool(value))
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("FAKEDRIVER:\t", s)
+	}
+}
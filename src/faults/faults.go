@@ -0,0 +1,171 @@
+package faults
+
+import (
+	"../fsm"
+	"log"
+	"time"
+)
+
+const debug = false
+const historyLength = 100
+
+//Fault types
+const (
+	FaultAssignmentFailed = iota
+	FaultExecutionTimedOut
+	FaultMotor
+)
+
+var FaultType = []string{
+	"FaultAssignmentFailed",
+	"FaultExecutionTimedOut",
+	"FaultMotor",
+}
+
+//degrading lists the faults that mean the elevator can not be trusted with external orders.
+//The others are only reported.
+var degrading = map[int]bool{
+	FaultExecutionTimedOut: true,
+	FaultMotor:             true,
+}
+
+type Fault struct {
+	Type   int
+	Time   time.Time
+	Detail string
+}
+
+func (f Fault) String() string {
+	return f.Time.Format("15:04:05.000") + " " + FaultType[f.Type] + ": " + f.Detail
+}
+
+//------------EVENTS-------
+type Event interface{}
+
+type FaultReported struct {
+	Type   int
+	Detail string
+}
+
+//Tick lets the handler check its self test deadlines against the clock
+type Tick struct{}
+
+//SelfTestPassed is sent when the elevator has reached a floor during a self test
+type SelfTestPassed struct{}
+
+//------------ACTIONS-------
+type Action interface{}
+
+//EnterDegraded: stop the motor, hand off the external orders and stop taking new ones.
+//Cab calls are still served once a self test has passed.
+type EnterDegraded struct {
+	Fault Fault
+}
+
+//StartSelfTest: drive to the nearest floor and report SelfTestPassed when it is reached
+type StartSelfTest struct{}
+
+//AbortSelfTest: the self test did not reach a floor in time. Stop the motor again.
+type AbortSelfTest struct{}
+
+//Rejoin: the elevator has worked long enough since the last fault to take external orders again
+type Rejoin struct{}
+
+//------------HANDLER-------
+type Config struct {
+	SelfTestInterval time.Duration //time from a fault or a failed self test to the next self test
+	SelfTestTimeout  time.Duration
+	RejoinAfter      time.Duration //fault free time after a passed self test before the elevator rejoins
+}
+
+type Handler struct {
+	config       Config
+	clock        fsm.Clock
+	degraded     bool
+	selfTesting  bool
+	selfTestDue  time.Time
+	selfTestPass bool
+	healthySince time.Time
+	history      []Fault
+}
+
+func New(config Config, clock fsm.Clock) *Handler {
+	return &Handler{config: config, clock: clock}
+}
+
+func (h *Handler) Degraded() bool {
+	return h.degraded
+}
+
+//History returns the latest faults, oldest first
+func (h *Handler) History() []Fault {
+	return h.history
+}
+
+func (h *Handler) Handle(event Event) []Action {
+	switch e := event.(type) {
+	case FaultReported:
+		return h.handleFault(e.Type, e.Detail)
+	case Tick:
+		return h.handleTick()
+	case SelfTestPassed:
+		if h.selfTesting {
+			log.Println("FAULTS:\t Self test passed. Serving cab calls only for", h.config.RejoinAfter)
+			h.selfTesting = false
+			h.selfTestPass = true
+			h.healthySince = h.clock.Now()
+		}
+		return nil
+	}
+	log.Printf("FAULTS:\t Can not handle event of type %T\n", event)
+	return nil
+}
+
+func (h *Handler) handleFault(faultType int, detail string) []Action {
+	fault := Fault{Type: faultType, Time: h.clock.Now(), Detail: detail}
+	h.history = append(h.history, fault)
+	if len(h.history) > historyLength {
+		h.history = h.history[len(h.history)-historyLength:]
+	}
+	log.Println("FAULTS:\t", fault.String())
+	if !degrading[faultType] {
+		return nil
+	}
+	log.Println("FAULTS:\t Entering degraded mode")
+	h.degraded = true
+	h.selfTesting = false
+	h.selfTestPass = false
+	h.selfTestDue = h.clock.Now().Add(h.config.SelfTestInterval)
+	return []Action{EnterDegraded{fault}}
+}
+
+func (h *Handler) handleTick() []Action {
+	if !h.degraded {
+		return nil
+	}
+	now := h.clock.Now()
+	switch {
+	case h.selfTesting && !now.Before(h.selfTestDue):
+		log.Println("FAULTS:\t Self test failed. Retrying in", h.config.SelfTestInterval)
+		h.selfTesting = false
+		h.selfTestDue = now.Add(h.config.SelfTestInterval)
+		return []Action{AbortSelfTest{}}
+	case !h.selfTesting && !h.selfTestPass && !now.Before(h.selfTestDue):
+		log.Println("FAULTS:\t Starting self test")
+		h.selfTesting = true
+		h.selfTestDue = now.Add(h.config.SelfTestTimeout)
+		return []Action{StartSelfTest{}}
+	case h.selfTestPass && now.Sub(h.healthySince) >= h.config.RejoinAfter:
+		log.Println("FAULTS:\t Leaving degraded mode")
+		h.degraded = false
+		h.selfTestPass = false
+		return []Action{Rejoin{}}
+	}
+	return nil
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("FAULTS:\t", s)
+	}
+}
@@ -0,0 +1,503 @@
+package fsm
+
+import (
+	. "../typedef"
+	"log"
+	"strconv"
+	"time"
+)
+
+const debug = false
+const transitionLogLength = 100
+
+//Clock is injected so the door timing can be tested tick by tick
+type Clock interface {
+	Now() time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+//OrderSource gives the FSM read access to the external orders. It is implemented by ordermanager.Manager and ordermanager.Cyclic.
+type OrderSource interface {
+	ExternalOrderMatrix() [][2]ElevOrder
+}
+
+//legalTransitions enumerates every transition the FSM may take. Anything else is refused.
+var legalTransitions = map[int][]int{
+	ElevInitializing:  {ElevIdle, ElevEmergencyStop},
+	ElevIdle:          {ElevMoving, ElevDoorOpen, ElevEmergencyStop, ElevInitializing},
+	ElevMoving:        {ElevDoorOpen, ElevEmergencyStop, ElevInitializing},
+	ElevDoorOpen:      {ElevIdle, ElevMoving, ElevDoorOpen, ElevObstructed, ElevEmergencyStop, ElevInitializing},
+	ElevObstructed:    {ElevDoorOpen, ElevEmergencyStop, ElevInitializing},
+	ElevEmergencyStop: {ElevInitializing},
+}
+
+//------------EVENTS-------
+type Event interface{}
+
+//FloorReached and FloorLeft have the time the floor sensor changed, which is more accurate than when
+//the event is handled. A zero Time is taken as now.
+type FloorReached struct {
+	Floor int
+	Time  time.Time
+}
+
+//FloorLeft is the floor sensor turning off as the elevator leaves a floor
+type FloorLeft struct {
+	Time time.Time
+}
+
+//Tick lets the FSM check its door deadline against the clock
+type Tick struct{}
+
+type CabButtonPressed struct {
+	Floor int
+}
+
+//OrderAssigned is a confirmed external order assigned to this elevator
+type OrderAssigned struct {
+	Floor int
+	Type  int
+}
+
+//OrdersChanged tells an idle elevator to look for new work, e.g. after a state restore
+type OrdersChanged struct{}
+
+type StopButtonPressed struct{}
+
+type ObstructionChanged struct {
+	Active bool
+}
+
+//Halt stops the elevator where it is and puts it back in ElevInitializing.
+//Cab calls are kept and served when a floor is reached again.
+type Halt struct{}
+
+//SelfTest drives a halted elevator towards the nearest floor
+type SelfTest struct{}
+
+//------------ACTIONS-------
+type Action interface{}
+
+type SetMotor struct {
+	Direction int
+}
+
+//ServeExternalOrders is emitted when the doors open at Floor. The external orders assigned to this elevator there are done.
+type ServeExternalOrders struct {
+	Floor int
+}
+
+//Initialized is emitted when the elevator has found a floor in ElevInitializing
+type Initialized struct{}
+
+//OutOfService is emitted when the elevator can no longer be counted on to serve external orders:
+//it is emergency stopped, or its doors have been obstructed for the obstruction timeout
+type OutOfService struct{}
+
+//BackInService is emitted when the elevator can serve external orders again after OutOfService
+type BackInService struct{}
+
+//BroadcastState is emitted whenever the local state has changed and should be backed up by the others
+type BroadcastState struct{}
+
+//------------FSM-------
+type Transition struct {
+	Time  time.Time
+	From  int
+	To    int
+	Cause string
+}
+
+func (t Transition) String() string {
+	return t.Time.Format("15:04:05.000") + " " + ElevBehaviour[t.From] + " -> " + ElevBehaviour[t.To] + " (" + t.Cause + ")"
+}
+
+type Config struct {
+	DoorOpenTime       time.Duration
+	ObstructionTimeout time.Duration //how long the doors can be obstructed before the elevator is out of service, 0 for ever
+	StopResetTime      time.Duration //how long until an emergency stop is reset by itself, 0 to wait for the stop button
+}
+
+type FSM struct {
+	elevator     *Elevator
+	orders       OrderSource
+	clock        Clock
+	config       Config
+	doorDeadline time.Time
+	transitions  []Transition
+	timing       timingEstimator
+	atFloor      bool //the floor sensor is on
+	doorsOpen    bool //from the doors opening until they close, also through an emergency stop
+
+	obstructed      bool      //the obstruction switch is on
+	obstructedAt    time.Time //the doors were held open by the obstruction
+	timedOut        bool      //the doors have been obstructed for the obstruction timeout
+	stopped         bool      //from the emergency stop until the elevator is initialized again
+	stoppedAt       time.Time
+	resumeDirection int //direction of the nearest floor when stopped between floors
+}
+
+//New creates an FSM for the local elevator in ElevInitializing.
+//The elevator is shared with the caller, who must not modify its State.
+//The TimingModel of the elevator starts from the default, with the doors open for config.DoorOpenTime.
+func New(elevator *Elevator, orders OrderSource, clock Clock, config Config) *FSM {
+	elevator.State.Behaviour = ElevInitializing
+	elevator.State.Direction = STOP
+	defaults := DefaultTimingModel
+	defaults.DoorWait = config.DoorOpenTime
+	elevator.State.Timing = defaults
+	return &FSM{
+		elevator: elevator,
+		orders:   orders,
+		clock:    clock,
+		config:   config,
+		timing:   newTimingEstimator(defaults),
+	}
+}
+
+func (f *FSM) State() int {
+	return f.elevator.State.Behaviour
+}
+
+//OutOfService tells whether the elevator is emergency stopped or its doors have been obstructed for
+//longer than the obstruction timeout. It can not serve external orders then.
+func (f *FSM) OutOfService() bool {
+	return f.stopped || f.timedOut
+}
+
+//DoorsOpen tells whether the doors are open. Doors open at an emergency stop stay open until it is reset.
+func (f *FSM) DoorsOpen() bool {
+	return f.doorsOpen
+}
+
+//EmergencyStopped tells whether the stop button has stopped the elevator, and it has not been reset yet
+func (f *FSM) EmergencyStopped() bool {
+	return f.State() == ElevEmergencyStop
+}
+
+//Transitions returns the latest transitions, oldest first
+func (f *FSM) Transitions() []Transition {
+	return f.transitions
+}
+
+func (f *FSM) Handle(event Event) []Action {
+	wasOutOfService := f.OutOfService()
+	actions := f.handle(event)
+	switch {
+	case !wasOutOfService && f.OutOfService():
+		actions = append(actions, OutOfService{})
+	case wasOutOfService && !f.OutOfService():
+		log.Println("FSM:\t Back in service")
+		actions = append(actions, BackInService{})
+	}
+	return actions
+}
+
+func (f *FSM) handle(event Event) []Action {
+	switch e := event.(type) {
+	case FloorReached:
+		return f.handleFloorReached(e.Floor, f.sensorTime(e.Time))
+	case FloorLeft:
+		return f.handleFloorLeft(f.sensorTime(e.Time))
+	case Tick:
+		return f.handleTick()
+	case CabButtonPressed:
+		return f.handleCabButton(e.Floor)
+	case OrderAssigned:
+		return f.handleOrderAssigned(e.Floor, e.Type)
+	case OrdersChanged:
+		if f.State() == ElevIdle {
+			return f.startNextOrder("OrdersChanged")
+		}
+		return nil
+	case StopButtonPressed:
+		return f.handleStopButton()
+	case ObstructionChanged:
+		return f.handleObstruction(e.Active)
+	case Halt:
+		return f.handleHalt()
+	case SelfTest:
+		return f.handleSelfTest()
+	}
+	log.Printf("FSM:\t Can not handle event of type %T\n", event)
+	return nil
+}
+
+//------------EVENT HANDLERS-------
+func (f *FSM) handleFloorReached(floor int, at time.Time) []Action {
+	f.elevator.SetLastFloor(floor)
+	f.atFloor = true
+	switch f.State() {
+	case ElevInitializing:
+		f.transition(ElevIdle, "FloorReached "+strconv.Itoa(floor))
+		f.stopped = false
+		actions := []Action{SetMotor{STOP}, Initialized{}}
+		return append(actions, f.startNextOrder("Initialized")...)
+	case ElevMoving:
+		stopping := f.extendedState().ShouldStop()
+		f.timing.floorReached(at, stopping)
+		f.updateTiming()
+		if stopping {
+			actions := []Action{SetMotor{STOP}}
+			return append(append(actions, f.openDoors("FloorReached "+strconv.Itoa(floor))...), BroadcastState{})
+		}
+	}
+	return []Action{BroadcastState{}}
+}
+
+func (f *FSM) handleFloorLeft(at time.Time) []Action {
+	f.atFloor = false
+	if f.State() == ElevMoving {
+		f.timing.floorLeft(at)
+		f.updateTiming()
+	}
+	return nil
+}
+
+func (f *FSM) handleTick() []Action {
+	switch f.State() {
+	case ElevObstructed:
+		f.checkObstruction()
+		return nil
+	case ElevEmergencyStop:
+		if f.config.StopResetTime != 0 && f.clock.Now().Sub(f.stoppedAt) >= f.config.StopResetTime {
+			return f.resetStop("StopResetTime")
+		}
+		return nil
+	}
+	if f.State() != ElevDoorOpen || f.clock.Now().Before(f.doorDeadline) {
+		return nil
+	}
+	if f.obstructed {
+		return f.holdDoors("DoorTimeout")
+	}
+	printDebug("evDoorTimeout")
+	log.Println("FSM:\t Closing doors")
+	f.timing.doorsClosed(f.clock.Now())
+	f.updateTiming()
+	f.doorsOpen = false
+	return f.startNextOrder("DoorTimeout")
+}
+
+func (f *FSM) handleCabButton(floor int) []Action {
+	state := f.State()
+	if state != ElevMoving && state != ElevEmergencyStop && state != ElevInitializing && f.elevator.State.LastFloor == floor {
+		if state == ElevObstructed {
+			return nil
+		}
+		return append(f.openDoors("CabButtonPressed "+strconv.Itoa(floor)), BroadcastState{})
+	}
+	printDebug("Added internal order to queue")
+	f.elevator.SetInternalOrder(floor)
+	actions := []Action{BroadcastState{}}
+	if state == ElevIdle {
+		actions = append(actions, f.startNextOrder("CabButtonPressed "+strconv.Itoa(floor))...)
+	}
+	return actions
+}
+
+func (f *FSM) handleOrderAssigned(floor, buttonType int) []Action {
+	switch f.State() {
+	case ElevIdle, ElevDoorOpen:
+		extended := f.extendedState()
+		if f.elevator.State.LastFloor == floor &&
+			(extended.GetNextDirection() == STOP || extended.GetNextButtonDirection() == buttonType) {
+			return append(f.openDoors("OrderAssigned "+ButtonType[buttonType]+" "+strconv.Itoa(floor)), BroadcastState{})
+		}
+		if f.State() == ElevIdle {
+			return f.startNextOrder("OrderAssigned")
+		}
+	}
+	return nil
+}
+
+//handleStopButton stops the elevator where it is, or resets the emergency stop if it is pressed again
+func (f *FSM) handleStopButton() []Action {
+	if f.State() == ElevEmergencyStop {
+		return f.resetStop("StopButtonPressed")
+	}
+	f.resumeDirection = f.nearestFloorDirection()
+	if !f.transition(ElevEmergencyStop, "StopButtonPressed") {
+		return nil
+	}
+	log.Println("FSM:\t Emergency stop")
+	f.stopped = true
+	f.stoppedAt = f.clock.Now()
+	f.timing.interrupted()
+	f.elevator.SetDirection(STOP)
+	return []Action{SetMotor{STOP}, BroadcastState{}}
+}
+
+func (f *FSM) handleObstruction(active bool) []Action {
+	f.obstructed = active
+	if !active {
+		f.timedOut = false
+	}
+	switch {
+	case active && f.State() == ElevDoorOpen:
+		return f.holdDoors("ObstructionChanged on")
+	case !active && f.State() == ElevObstructed:
+		return append(f.openDoors("ObstructionChanged off"), BroadcastState{})
+	}
+	return nil
+}
+
+func (f *FSM) handleHalt() []Action {
+	switch f.State() {
+	case ElevEmergencyStop:
+		return nil
+	case ElevInitializing:
+		return []Action{SetMotor{STOP}}
+	}
+	f.transition(ElevInitializing, "Halt")
+	f.timing.interrupted()
+	f.elevator.SetDirection(STOP)
+	f.doorsOpen = false
+	return []Action{SetMotor{STOP}, BroadcastState{}}
+}
+
+func (f *FSM) handleSelfTest() []Action {
+	if f.State() != ElevInitializing {
+		return nil
+	}
+	direction := DOWN
+	if f.elevator.State.LastFloor == 0 {
+		direction = UP
+	}
+	log.Println("FSM:\t Self test going", MotorCommands[direction+1])
+	return []Action{SetMotor{direction}}
+}
+
+//resetStop initializes the elevator again after an emergency stop, by driving it to the nearest floor.
+//It is back in service once the floor is reached.
+func (f *FSM) resetStop(cause string) []Action {
+	f.transition(ElevInitializing, cause)
+	f.doorsOpen = false
+	if f.atFloor {
+		log.Println("FSM:\t Emergency stop reset at floor", f.elevator.State.LastFloor)
+		return f.handleFloorReached(f.elevator.State.LastFloor, f.clock.Now())
+	}
+	log.Println("FSM:\t Emergency stop reset, going", MotorCommands[f.resumeDirection+1], "to the nearest floor")
+	return []Action{SetMotor{f.resumeDirection}, BroadcastState{}}
+}
+
+//------------SUPPORT FUNCTIONS-------
+//openDoors opens the doors at the current floor and serves every order there
+func (f *FSM) openDoors(cause string) []Action {
+	if !f.transition(ElevDoorOpen, cause) {
+		return nil
+	}
+	log.Println("FSM:\t Opening doors")
+	f.doorsOpen = true
+	f.doorDeadline = f.clock.Now().Add(f.config.DoorOpenTime)
+	f.timing.doorsOpened(f.clock.Now())
+	f.elevator.ClearInternalOrderAtCurrentFloor()
+	return []Action{ServeExternalOrders{Floor: f.elevator.State.LastFloor}}
+}
+
+//holdDoors keeps the doors open for as long as they are obstructed
+func (f *FSM) holdDoors(cause string) []Action {
+	if !f.transition(ElevObstructed, cause) {
+		return nil
+	}
+	log.Println("FSM:\t Holding the doors open, they are obstructed")
+	f.obstructedAt = f.clock.Now()
+	f.timing.interrupted() //the time held open is not the door wait of the elevator
+	return []Action{BroadcastState{}}
+}
+
+//checkObstruction gives up on the obstruction being removed soon once it has held the doors for the obstruction timeout
+func (f *FSM) checkObstruction() {
+	if f.timedOut || f.config.ObstructionTimeout == 0 || f.clock.Now().Sub(f.obstructedAt) < f.config.ObstructionTimeout {
+		return
+	}
+	log.Println("FSM:\t The doors have been obstructed for", f.config.ObstructionTimeout)
+	f.timedOut = true
+}
+
+//nearestFloorDirection is the direction of the nearest floor, from how long ago the last one was left.
+//It is STOP at a floor.
+func (f *FSM) nearestFloorDirection() int {
+	direction := f.elevator.State.Direction
+	switch {
+	case f.atFloor:
+		return STOP
+	case direction == STOP && f.elevator.State.LastFloor == 0: //halted, and the way it went is not known
+		return UP
+	case direction == STOP:
+		return DOWN
+	case !f.timing.leftAt.IsZero() && f.clock.Now().Sub(f.timing.leftAt) > f.timing.Model().Travel/2:
+		return direction
+	}
+	return -direction
+}
+
+//startNextOrder decides what an elevator with closed doors should do next
+func (f *FSM) startNextOrder(cause string) []Action {
+	extended := f.extendedState()
+	if extended.HaveOrdersAtCurrentFloor() {
+		return append(f.openDoors(cause), BroadcastState{})
+	}
+	direction := extended.GetNextDirection()
+	if direction == STOP {
+		log.Println("FSM:\t I dont have any order to do")
+		f.elevator.SetDirection(STOP)
+		if f.State() != ElevIdle {
+			f.transition(ElevIdle, cause)
+		}
+		return []Action{BroadcastState{}}
+	}
+	log.Println("FSM:\t Going direction", MotorCommands[direction+1])
+	f.elevator.SetDirection(direction)
+	f.transition(ElevMoving, cause)
+	f.timing.motorStarted(f.clock.Now())
+	return []Action{SetMotor{direction}, BroadcastState{}}
+}
+
+func (f *FSM) sensorTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return f.clock.Now()
+	}
+	return t
+}
+
+//updateTiming puts the measured timing in the state, so it is sent with the next BroadcastState
+func (f *FSM) updateTiming() {
+	f.elevator.State.Timing = f.timing.Model()
+}
+
+func (f *FSM) extendedState() ExtendedElevState {
+	return f.elevator.ResolveExtendedElevState(f.orders.ExternalOrderMatrix())
+}
+
+func (f *FSM) transition(to int, cause string) bool {
+	from := f.State()
+	legal := false
+	for _, state := range legalTransitions[from] {
+		if state == to {
+			legal = true
+		}
+	}
+	if !legal {
+		log.Println("FSM:\t Refused illegal transition", ElevBehaviour[from], "->", ElevBehaviour[to], "("+cause+")")
+		return false
+	}
+	f.elevator.State.Behaviour = to
+	f.transitions = append(f.transitions, Transition{Time: f.clock.Now(), From: from, To: to, Cause: cause})
+	if len(f.transitions) > transitionLogLength {
+		f.transitions = f.transitions[len(f.transitions)-transitionLogLength:]
+	}
+	printDebug(f.transitions[len(f.transitions)-1].String())
+	return true
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("FSM:\t", s)
+	}
+}
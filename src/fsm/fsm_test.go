@@ -0,0 +1,137 @@
+package fsm
+
+import (
+	. "../typedef"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testFloors = 4
+
+//fakeClock is a Clock that only moves when the test moves it
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+//noOrders is an OrderSource without any external orders
+type noOrders struct{}
+
+func (noOrders) ExternalOrderMatrix() [][2]ElevOrder {
+	return NewExternalOrderMatrix(testFloors)
+}
+
+//describe names an action by its type and, for the motor, its direction
+func describe(action Action) string {
+	if a, ok := action.(SetMotor); ok {
+		return "SetMotor " + MotorCommands[a.Direction+1]
+	}
+	return reflect.TypeOf(action).Name()
+}
+
+func TestDoorsAndStop(t *testing.T) {
+	type step struct {
+		after     time.Duration //on the clock, since the step before
+		event     Event
+		state     int
+		doorsOpen bool
+		actions   []string
+	}
+	config := Config{DoorOpenTime: 3 * time.Second, ObstructionTimeout: 10 * time.Second}
+	tests := []struct {
+		name          string
+		stopResetTime time.Duration
+		steps         []step
+	}{
+		{
+			name: "the doors close after the door open time",
+			steps: []step{
+				{0, CabButtonPressed{1}, ElevDoorOpen, true, []string{"ServeExternalOrders", "BroadcastState"}},
+				{2 * time.Second, Tick{}, ElevDoorOpen, true, []string{}},
+				{time.Second, Tick{}, ElevIdle, false, []string{"BroadcastState"}},
+			},
+		},
+		{
+			name: "the doors are held open while they are obstructed",
+			steps: []step{
+				{0, CabButtonPressed{1}, ElevDoorOpen, true, []string{"ServeExternalOrders", "BroadcastState"}},
+				{time.Second, ObstructionChanged{true}, ElevObstructed, true, []string{"BroadcastState"}},
+				{5 * time.Second, Tick{}, ElevObstructed, true, []string{}},
+				{0, ObstructionChanged{false}, ElevDoorOpen, true, []string{"ServeExternalOrders", "BroadcastState"}},
+				{2 * time.Second, Tick{}, ElevDoorOpen, true, []string{}},
+				{time.Second, Tick{}, ElevIdle, false, []string{"BroadcastState"}},
+			},
+		},
+		{
+			name: "obstructed doors are not closed when they time out",
+			steps: []step{
+				{0, ObstructionChanged{true}, ElevIdle, false, []string{}},
+				{0, CabButtonPressed{1}, ElevDoorOpen, true, []string{"ServeExternalOrders", "BroadcastState"}},
+				{3 * time.Second, Tick{}, ElevObstructed, true, []string{"BroadcastState"}},
+			},
+		},
+		{
+			name: "doors obstructed for the obstruction timeout are out of service",
+			steps: []step{
+				{0, CabButtonPressed{1}, ElevDoorOpen, true, []string{"ServeExternalOrders", "BroadcastState"}},
+				{0, ObstructionChanged{true}, ElevObstructed, true, []string{"BroadcastState"}},
+				{9 * time.Second, Tick{}, ElevObstructed, true, []string{}},
+				{time.Second, Tick{}, ElevObstructed, true, []string{"OutOfService"}},
+				{0, ObstructionChanged{false}, ElevDoorOpen, true, []string{"ServeExternalOrders", "BroadcastState", "BackInService"}},
+			},
+		},
+		{
+			name: "the stop button stops the elevator between floors until it is pressed again",
+			steps: []step{
+				{0, CabButtonPressed{3}, ElevMoving, false, []string{"BroadcastState", "SetMotor UP", "BroadcastState"}},
+				{0, FloorLeft{}, ElevMoving, false, []string{}},
+				{0, StopButtonPressed{}, ElevEmergencyStop, false, []string{"SetMotor STOP", "BroadcastState", "OutOfService"}},
+				{time.Minute, Tick{}, ElevEmergencyStop, false, []string{}},
+				{0, StopButtonPressed{}, ElevInitializing, false, []string{"SetMotor DOWN", "BroadcastState"}},
+				{0, FloorReached{Floor: 1}, ElevMoving, false, []string{"SetMotor STOP", "Initialized", "SetMotor UP", "BroadcastState", "BackInService"}},
+			},
+		},
+		{
+			name:          "an emergency stop is reset after the stop reset time",
+			stopResetTime: 5 * time.Second,
+			steps: []step{
+				{0, StopButtonPressed{}, ElevEmergencyStop, false, []string{"SetMotor STOP", "BroadcastState", "OutOfService"}},
+				{4 * time.Second, Tick{}, ElevEmergencyStop, false, []string{}},
+				{time.Second, Tick{}, ElevIdle, false, []string{"SetMotor STOP", "Initialized", "BroadcastState", "BackInService"}},
+			},
+		},
+		{
+			name: "doors open at an emergency stop stay open until it is reset",
+			steps: []step{
+				{0, CabButtonPressed{1}, ElevDoorOpen, true, []string{"ServeExternalOrders", "BroadcastState"}},
+				{0, StopButtonPressed{}, ElevEmergencyStop, true, []string{"SetMotor STOP", "BroadcastState", "OutOfService"}},
+				{3 * time.Second, Tick{}, ElevEmergencyStop, true, []string{}},
+				{0, StopButtonPressed{}, ElevIdle, false, []string{"SetMotor STOP", "Initialized", "BroadcastState", "BackInService"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		config.StopResetTime = test.stopResetTime
+		f := New(ResolveElevator(NewElevState("A", 0, testFloors)), noOrders{}, clock, config)
+		f.Handle(FloorReached{Floor: 1})
+		for i, step := range test.steps {
+			clock.now = clock.now.Add(step.after)
+			got := []string{}
+			for _, action := range f.Handle(step.event) {
+				got = append(got, describe(action))
+			}
+			if !reflect.DeepEqual(got, step.actions) {
+				t.Errorf("%s, step %d: got the actions %q, want %q", test.name, i, got, step.actions)
+			}
+			if f.State() != step.state || f.DoorsOpen() != step.doorsOpen {
+				t.Errorf("%s, step %d: the elevator is %s with the doors open %v, want %s with the doors open %v", test.name, i,
+					ElevBehaviour[f.State()], f.DoorsOpen(), ElevBehaviour[step.state], step.doorsOpen)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package fsm
+
+import (
+	. "../typedef"
+	"time"
+)
+
+//timingWeight is how many samples the average of a duration is made of. A new sample counts
+//1/timingWeight, so one slow trip does not make the elevator look slow for long.
+const timingWeight = 4
+
+//maxTimingSample is the longest sample that is believed. Anything longer is a fault, not the speed of the elevator.
+const maxTimingSample = 30 * time.Second
+
+//timingEstimator measures the TimingModel of the elevator from the times the floor sensor
+//and the doors change. The durations it has no samples of are taken from defaults.
+type timingEstimator struct {
+	defaults     TimingModel
+	measured     TimingModel //zero until the first sample of each duration
+	startedAt    time.Time   //the motor was started at a floor
+	reachedAt    time.Time   //a floor was reached and the elevator did not stop there
+	leftAt       time.Time   //the sensor of the last floor was left
+	doorOpenedAt time.Time
+}
+
+func newTimingEstimator(defaults TimingModel) timingEstimator {
+	return timingEstimator{defaults: defaults}
+}
+
+//Model returns the measured durations, and the defaults of the ones not measured yet
+func (t *timingEstimator) Model() TimingModel {
+	model := t.defaults
+	for _, d := range []struct{ measured, model *time.Duration }{
+		{&t.measured.DoorWait, &model.DoorWait},
+		{&t.measured.Travel, &model.Travel},
+		{&t.measured.Acceleration, &model.Acceleration},
+		{&t.measured.SensorPassage, &model.SensorPassage},
+	} {
+		if *d.measured != 0 {
+			*d.model = *d.measured
+		}
+	}
+	return model
+}
+
+func (t *timingEstimator) motorStarted(now time.Time) {
+	t.startedAt, t.reachedAt, t.leftAt = now, time.Time{}, time.Time{}
+}
+
+//floorLeft is a sample of the acceleration when the motor was started at the floor, and of the
+//sensor passage when the elevator passed the floor
+func (t *timingEstimator) floorLeft(now time.Time) {
+	switch {
+	case !t.startedAt.IsZero():
+		sample(&t.measured.Acceleration, now.Sub(t.startedAt))
+	case !t.reachedAt.IsZero():
+		sample(&t.measured.SensorPassage, now.Sub(t.reachedAt))
+	}
+	t.startedAt, t.reachedAt, t.leftAt = time.Time{}, time.Time{}, now
+}
+
+func (t *timingEstimator) floorReached(now time.Time, stopping bool) {
+	if !t.leftAt.IsZero() {
+		sample(&t.measured.Travel, now.Sub(t.leftAt))
+	}
+	t.startedAt, t.leftAt = time.Time{}, time.Time{}
+	if stopping {
+		t.reachedAt = time.Time{}
+	} else {
+		t.reachedAt = now
+	}
+}
+
+//doorsOpened keeps the first time when the doors are opened again before they have closed,
+//so the samples are of the whole time the elevator is held at the floor
+func (t *timingEstimator) doorsOpened(now time.Time) {
+	if t.doorOpenedAt.IsZero() {
+		t.doorOpenedAt = now
+	}
+}
+
+func (t *timingEstimator) doorsClosed(now time.Time) {
+	if !t.doorOpenedAt.IsZero() {
+		sample(&t.measured.DoorWait, now.Sub(t.doorOpenedAt))
+	}
+	t.doorOpenedAt = time.Time{}
+}
+
+//interrupted forgets the samples in progress, e.g. when the elevator is halted between floors
+func (t *timingEstimator) interrupted() {
+	t.startedAt, t.reachedAt, t.leftAt, t.doorOpenedAt = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+}
+
+func sample(average *time.Duration, d time.Duration) {
+	switch {
+	case d <= 0 || d > maxTimingSample:
+		printDebug("Ignoring the timing sample " + d.String())
+	case *average == 0:
+		*average = d
+	default:
+		*average += (d - *average) / timingWeight
+	}
+}
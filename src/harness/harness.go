@@ -0,0 +1,309 @@
+package harness
+
+import (
+	"../cost"
+	"../network"
+	"../node"
+	"../protocol"
+	"../simulatorCore"
+	. "../typedef"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const debug = false
+const assertPollDelay = 50 * time.Millisecond
+
+//harnessKey is the cluster key of every node. The rogue host does not know it.
+var harnessKey = []byte("harness cluster key")
+
+const rogueAddress = "rogue"
+
+//Harness runs a whole cluster of elevators in one process. Every node gets a headless
+//simulator as its shaft, and all of them share an in-memory network bus.
+type Harness struct {
+	numFloors    int
+	cost         cost.CostFunction
+	global       *cost.GlobalAssigner
+	cyclicOrders bool
+	destination  bool
+	bus          *network.Bus
+	nodes        map[string]*harnessNode
+	names        []string
+	started      time.Time
+	partition    [][]string //node names, translated to bus addresses by applyPartition
+	directory    string     //the journals of the nodes
+	rogue        *rogueHost
+}
+
+//rogueHost is a host on the network that is not part of the cluster. It overhears
+//every packet and can send them again, or send packets of its own.
+type rogueHost struct {
+	mutex     *sync.Mutex
+	overheard []overheardPacket
+}
+
+type overheardPacket struct {
+	at   time.Time
+	data []byte
+}
+
+type harnessNode struct {
+	name      string
+	simulator *simulator.Simulator
+	node      *node.Node
+	alive     bool
+	address   string //bus address, a new one every time the node is revived
+	revivals  int
+	slowdown  int
+}
+
+func RunFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scenario, err := ParseScenario(file)
+	if err != nil {
+		return err
+	}
+	return Run(scenario)
+}
+
+//Run starts the nodes of the scenario, executes its steps and stops every node again.
+//It returns an error describing the first step that failed.
+func Run(scenario Scenario) error {
+	h := &Harness{
+		numFloors:    scenario.NumFloors,
+		cost:         scenario.Cost,
+		global:       scenario.Global,
+		cyclicOrders: scenario.CyclicOrders,
+		destination:  scenario.Destination,
+		bus:          network.NewBus(),
+		nodes:        make(map[string]*harnessNode),
+		names:        scenario.Nodes,
+	}
+	h.bus.SetFaults(scenario.Faults, scenario.Seed)
+	h.startRogue()
+	directory, err := ioutil.TempDir("", "harness")
+	if err != nil {
+		return err
+	}
+	h.directory = directory
+	defer os.RemoveAll(directory)
+	defer h.stopAll()
+	for _, name := range scenario.Nodes {
+		h.nodes[name] = &harnessNode{name: name, slowdown: scenario.Slowdown[name]}
+		if err := h.startNode(name, scenario.StartFloor[name]); err != nil {
+			return err
+		}
+	}
+	h.started = time.Now()
+	for _, step := range scenario.Steps {
+		if err := h.runStep(step); err != nil {
+			return errors.New("HARNESS:\t Line " + strconv.Itoa(step.Line) + " \"" + step.Text + "\" failed: " + err.Error())
+		}
+		log.Println("HARNESS:\t", time.Since(h.started).Truncate(time.Millisecond), "\""+step.Text+"\" ok")
+	}
+	return nil
+}
+
+func (h *Harness) runStep(step Step) error {
+	if !step.Deadline {
+		time.Sleep(step.At - time.Since(h.started))
+		return h.execute(step)
+	}
+	for {
+		err := h.execute(step)
+		if err == nil || time.Since(h.started) > step.At {
+			return err
+		}
+		time.Sleep(assertPollDelay)
+	}
+}
+
+func (h *Harness) execute(step Step) error {
+	n := h.nodes[step.node]
+	if n != nil && step.kind != stepRevive && !n.alive {
+		return errors.New(step.node + " is dead")
+	}
+	switch step.kind {
+	case stepPress:
+		return n.simulator.PressButton(step.floor, step.button)
+	case stepPressStop:
+		n.simulator.PressStopButton()
+	case stepCall:
+		return n.node.RequestDestination(step.floor, step.destination)
+	case stepKill:
+		h.killNode(step.node)
+	case stepRevive:
+		if n.alive {
+			return errors.New(step.node + " is already alive")
+		}
+		return h.startNode(step.node, n.simulator.LastFloor())
+	case stepBreakMotor:
+		n.simulator.BreakMotor(true)
+	case stepJamMotor:
+		n.simulator.JamMotor(true)
+	case stepRepairMotor:
+		n.simulator.BreakMotor(false)
+		n.simulator.JamMotor(false)
+	case stepObstructDoor, stepReleaseDoor:
+		n.simulator.SetObstruction(step.kind == stepObstructDoor)
+	case stepBlankLights:
+		n.simulator.BlankLights()
+	case stepPartition:
+		h.partition = step.groups
+		h.applyPartition()
+	case stepHeal:
+		h.partition = nil
+		h.applyPartition()
+	case stepForge:
+		return h.forgeOrderDone(step.floor, step.button, step.node)
+	case stepReplay:
+		h.replayOverheard(step.from, step.to)
+	case stepAssertLight:
+		for _, name := range h.names {
+			if (step.node == "all" || step.node == name) && h.nodes[name].alive &&
+				h.nodes[name].simulator.ButtonLight(step.floor, step.button) != step.active {
+				return errors.New("the " + ButtonType[step.button] + " light at floor " + strconv.Itoa(step.floor) + " on " + name + " is " + onOff(!step.active))
+			}
+		}
+	case stepAssertFloor:
+		if floor := n.simulator.LastFloor(); floor != step.floor {
+			return errors.New(step.node + " is at floor " + strconv.Itoa(floor))
+		}
+	case stepAssertDoor:
+		if open := n.simulator.DoorOpen(); open && !step.active {
+			return errors.New("the door on " + step.node + " is open")
+		} else if !open && step.active {
+			return errors.New("the door on " + step.node + " is closed")
+		}
+	}
+	return nil
+}
+
+func (h *Harness) startNode(name string, floor int) error {
+	n := h.nodes[name]
+	n.simulator = simulator.NewHeadless(floor)
+	if n.slowdown > 1 {
+		n.simulator.SetSlowdown(n.slowdown)
+	}
+	n.address = name + "-" + strconv.Itoa(n.revivals)
+	n.revivals++
+	h.applyPartition()
+	initNetwork := func(localID string, numFloors int,
+		receiveOrderChannel chan<- ElevOrderMessage,
+		sendOrderChannel <-chan ElevOrderMessage,
+		receiveRestoreChannel chan<- ElevRestoreMessage,
+		sendRestoreChannel <-chan ElevRestoreMessage,
+		sendReliableChannel <-chan ReliableMessage,
+		versionChannel chan<- uint8) (string, error) {
+		return network.Init(network.BusTransport{Bus: h.bus, LocalIP: n.address}, harnessKey, localID, numFloors, receiveOrderChannel, sendOrderChannel, receiveRestoreChannel, sendRestoreChannel, sendReliableChannel, versionChannel)
+	}
+	config := node.DefaultConfig(name, h.numFloors)
+	config.JournalPath = filepath.Join(h.directory, name+".journal")
+	config.Cost = h.cost
+	config.Global = h.global
+	config.CyclicOrders = h.cyclicOrders
+	config.DestinationDispatch = h.destination
+	started, err := node.Start(config, n.simulator, initNetwork)
+	if err != nil {
+		return err
+	}
+	n.node = started
+	n.alive = true
+	printDebug("Started " + name + " at floor " + strconv.Itoa(floor))
+	return nil
+}
+
+func (h *Harness) killNode(name string) {
+	n := h.nodes[name]
+	h.bus.Detach(n.address)
+	n.node.Stop()
+	n.alive = false
+	printDebug("Killed " + name)
+}
+
+func (h *Harness) startRogue() {
+	h.rogue = &rogueHost{mutex: &sync.Mutex{}}
+	inbox := h.bus.Attach(rogueAddress)
+	go func() {
+		for msg := range inbox {
+			h.rogue.mutex.Lock()
+			h.rogue.overheard = append(h.rogue.overheard, overheardPacket{time.Now(), msg.Data[:msg.Length]})
+			h.rogue.mutex.Unlock()
+		}
+	}()
+}
+
+//forgeOrderDone sends an unsigned EvOrderDone for the call in the name of node
+func (h *Harness) forgeOrderDone(floor, button int, node string) error {
+	msg := ElevOrderMessage{
+		Event:      EvOrderDone,
+		Floor:      floor,
+		ButtonType: button,
+		AssignedTo: node,
+		OriginID:   node,
+		SenderID:   node,
+	}
+	data, err := protocol.Marshal(protocol.Envelope{Version: protocol.Version, NodeID: node, Seq: 1}, msg)
+	if err != nil {
+		return err
+	}
+	h.bus.Broadcast(rogueAddress, data)
+	return nil
+}
+
+//replayOverheard sends the packets overheard between from and to again, in the order they were sent
+func (h *Harness) replayOverheard(from, to time.Duration) {
+	h.rogue.mutex.Lock()
+	overheard := h.rogue.overheard
+	h.rogue.mutex.Unlock()
+	replayed := 0
+	for _, packet := range overheard {
+		if at := packet.at.Sub(h.started); at >= from && at <= to {
+			h.bus.Broadcast(rogueAddress, packet.data)
+			replayed++
+		}
+	}
+	printDebug("Replayed " + strconv.Itoa(replayed) + " packets")
+}
+
+func (h *Harness) applyPartition() {
+	groups := make([][]string, len(h.partition))
+	for i, names := range h.partition {
+		for _, name := range names {
+			groups[i] = append(groups[i], h.nodes[name].address)
+		}
+	}
+	h.bus.Partition(groups...)
+}
+
+func (h *Harness) stopAll() {
+	for _, name := range h.names {
+		if h.nodes[name].alive {
+			h.killNode(name)
+		}
+	}
+}
+
+func onOff(active bool) string {
+	if active {
+		return "on"
+	}
+	return "off"
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("HARNESS:\t", s)
+	}
+}
@@ -0,0 +1,36 @@
+package harness
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//TestScenarios runs every scenario in scenarios/. They run in real time, for up to a minute, so they
+//are skipped with -short. They are all started at once, as they mostly wait, whatever -parallel is.
+func TestScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the scenarios run in real time")
+	}
+	paths, err := filepath.Glob("../../scenarios/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("there are no scenarios in ../../scenarios")
+	}
+	results := make([]chan error, len(paths))
+	for i, path := range paths {
+		results[i] = make(chan error, 1)
+		go func(path string, result chan<- error) {
+			result <- RunFile(path)
+		}(path, results[i])
+	}
+	for i, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".txt"), func(t *testing.T) {
+			if err := <-results[i]; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+package harness
+
+import (
+	"../cost"
+	"../network"
+	. "../typedef"
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//A scenario is a list of statements, one per line or separated by ';'. Floors count from 0.
+//
+//	floors 4                           //building size, default DefaultNumFloors
+//	nodes A B C                        //names of the elevators, all started at t=0
+//	start A 2                          //A starts at floor 2 instead of 0
+//	slow A 2                           //the shaft of A is 2 times slower than the others
+//	cost timetoidle                    //assign the hall orders with this cost function, default heuristic
+//	rebalance 4s                       //move the hall orders when the global assignment saves more than 4s
+//	orders cyclic                      //distribute the hall orders with the cyclic counters, default handshake
+//	destination                        //destination dispatch, with the cost function destination unless one is chosen
+//	at 1s press up 2 on B              //press a button (up, down or cab)
+//	at 2s press stop on A              //press the stop button
+//	at 1s call 0 to 3 on B             //a passenger on floor 0 asks the hall panel of B for floor 3
+//	at 3s kill A                       //A stops and disappears from the network
+//	at 10s revive A                    //A restarts where it stopped
+//	by 20s assert light off up 2 on all
+//	by 20s assert floor 2 on B
+//	by 20s assert door open on B
+//	faults drop 0.1 duplicate 0.05 reorder 0.1 delay 5ms 20ms seed 42
+//	at 5s partition A B | C            //C can no longer hear A and B or the other way round
+//	at 9s heal
+//	at 2s break motor on A             //the motor of A ignores every command
+//	at 3s jam motor on A               //the motor of A keeps running as it does, whatever it is commanded
+//	at 8s repair motor on A            //undoes break and jam
+//	at 2s obstruct door on A           //the obstruction switch of A is turned on
+//	at 9s release door on A
+//	at 5s blank lights on A            //every lamp of A is turned off behind the back of the node
+//	at 4s forge done up 2 as A         //a rogue host on the network says A has served the call
+//	at 9s replay 1s 2s                 //the rogue host sends what it overheard from 1s to 2s again
+//
+//'at' waits until the given time, 'by' retries the assertion until it holds or the time has passed.
+//Steps run in the order they are written. Everything after '#' is a comment.
+//Every scenario in scenarios/ is run by go test, unless it is given -short.
+
+const (
+	stepPress = iota
+	stepKill
+	stepRevive
+	stepAssertLight
+	stepAssertFloor
+	stepAssertDoor
+	stepPartition
+	stepHeal
+	stepBreakMotor
+	stepRepairMotor
+	stepJamMotor
+	stepForge
+	stepReplay
+	stepCall
+	stepObstructDoor
+	stepReleaseDoor
+	stepPressStop
+	stepBlankLights
+)
+
+type Scenario struct {
+	NumFloors    int
+	Nodes        []string
+	StartFloor   map[string]int
+	Slowdown     map[string]int
+	Cost         cost.CostFunction
+	Global       *cost.GlobalAssigner
+	CyclicOrders bool
+	Destination  bool
+	Faults       network.Faults
+	Seed         int64
+	Steps        []Step
+	costChosen   bool
+}
+
+type Step struct {
+	Line        int
+	Text        string
+	At          time.Duration
+	Deadline    bool //true for 'by', the step is retried until At
+	kind        int
+	node        string //"all" for every living node in light assertions
+	floor       int
+	button      int
+	destination int
+	active      bool
+	groups      [][]string
+	from        time.Duration //replayed time span
+	to          time.Duration
+}
+
+func ParseScenario(r io.Reader) (Scenario, error) {
+	scenario := Scenario{NumFloors: DefaultNumFloors, StartFloor: make(map[string]int), Slowdown: make(map[string]int), Cost: cost.Functions[cost.Default]}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		for _, statement := range strings.Split(line, ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			if err := scenario.parseStatement(lineNumber, strings.Fields(statement)); err != nil {
+				return Scenario{}, errors.New("HARNESS:\t Line " + strconv.Itoa(lineNumber) + ": " + err.Error())
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Scenario{}, err
+	}
+	if len(scenario.Nodes) == 0 {
+		return Scenario{}, errors.New("HARNESS:\t The scenario has no nodes")
+	}
+	if scenario.Destination && !scenario.costChosen {
+		scenario.Cost = cost.Destination{}
+	}
+	for _, step := range scenario.Steps {
+		if step.floor >= scenario.NumFloors {
+			return Scenario{}, errors.New("HARNESS:\t Line " + strconv.Itoa(step.Line) + ": no floor " + strconv.Itoa(step.floor))
+		}
+		if step.destination >= scenario.NumFloors {
+			return Scenario{}, errors.New("HARNESS:\t Line " + strconv.Itoa(step.Line) + ": no floor " + strconv.Itoa(step.destination))
+		}
+		if step.kind == stepCall && !scenario.Destination {
+			return Scenario{}, errors.New("HARNESS:\t Line " + strconv.Itoa(step.Line) + ": calls need destination dispatch")
+		}
+		if step.kind == stepPress && ((step.floor == 0 && step.button == BUTTON_CALL_DOWN) ||
+			(step.floor == scenario.NumFloors-1 && step.button == BUTTON_CALL_UP)) {
+			return Scenario{}, errors.New("HARNESS:\t Line " + strconv.Itoa(step.Line) + ": there is no such button at floor " + strconv.Itoa(step.floor))
+		}
+	}
+	for name, floor := range scenario.StartFloor {
+		if floor >= scenario.NumFloors {
+			return Scenario{}, errors.New("HARNESS:\t " + name + " can not start at floor " + strconv.Itoa(floor))
+		}
+	}
+	return scenario, nil
+}
+
+func (s *Scenario) parseStatement(line int, words []string) error {
+	switch words[0] {
+	case "floors":
+		if len(words) != 2 {
+			return errors.New("usage: floors <n>")
+		}
+		n, err := strconv.Atoi(words[1])
+		if err != nil || n < 2 {
+			return errors.New("a building needs at least two floors")
+		}
+		s.NumFloors = n
+		return nil
+	case "nodes":
+		if len(words) < 2 {
+			return errors.New("usage: nodes <name>...")
+		}
+		for _, name := range words[1:] {
+			if s.hasNode(name) || name == "all" {
+				return errors.New("invalid node name " + name)
+			}
+			s.Nodes = append(s.Nodes, name)
+		}
+		return nil
+	case "start":
+		if len(words) != 3 || !s.hasNode(words[1]) {
+			return errors.New("usage: start <node> <floor>")
+		}
+		floor, err := parseFloor(words[2])
+		if err != nil {
+			return err
+		}
+		s.StartFloor[words[1]] = floor
+		return nil
+	case "slow":
+		if len(words) != 3 || !s.hasNode(words[1]) {
+			return errors.New("usage: slow <node> <factor>")
+		}
+		factor, err := strconv.Atoi(words[2])
+		if err != nil || factor < 1 {
+			return errors.New("the slowdown is a whole number from 1")
+		}
+		s.Slowdown[words[1]] = factor
+		return nil
+	case "cost":
+		if len(words) != 2 {
+			return errors.New("usage: cost <function>")
+		}
+		var err error
+		s.Cost, err = cost.Lookup(words[1])
+		s.costChosen = true
+		return err
+	case "rebalance":
+		hysteresis := cost.DefaultHysteresis
+		if len(words) > 2 {
+			return errors.New("usage: rebalance [hysteresis]")
+		} else if len(words) == 2 {
+			var err error
+			if hysteresis, err = time.ParseDuration(words[1]); err != nil || hysteresis < 0 {
+				return errors.New("the hysteresis is a duration, e.g. 4s")
+			}
+		}
+		s.Global = &cost.GlobalAssigner{Hysteresis: hysteresis}
+		return nil
+	case "orders":
+		if len(words) != 2 || (words[1] != "handshake" && words[1] != "cyclic") {
+			return errors.New("usage: orders handshake|cyclic")
+		}
+		s.CyclicOrders = words[1] == "cyclic"
+		return nil
+	case "destination":
+		if len(words) != 1 {
+			return errors.New("usage: destination")
+		}
+		s.Destination = true
+		return nil
+	case "faults":
+		return s.parseFaults(words[1:])
+	case "at", "by":
+		if len(words) < 3 {
+			return errors.New("usage: " + words[0] + " <time> <command>")
+		}
+		at, err := time.ParseDuration(words[1])
+		if err != nil {
+			return err
+		}
+		step := Step{Line: line, Text: strings.Join(words, " "), At: at, Deadline: words[0] == "by"}
+		if err := s.parseCommand(&step, words[2:]); err != nil {
+			return err
+		}
+		if step.Deadline && step.kind != stepAssertLight && step.kind != stepAssertFloor && step.kind != stepAssertDoor {
+			return errors.New("only assertions can have a deadline")
+		}
+		s.Steps = append(s.Steps, step)
+		return nil
+	}
+	return errors.New("unknown statement " + words[0])
+}
+
+func (s *Scenario) parseCommand(step *Step, words []string) error {
+	var err error
+	switch {
+	case words[0] == "press" && len(words) == 5 && words[3] == "on":
+		step.kind = stepPress
+		if step.button, err = parseButton(words[1]); err != nil {
+			return err
+		}
+		step.floor, err = parseFloor(words[2])
+		return s.parseNode(step, words[4], false, err)
+
+	case words[0] == "press" && len(words) == 4 && words[1] == "stop" && words[2] == "on":
+		step.kind = stepPressStop
+		return s.parseNode(step, words[3], false, nil)
+
+	case words[0] == "call" && len(words) == 6 && words[2] == "to" && words[4] == "on":
+		step.kind = stepCall
+		if step.floor, err = parseFloor(words[1]); err != nil {
+			return err
+		}
+		if step.destination, err = parseFloor(words[3]); err == nil && step.destination == step.floor {
+			err = errors.New("the passenger is already on floor " + words[1])
+		}
+		return s.parseNode(step, words[5], false, err)
+
+	case (words[0] == "kill" || words[0] == "revive") && len(words) == 2:
+		step.kind = stepKill
+		if words[0] == "revive" {
+			step.kind = stepRevive
+		}
+		return s.parseNode(step, words[1], false, nil)
+
+	case words[0] == "assert" && len(words) == 7 && words[1] == "light" && words[5] == "on":
+		step.kind = stepAssertLight
+		if step.active, err = parseOnOff(words[2], "on", "off"); err != nil {
+			return err
+		}
+		if step.button, err = parseButton(words[3]); err != nil {
+			return err
+		}
+		step.floor, err = parseFloor(words[4])
+		return s.parseNode(step, words[6], true, err)
+
+	case words[0] == "partition" && len(words) >= 2:
+		step.kind = stepPartition
+		group := []string{}
+		for _, word := range append(words[1:], "|") {
+			if word != "|" {
+				if !s.hasNode(word) {
+					return errors.New("unknown node " + word)
+				}
+				group = append(group, word)
+			} else if len(group) != 0 {
+				step.groups = append(step.groups, group)
+				group = []string{}
+			}
+		}
+		return nil
+
+	case (words[0] == "break" || words[0] == "jam" || words[0] == "repair") && len(words) == 4 && words[1] == "motor" && words[2] == "on":
+		step.kind = map[string]int{"break": stepBreakMotor, "jam": stepJamMotor, "repair": stepRepairMotor}[words[0]]
+		return s.parseNode(step, words[3], false, nil)
+
+	case (words[0] == "obstruct" || words[0] == "release") && len(words) == 4 && words[1] == "door" && words[2] == "on":
+		step.kind = stepObstructDoor
+		if words[0] == "release" {
+			step.kind = stepReleaseDoor
+		}
+		return s.parseNode(step, words[3], false, nil)
+
+	case words[0] == "blank" && len(words) == 4 && words[1] == "lights" && words[2] == "on":
+		step.kind = stepBlankLights
+		return s.parseNode(step, words[3], false, nil)
+
+	case words[0] == "forge" && len(words) == 6 && words[1] == "done" && words[4] == "as":
+		step.kind = stepForge
+		if step.button, err = parseButton(words[2]); err != nil {
+			return err
+		}
+		step.floor, err = parseFloor(words[3])
+		return s.parseNode(step, words[5], false, err)
+
+	case words[0] == "replay" && len(words) == 3:
+		step.kind = stepReplay
+		if step.from, err = time.ParseDuration(words[1]); err != nil {
+			return err
+		}
+		if step.to, err = time.ParseDuration(words[2]); err != nil {
+			return err
+		}
+		if step.from > step.to || step.to > step.At {
+			return errors.New("can only replay what has been overheard already")
+		}
+		return nil
+
+	case words[0] == "heal" && len(words) == 1:
+		step.kind = stepHeal
+		return nil
+
+	case words[0] == "assert" && len(words) == 5 && words[1] == "floor" && words[3] == "on":
+		step.kind = stepAssertFloor
+		step.floor, err = parseFloor(words[2])
+		return s.parseNode(step, words[4], false, err)
+
+	case words[0] == "assert" && len(words) == 5 && words[1] == "door" && words[3] == "on":
+		step.kind = stepAssertDoor
+		step.active, err = parseOnOff(words[2], "open", "closed")
+		return s.parseNode(step, words[4], false, err)
+	}
+	return errors.New("unknown command " + strings.Join(words, " "))
+}
+
+func (s *Scenario) parseFaults(words []string) error {
+	for i := 0; i < len(words); i++ {
+		if i+1 >= len(words) {
+			return errors.New("missing value after " + words[i])
+		}
+		var err error
+		switch words[i] {
+		case "drop":
+			s.Faults.Drop, err = parseProbability(words[i+1])
+		case "duplicate":
+			s.Faults.Duplicate, err = parseProbability(words[i+1])
+		case "reorder":
+			s.Faults.Reorder, err = parseProbability(words[i+1])
+			s.Faults.ReorderDelay = 50 * time.Millisecond
+		case "delay":
+			if i+2 >= len(words) {
+				return errors.New("usage: delay <min> <max>")
+			}
+			if s.Faults.MinDelay, err = time.ParseDuration(words[i+1]); err == nil {
+				s.Faults.MaxDelay, err = time.ParseDuration(words[i+2])
+			}
+			i++
+		case "seed":
+			s.Seed, err = strconv.ParseInt(words[i+1], 10, 64)
+		default:
+			return errors.New("unknown fault " + words[i])
+		}
+		if err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+func (s *Scenario) parseNode(step *Step, name string, allowAll bool, err error) error {
+	if err != nil {
+		return err
+	}
+	if !s.hasNode(name) && !(allowAll && name == "all") {
+		return errors.New("unknown node " + name)
+	}
+	step.node = name
+	return nil
+}
+
+func (s *Scenario) hasNode(name string) bool {
+	for _, node := range s.Nodes {
+		if node == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseButton(word string) (int, error) {
+	switch word {
+	case "up":
+		return BUTTON_CALL_UP, nil
+	case "down":
+		return BUTTON_CALL_DOWN, nil
+	case "cab":
+		return BUTTON_COMMAND, nil
+	}
+	return 0, errors.New("unknown button " + word)
+}
+
+func parseProbability(word string) (float64, error) {
+	p, err := strconv.ParseFloat(word, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, errors.New("invalid probability " + word)
+	}
+	return p, nil
+}
+
+func parseFloor(word string) (int, error) {
+	floor, err := strconv.Atoi(word)
+	if err != nil || floor < 0 {
+		return 0, errors.New("invalid floor " + word)
+	}
+	return floor, nil
+}
+
+func parseOnOff(word, on, off string) (bool, error) {
+	switch word {
+	case on:
+		return true, nil
+	case off:
+		return false, nil
+	}
+	return false, errors.New("expected " + on + " or " + off + ", got " + word)
+}
@@ -0,0 +1,90 @@
+package journal
+
+import (
+	. "../typedef"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const debug = false
+
+//Record is everything an elevator must remember to not lose any orders when it restarts alone
+type Record struct {
+	ID                  string
+	InternalOrders      []bool
+	ExternalOrderMatrix [][2]ElevOrder
+}
+
+//Journal keeps the latest Record on disk. A save writes a temporary file and renames it
+//over the old one, so a crash leaves either the old or the new record, never a torn one.
+type Journal struct {
+	path      string
+	lastSaved []byte
+}
+
+func Open(path string) *Journal {
+	return &Journal{path: path}
+}
+
+//Load returns the stored record. ok is false if nothing has been stored yet.
+func (j *Journal) Load() (record Record, ok bool, err error) {
+	data, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return Record{}, false, nil
+	} else if err != nil {
+		return Record{}, false, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		log.Println("JOURNAL:\t The journal", j.path, "is corrupt")
+		return Record{}, false, err
+	}
+	j.lastSaved = data
+	printDebug("Loaded " + j.path)
+	return record, true, nil
+}
+
+//Save stores record. Saving the same record twice only touches the disk once.
+func (j *Journal) Save(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, j.lastSaved) {
+		return nil
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Rename(temp.Name(), j.path); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	j.lastSaved = data
+	printDebug("Saved " + j.path)
+	return nil
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("JOURNAL:\t", s)
+	}
+}
@@ -0,0 +1,121 @@
+package membership
+
+import (
+	"math"
+	"time"
+)
+
+//Peer statuses
+const (
+	Alive = iota
+	Suspected
+	Lost
+)
+
+var Status = []string{
+	"Alive",
+	"Suspected",
+	"Lost",
+}
+
+//Detector judges one peer from the arrival times of its heartbeats.
+//Every peer gets its own Detector.
+type Detector interface {
+	Heartbeat(now time.Time)
+	Status(now time.Time) int
+}
+
+//KMissed suspects a peer when SuspectAfter heartbeats in a row are missing, and declares it lost
+//when LostAfter are missing.
+type KMissed struct {
+	Interval     time.Duration //between the heartbeats of the peer
+	SuspectAfter float64
+	LostAfter    float64
+	last         time.Time
+}
+
+func NewKMissed(interval time.Duration, suspectAfter, lostAfter float64) func() Detector {
+	return func() Detector {
+		return &KMissed{Interval: interval, SuspectAfter: suspectAfter, LostAfter: lostAfter}
+	}
+}
+
+func (d *KMissed) Heartbeat(now time.Time) {
+	d.last = now
+}
+
+func (d *KMissed) Status(now time.Time) int {
+	missed := float64(now.Sub(d.last)) / float64(d.Interval)
+	switch {
+	case missed >= d.LostAfter:
+		return Lost
+	case missed >= d.SuspectAfter:
+		return Suspected
+	}
+	return Alive
+}
+
+//PhiAccrual is the phi accrual failure detector of Hayashibara et al. It learns the distribution
+//of the time between the heartbeats of the peer, and phi is -log10 of the probability that a
+//heartbeat is still coming after the time that has passed since the last one. A phi of 3
+//means a 1 in 1000 chance of wrongly suspecting the peer.
+type PhiAccrual struct {
+	SuspectPhi float64
+	LostPhi    float64
+	MinStdDev  time.Duration //keeps a very regular peer from being suspected on the slightest delay
+	WindowSize int           //number of intervals the distribution is learnt from
+	intervals  []float64     //seconds
+	last       time.Time
+}
+
+//NewPhiAccrual starts every peer off as if it had sent its heartbeats every interval
+func NewPhiAccrual(interval time.Duration, suspectPhi, lostPhi float64) func() Detector {
+	return func() Detector {
+		return &PhiAccrual{
+			SuspectPhi: suspectPhi,
+			LostPhi:    lostPhi,
+			MinStdDev:  interval / 2,
+			WindowSize: 100,
+			intervals:  []float64{interval.Seconds()},
+		}
+	}
+}
+
+func (d *PhiAccrual) Heartbeat(now time.Time) {
+	if !d.last.IsZero() {
+		d.intervals = append(d.intervals, now.Sub(d.last).Seconds())
+		if len(d.intervals) > d.WindowSize {
+			d.intervals = d.intervals[len(d.intervals)-d.WindowSize:]
+		}
+	}
+	d.last = now
+}
+
+func (d *PhiAccrual) Status(now time.Time) int {
+	phi := d.Phi(now)
+	switch {
+	case phi >= d.LostPhi:
+		return Lost
+	case phi >= d.SuspectPhi:
+		return Suspected
+	}
+	return Alive
+}
+
+func (d *PhiAccrual) Phi(now time.Time) float64 {
+	mean, variance := 0.0, 0.0
+	for _, interval := range d.intervals {
+		mean += interval
+	}
+	mean /= float64(len(d.intervals))
+	for _, interval := range d.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(d.intervals))), d.MinStdDev.Seconds())
+	elapsed := now.Sub(d.last).Seconds()
+	later := 0.5 * math.Erfc((elapsed-mean)/(stdDev*math.Sqrt2)) //probability of a heartbeat arriving even later
+	if later < 1e-300 {
+		return math.Inf(1)
+	}
+	return -math.Log10(later)
+}
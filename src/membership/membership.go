@@ -0,0 +1,224 @@
+package membership
+
+import (
+	. "../typedef"
+	"log"
+	"sort"
+	"time"
+)
+
+const debug = false
+
+//------------EVENTS-------
+type Event interface{}
+
+//PeerJoined: ID is alive. Sent the first time it is heard, when it is heard again after it was
+//lost and when it is no longer suspected.
+type PeerJoined struct {
+	ID string
+}
+
+//PeerSuspected: the heartbeats of ID are late. It is still a member, but might be lost soon.
+type PeerSuspected struct {
+	ID string
+}
+
+//PeerLost: the heartbeats of ID have stopped. It is no longer a member.
+type PeerLost struct {
+	ID string
+}
+
+//------------SERVICE-------
+type Config struct {
+	HeartbeatInterval time.Duration
+	CheckInterval     time.Duration   //how often the detectors are asked for the status of the peers
+	NewDetector       func() Detector //creates the detector of a new peer
+}
+
+//Default thresholds of the detectors. A lost peer has its hall orders reassigned right away, so a short
+//burst of lost packets must not lose it. With a fifth of the packets lost, three heartbeats in a row go
+//missing between two elevators every ten seconds or so, but five only every few minutes. At five, a peer
+//that is really gone is still lost in about half a second.
+const (
+	DefaultSuspectAfter = 2
+	DefaultLostAfter    = 5.1
+	DefaultSuspectPhi   = 3
+	DefaultLostPhi      = 8
+)
+
+//DefaultConfig uses a KMissed detector with DefaultSuspectAfter and DefaultLostAfter
+func DefaultConfig() Config {
+	const heartbeatInterval = 100 * time.Millisecond
+	return Config{
+		HeartbeatInterval: heartbeatInterval,
+		CheckInterval:     heartbeatInterval / 2,
+		NewDetector:       NewKMissed(heartbeatInterval, DefaultSuspectAfter, DefaultLostAfter),
+	}
+}
+
+//Service sends the heartbeats (EvIAmAlive) of the local elevator, watches the heartbeats of
+//every elevator, itself included, and reports the changes in membership on Events.
+type Service struct {
+	config           Config
+	localID          string
+	heartbeatChannel chan string
+	stateChannel     chan ElevState
+	eventChannel     chan Event
+	quit             chan bool
+	done             chan bool
+}
+
+type peer struct {
+	detector Detector
+	status   int
+}
+
+//Start starts the service. The heartbeats are sent on sendRestoreChannel with state in them,
+//see UpdateState. The local elevator counts as heard from when the service starts.
+func Start(config Config, localID string, state ElevState, sendRestoreChannel chan<- ElevRestoreMessage) *Service {
+	s := &Service{
+		config:           config,
+		localID:          localID,
+		heartbeatChannel: make(chan string, 10),
+		stateChannel:     make(chan ElevState, 1),
+		eventChannel:     make(chan Event),
+		quit:             make(chan bool),
+		done:             make(chan bool),
+	}
+	go s.run(state, sendRestoreChannel)
+	return s
+}
+
+//Events returns the channel the membership changes are reported on
+func (s *Service) Events() <-chan Event {
+	return s.eventChannel
+}
+
+//HeartbeatReceived must be called for every EvIAmAlive received, also the ones from the local elevator
+func (s *Service) HeartbeatReceived(ID string) {
+	select {
+	case s.heartbeatChannel <- ID:
+	case <-s.done:
+	}
+}
+
+//UpdateState changes the state sent in the heartbeats
+func (s *Service) UpdateState(state ElevState) {
+	select {
+	case s.stateChannel <- state:
+	case <-s.done:
+	}
+}
+
+func (s *Service) Stop() {
+	close(s.quit)
+	<-s.done
+}
+
+//run never blocks on the receiver of the events, they are queued until they are taken.
+//The caller may be waiting in HeartbeatReceived or UpdateState meanwhile. Nor does it block on the
+//network, or the peers would not be checked and all be lost together when the network is slow.
+//The heartbeats are sent by sendHeartbeats, and skipped while the one before has not been sent.
+func (s *Service) run(state ElevState, sendRestoreChannel chan<- ElevRestoreMessage) {
+	heartbeatTick := time.NewTicker(s.config.HeartbeatInterval)
+	defer heartbeatTick.Stop()
+	checkTick := time.NewTicker(s.config.CheckInterval)
+	defer checkTick.Stop()
+	heartbeats := make(chan ElevRestoreMessage, 1)
+	go s.sendHeartbeats(heartbeats, sendRestoreChannel)
+	peers := make(map[string]*peer)
+	queue := []Event{}
+	s.heard(peers, s.localID, time.Now(), &queue)
+	for {
+		var eventChannel chan<- Event
+		var next Event
+		if len(queue) > 0 {
+			eventChannel = s.eventChannel
+			next = queue[0]
+		}
+		select {
+		case eventChannel <- next:
+			queue = queue[1:]
+
+		case ID := <-s.heartbeatChannel:
+			s.heard(peers, ID, time.Now(), &queue)
+
+		case state = <-s.stateChannel:
+
+		case <-heartbeatTick.C:
+			select {
+			case heartbeats <- ElevRestoreMessage{ResponderID: s.localID, Event: EvIAmAlive, State: state.Copy()}:
+			default:
+				printDebug("The last heartbeat has not been sent yet. Skipping this one")
+			}
+
+		case now := <-checkTick.C:
+			s.check(peers, now, &queue)
+
+		case <-s.quit:
+			close(s.done)
+			return
+		}
+	}
+}
+
+//sendHeartbeats sends the heartbeats on the network until the service is stopped
+func (s *Service) sendHeartbeats(heartbeats <-chan ElevRestoreMessage, sendRestoreChannel chan<- ElevRestoreMessage) {
+	for {
+		select {
+		case msg := <-heartbeats:
+			select {
+			case sendRestoreChannel <- msg:
+			case <-s.quit:
+				return
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Service) heard(peers map[string]*peer, ID string, now time.Time, queue *[]Event) {
+	p, ok := peers[ID]
+	if !ok {
+		p = &peer{detector: s.config.NewDetector(), status: Lost}
+		peers[ID] = p
+	}
+	p.detector.Heartbeat(now)
+	if p.status != Alive {
+		log.Println("MEMBERSHIP:\t", ID, "is alive")
+		p.status = Alive
+		*queue = append(*queue, PeerJoined{ID})
+	}
+}
+
+func (s *Service) check(peers map[string]*peer, now time.Time, queue *[]Event) {
+	IDs := []string{}
+	for ID := range peers {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+	for _, ID := range IDs {
+		p := peers[ID]
+		status := p.detector.Status(now)
+		if status == p.status || (status == Alive && p.status == Lost) {
+			continue
+		}
+		log.Println("MEMBERSHIP:\t", ID, "is", Status[status])
+		p.status = status
+		switch status {
+		case Alive:
+			*queue = append(*queue, PeerJoined{ID})
+		case Suspected:
+			*queue = append(*queue, PeerSuspected{ID})
+		case Lost:
+			*queue = append(*queue, PeerLost{ID})
+		}
+	}
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("MEMBERSHIP:\t", s)
+	}
+}
@@ -0,0 +1,141 @@
+package membership
+
+import (
+	. "../typedef"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKMissed(t *testing.T) {
+	tests := []struct {
+		elapsed time.Duration //since the last heartbeat
+		status  int
+	}{
+		{0, Alive},
+		{199 * time.Millisecond, Alive},
+		{200 * time.Millisecond, Suspected},
+		{509 * time.Millisecond, Suspected},
+		{510 * time.Millisecond, Lost},
+	}
+	start := time.Unix(0, 0)
+	for _, test := range tests {
+		d := NewKMissed(100*time.Millisecond, 2, 5.1)()
+		d.Heartbeat(start)
+		if status := d.Status(start.Add(test.elapsed)); status != test.status {
+			t.Errorf("%v after the last heartbeat: got %s, want %s", test.elapsed, Status[status], Status[test.status])
+		}
+	}
+}
+
+func TestPhiAccrual(t *testing.T) {
+	//With heartbeats every 100ms the spread is the minimum of 50ms, so phi is 3 about 255ms and 8 about 381ms after the last one
+	tests := []struct {
+		elapsed time.Duration
+		status  int
+	}{
+		{100 * time.Millisecond, Alive},
+		{240 * time.Millisecond, Alive},
+		{270 * time.Millisecond, Suspected},
+		{370 * time.Millisecond, Suspected},
+		{400 * time.Millisecond, Lost},
+	}
+	start := time.Unix(0, 0)
+	for _, test := range tests {
+		d := NewPhiAccrual(100*time.Millisecond, 3, 8)()
+		last := start
+		for i := 0; i < 10; i++ {
+			last = start.Add(time.Duration(i) * 100 * time.Millisecond)
+			d.Heartbeat(last)
+		}
+		if status := d.Status(last.Add(test.elapsed)); status != test.status {
+			t.Errorf("%v after the last heartbeat: got %s, want %s", test.elapsed, Status[status], Status[test.status])
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	type step struct {
+		at     time.Duration //on the clock of the service
+		heard  []string      //before the peers are checked
+		events []Event
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "the local elevator joins once while it hears itself",
+			steps: []step{
+				{0, []string{"A"}, []Event{PeerJoined{"A"}}},
+				{100 * time.Millisecond, []string{"A"}, []Event{}},
+				{200 * time.Millisecond, []string{"A"}, []Event{}},
+			},
+		},
+		{
+			name: "a peer is suspected and then lost",
+			steps: []step{
+				{0, []string{"A", "B"}, []Event{PeerJoined{"A"}, PeerJoined{"B"}}},
+				{100 * time.Millisecond, []string{"A"}, []Event{}},
+				{200 * time.Millisecond, []string{"A"}, []Event{PeerSuspected{"B"}}},
+				{400 * time.Millisecond, []string{"A"}, []Event{}},
+				{510 * time.Millisecond, []string{"A"}, []Event{PeerLost{"B"}}},
+			},
+		},
+		{
+			name: "a suspected peer that is heard again is alive",
+			steps: []step{
+				{0, []string{"A", "B"}, []Event{PeerJoined{"A"}, PeerJoined{"B"}}},
+				{250 * time.Millisecond, []string{"A"}, []Event{PeerSuspected{"B"}}},
+				{300 * time.Millisecond, []string{"A", "B"}, []Event{PeerJoined{"B"}}},
+				{400 * time.Millisecond, []string{"A", "B"}, []Event{}},
+			},
+		},
+		{
+			name: "a lost peer that is heard again joins",
+			steps: []step{
+				{0, []string{"A", "B"}, []Event{PeerJoined{"A"}, PeerJoined{"B"}}},
+				{600 * time.Millisecond, []string{"A"}, []Event{PeerLost{"B"}}},
+				{700 * time.Millisecond, []string{"A", "B"}, []Event{PeerJoined{"B"}}},
+			},
+		},
+	}
+	start := time.Unix(0, 0)
+	for _, test := range tests {
+		s := &Service{config: Config{NewDetector: NewKMissed(100*time.Millisecond, 2, 5.1)}, localID: "A"}
+		peers := make(map[string]*peer)
+		for i, step := range test.steps {
+			queue := []Event{}
+			now := start.Add(step.at)
+			for _, ID := range step.heard {
+				s.heard(peers, ID, now, &queue)
+			}
+			s.check(peers, now, &queue)
+			if !reflect.DeepEqual(queue, step.events) {
+				t.Errorf("%s, step %d: got the events %v, want %v", test.name, i, queue, step.events)
+			}
+		}
+	}
+}
+
+//TestSlowNetwork checks that the peers are still checked while the network does not take the heartbeats
+func TestSlowNetwork(t *testing.T) {
+	config := Config{
+		HeartbeatInterval: 10 * time.Millisecond,
+		CheckInterval:     5 * time.Millisecond,
+		NewDetector:       NewKMissed(10*time.Millisecond, 2, 5.1),
+	}
+	sendRestoreChannel := make(chan ElevRestoreMessage) //never read
+	s := Start(config, "A", ElevState{}, sendRestoreChannel)
+	defer s.Stop()
+	for {
+		select {
+		case event := <-s.Events():
+			if event == (PeerLost{"A"}) {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the local elevator was not lost while the network took no heartbeats")
+		}
+	}
+}
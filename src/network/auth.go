@@ -0,0 +1,164 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Signed packets have a trailer after the envelope (big endian):
+//
+//	counter 8 bytes   unix time in nanoseconds, strictly increasing per sender
+//	mac     32 bytes  HMAC-SHA256 with the cluster key over the envelope and the counter
+//
+//The counter is what protects against replays. A receiver accepts every counter once, as long
+//as it is within maxClockSkew of its own clock and within replayWindow of the newest counter
+//it has seen from that sender. The counter is a time, so it keeps increasing across restarts.
+//There is no newest counter from a sender the receiver has not heard from, e.g. since it restarted,
+//so the first packet from a sender must be within firstPacketSkew of the clock of the receiver.
+const (
+	counterLength = 8
+	macLength     = sha256.Size
+	trailerLength = counterLength + macLength
+)
+
+//maxClockSkew is how far the clocks of the elevators may drift apart. A replayed packet is
+//never accepted once it is this old.
+const maxClockSkew = 30 * time.Second
+
+//firstPacketSkew is how far the clocks of the elevators may drift apart for them to hear from each other
+//the first time. A replayed packet is accepted by a receiver that has not heard from its sender only
+//if it is newer than this, which is why it is so much tighter than maxClockSkew.
+const firstPacketSkew = time.Second
+
+//replayWindow is how much older than the newest packet of a sender a reordered packet may be
+const replayWindow = 2 * time.Second
+
+var (
+	errUnsigned  = errors.New("NETWORK:\t Unsigned packet")
+	errSignature = errors.New("NETWORK:\t Bad signature")
+	errStale     = errors.New("NETWORK:\t Packet outside of the clock skew limit")
+	errReplayed  = errors.New("NETWORK:\t Replayed packet")
+)
+
+//LoadKey reads the pre-shared cluster key from path. Every elevator in the cluster must use the same key.
+func LoadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < 16 {
+		return nil, errors.New("NETWORK:\t The key in " + path + " is shorter than 16 bytes")
+	}
+	return key, nil
+}
+
+//authenticator signs outgoing packets and verifies incoming ones. Without a key it does neither.
+type authenticator struct {
+	key         []byte
+	mutex       *sync.Mutex
+	lastCounter uint64
+	senders     map[string]*replayState //key = node ID
+	now         func() time.Time
+}
+
+type replayState struct {
+	newest uint64
+	seen   map[uint64]bool //counters within replayWindow of newest
+}
+
+func newAuthenticator(key []byte) *authenticator {
+	return &authenticator{
+		key:     key,
+		mutex:   &sync.Mutex{},
+		senders: make(map[string]*replayState),
+		now:     time.Now,
+	}
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.key) > 0
+}
+
+//sign appends the trailer to envelope
+func (a *authenticator) sign(envelope []byte) []byte {
+	if !a.enabled() {
+		return envelope
+	}
+	a.mutex.Lock()
+	counter := uint64(a.now().UnixNano())
+	if counter <= a.lastCounter {
+		counter = a.lastCounter + 1
+	}
+	a.lastCounter = counter
+	a.mutex.Unlock()
+	data := make([]byte, len(envelope), len(envelope)+trailerLength)
+	copy(data, envelope)
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(data[len(envelope):], counter)
+	return append(data, a.mac(data)...)
+}
+
+//verify checks the signature of data and returns the envelope and the counter.
+//The counter must be passed to checkReplay once the sender of the envelope is known.
+func (a *authenticator) verify(data []byte) (envelope []byte, counter uint64, err error) {
+	if !a.enabled() {
+		return data, 0, nil
+	}
+	if len(data) < trailerLength || data[0] == '{' {
+		return nil, 0, errUnsigned
+	}
+	signed := data[:len(data)-macLength]
+	if !hmac.Equal(a.mac(signed), data[len(signed):]) {
+		return nil, 0, errSignature
+	}
+	envelope = signed[:len(signed)-counterLength]
+	return envelope, binary.BigEndian.Uint64(signed[len(envelope):]), nil
+}
+
+//checkReplay accepts every counter from nodeID once. The first one must be within firstPacketSkew of now.
+func (a *authenticator) checkReplay(nodeID string, counter uint64) error {
+	if !a.enabled() {
+		return nil
+	}
+	now := a.now()
+	sent := time.Unix(0, int64(counter))
+	if sent.Before(now.Add(-maxClockSkew)) || sent.After(now.Add(maxClockSkew)) {
+		return errStale
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	state, ok := a.senders[nodeID]
+	if !ok {
+		if sent.Before(now.Add(-firstPacketSkew)) || sent.After(now.Add(firstPacketSkew)) {
+			return errStale
+		}
+		state = &replayState{newest: counter, seen: make(map[uint64]bool)}
+		a.senders[nodeID] = state
+	}
+	if state.seen[counter] || counter+uint64(replayWindow) < state.newest {
+		return errReplayed
+	}
+	state.seen[counter] = true
+	if counter > state.newest {
+		state.newest = counter
+		for old := range state.seen {
+			if old+uint64(replayWindow) < state.newest {
+				delete(state.seen, old)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *authenticator) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, a.key)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckReplay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	at := func(offset time.Duration) uint64 {
+		return uint64(now.Add(offset).UnixNano())
+	}
+	type packet struct {
+		from    string
+		counter uint64
+		err     error
+	}
+	tests := []struct {
+		name    string
+		packets []packet
+	}{
+		{
+			name:    "a packet from a new sender",
+			packets: []packet{{"A", at(-500 * time.Millisecond), nil}},
+		},
+		{
+			name:    "a packet captured before a restart, from a sender not heard from since",
+			packets: []packet{{"A", at(-20 * time.Second), errStale}, {"A", at(0), nil}},
+		},
+		{
+			name:    "a packet from a sender whose clock is ahead of the first packet skew",
+			packets: []packet{{"A", at(2 * time.Second), errStale}},
+		},
+		{
+			name:    "a packet outside of the clock skew",
+			packets: []packet{{"A", at(0), nil}, {"A", at(-31 * time.Second), errStale}},
+		},
+		{
+			name:    "a replayed packet",
+			packets: []packet{{"A", at(0), nil}, {"A", at(0), errReplayed}},
+		},
+		{
+			name:    "a reordered packet within the replay window",
+			packets: []packet{{"A", at(0), nil}, {"A", at(-time.Second), nil}},
+		},
+		{
+			name:    "a packet older than the replay window",
+			packets: []packet{{"A", at(0), nil}, {"A", at(-3 * time.Second), errReplayed}},
+		},
+		{
+			name:    "the same counter from another sender",
+			packets: []packet{{"A", at(0), nil}, {"B", at(0), nil}},
+		},
+	}
+	for _, test := range tests {
+		a := newAuthenticator([]byte("0123456789abcdef"))
+		a.now = func() time.Time { return now }
+		for i, p := range test.packets {
+			if err := a.checkReplay(p.from, p.counter); err != p.err {
+				t.Errorf("%s, packet %d: got %v, want %v", test.name, i, err, p.err)
+			}
+		}
+	}
+}
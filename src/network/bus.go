@@ -0,0 +1,133 @@
+package network
+
+import (
+	"../udp"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const busInboxSize = 100
+
+//Faults describes how badly the Bus treats the packets between two different nodes.
+//The probabilities are drawn independently for every receiver of a broadcast.
+type Faults struct {
+	Drop         float64       //probability that a packet is lost
+	Duplicate    float64       //probability that a packet arrives twice
+	Reorder      float64       //probability that a packet is held back ReorderDelay so later ones overtake it
+	MinDelay     time.Duration //every packet is delayed uniformly between MinDelay and MaxDelay
+	MaxDelay     time.Duration
+	ReorderDelay time.Duration
+}
+
+//Bus is an in-memory broadcast medium for running several nodes in one process.
+//Like UDP broadcast every message is delivered to all attached nodes, the sender included,
+//and messages to a node with a full inbox are dropped.
+//Faults and partitions only apply between different nodes, a node always hears itself.
+type Bus struct {
+	mutex     *sync.Mutex
+	inboxes   map[string]chan udp.UDPMessage //key = IPadr
+	faults    Faults
+	random    *rand.Rand
+	partition map[string]int //key = IPadr, value = group. Nodes outside the map are in group 0
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		mutex:     &sync.Mutex{},
+		inboxes:   make(map[string]chan udp.UDPMessage),
+		random:    rand.New(rand.NewSource(1)),
+		partition: make(map[string]int),
+	}
+}
+
+//SetFaults starts injecting faults. The same seed gives the same sequence of decisions.
+func (b *Bus) SetFaults(faults Faults, seed int64) {
+	b.mutex.Lock()
+	b.faults = faults
+	b.random = rand.New(rand.NewSource(seed))
+	b.mutex.Unlock()
+}
+
+//Partition splits the bus so that only nodes in the same group can hear each other.
+//Nodes not mentioned form a group of their own.
+func (b *Bus) Partition(groups ...[]string) {
+	b.mutex.Lock()
+	b.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, IP := range group {
+			b.partition[IP] = i + 1
+		}
+	}
+	b.mutex.Unlock()
+}
+
+func (b *Bus) Heal() {
+	b.Partition()
+}
+
+//Attach connects localIP to the bus and returns its inbox. Attaching an address again replaces the old inbox.
+func (b *Bus) Attach(localIP string) <-chan udp.UDPMessage {
+	inbox := make(chan udp.UDPMessage, busInboxSize)
+	b.mutex.Lock()
+	b.inboxes[localIP] = inbox
+	b.mutex.Unlock()
+	return inbox
+}
+
+//Detach disconnects localIP. It neither receives nor sends anything until it is attached again.
+func (b *Bus) Detach(localIP string) {
+	b.mutex.Lock()
+	delete(b.inboxes, localIP)
+	b.mutex.Unlock()
+}
+
+func (b *Bus) Broadcast(senderIP string, data []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.inboxes[senderIP]; !ok {
+		printDebug("Dropped a message from detached " + senderIP)
+		return
+	}
+	msg := udp.UDPMessage{Raddr: senderIP, Data: data, Length: len(data)}
+	for IP, inbox := range b.inboxes {
+		if IP == senderIP {
+			deliver(inbox, msg)
+			continue
+		}
+		if b.partition[IP] != b.partition[senderIP] {
+			continue
+		}
+		if b.random.Float64() < b.faults.Drop {
+			printDebug("Dropping a message from " + senderIP + " to " + IP)
+			continue
+		}
+		copies := 1
+		if b.random.Float64() < b.faults.Duplicate {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			delay := b.faults.MinDelay
+			if b.faults.MaxDelay > b.faults.MinDelay {
+				delay += time.Duration(b.random.Int63n(int64(b.faults.MaxDelay - b.faults.MinDelay)))
+			}
+			if b.random.Float64() < b.faults.Reorder {
+				delay += b.faults.ReorderDelay
+			}
+			if delay == 0 {
+				deliver(inbox, msg)
+			} else {
+				inbox := inbox
+				time.AfterFunc(delay, func() { deliver(inbox, msg) })
+			}
+		}
+	}
+}
+
+func deliver(inbox chan udp.UDPMessage, msg udp.UDPMessage) {
+	select {
+	case inbox <- msg:
+	default:
+		printDebug("Inbox of " + msg.Raddr + "'s receiver is full. Dropping message")
+	}
+}
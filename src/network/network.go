@@ -1,98 +1,254 @@
 package network
 
 import (
+	"../protocol"
 	. "../typedef"
 	"../udp"
-	"encoding/json"
+	"errors"
 	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const debug = false
 
-func Init(reciveOrderChannel chan<- ElevOrderMessage,
+//peerVersionTimeout is how long a peer that has gone silent still holds the protocol version down
+const peerVersionTimeout = 5 * time.Second
+
+//Init starts the network on transport, see Transport for the available ones.
+//localID is put in the envelope of every packet sent. With a key every packet is signed
+//with it, and packets that are not signed with the same key are rejected.
+//The messages on sendReliableChannel are sent reliably, see ReliableMessage.
+//The protocol version the cluster talks is sent on versionChannel whenever it changes.
+func Init(transport Transport, key []byte, localID string, numFloors int,
+	reciveOrderChannel chan<- ElevOrderMessage,
 	sendOrderChannel <-chan ElevOrderMessage,
 	reciveRestoreChannel chan<- ElevRestoreMessage,
-	sendRestoreChannel <-chan ElevRestoreMessage) (localIP string, err error) {
+	sendRestoreChannel <-chan ElevRestoreMessage,
+	sendReliableChannel <-chan ReliableMessage,
+	versionChannel chan<- uint8) (localIP string, err error) {
 	const messageSize = 4 * 1024
-	const UDPLocalListenPort = 22301
-	const UDPBroadcastListenPort = 22302
 	UDPSendChannel := make(chan udp.UDPMessage, 10)
 	UDPReceiveChannel := make(chan udp.UDPMessage)
-	localIP, err = udp.Init(UDPLocalListenPort, UDPBroadcastListenPort, messageSize, UDPSendChannel, UDPReceiveChannel)
+	localIP, err = transport.Start(messageSize, UDPSendChannel, UDPReceiveChannel)
 	if err != nil {
 		return "", err
 	}
-	go reciveMessageHandler(reciveOrderChannel, reciveRestoreChannel, UDPReceiveChannel)
-	go sendMessageHandler(sendOrderChannel, sendRestoreChannel, UDPSendChannel)
+	if len(key) == 0 {
+		log.Println("NETWORK:\t No cluster key. Packets are neither signed nor authenticated")
+	}
+	versions := newPeerVersions()
+	auth := newAuthenticator(key)
+	reliable := newReliableSender()
+	out := transmitter{localID: localID, auth: auth, UDPSendChannel: UDPSendChannel}
+	go reciveMessageHandler(numFloors, out, versions, auth, reliable, reciveOrderChannel, reciveRestoreChannel, UDPReceiveChannel)
+	go sendMessageHandler(out, versions, reliable, sendOrderChannel, sendRestoreChannel, sendReliableChannel, versionChannel)
 	return localIP, nil
 }
 
-func reciveMessageHandler(reciveOrderChannel chan<- ElevOrderMessage, reciveRestoreChannel chan<- ElevRestoreMessage, UDPReceiveChannel <-chan udp.UDPMessage) {
-	for {
-		select {
-		case msg := <-UDPReceiveChannel:
-			var f interface{}
-			err := json.Unmarshal(msg.Data[:msg.Length], &f)
-			if err != nil {
-				printDebug("Error with Unmarshaling a message.")
-				log.Println(err)
-			} else {
-				m := f.(map[string]interface{})
-				event := int(m["Event"].(float64))
-				if event <= 3 && event >= 0 {
-					var restore = ElevRestoreMessage{}
-					if err := json.Unmarshal(msg.Data[:msg.Length], &restore); err == nil {
-						if restore.IsValid() {
-							reciveRestoreChannel <- restore
-							printDebug("Recived an ElevRestoreMessage with Event " + EventType[restore.Event])
-						} else {
-							printDebug("Rejected an ElevRestoreMessage with Event " + EventType[restore.Event])
-						}
-					} else {
-						printDebug("Error with Unmarshaling a ElevStateMessage")
-					}
-				} else if event >= 4 && event <= 10 {
-					var order = ElevOrderMessage{}
-					if err := json.Unmarshal(msg.Data[:msg.Length], &order); err == nil {
-						if order.IsValid() {
-							reciveOrderChannel <- order
-							printDebug("Recived an ElevOrderMessage with Event " + EventType[order.Event])
-						} else {
-							printDebug("Rejected an ElevOrderMessage with Event " + EventType[order.Event])
-						}
-					}
-				} else {
-					printDebug("Recived an unknown message type")
-				}
+func reciveMessageHandler(numFloors int, out transmitter, versions *peerVersions, auth *authenticator, reliable *reliableSender, reciveOrderChannel chan<- ElevOrderMessage, reciveRestoreChannel chan<- ElevRestoreMessage, UDPReceiveChannel <-chan udp.UDPMessage) {
+	rejected := newRejectCounter()
+	received := newDedup()
+	for msg := range UDPReceiveChannel {
+		envelope, counter, err := auth.verify(msg.Data[:msg.Length])
+		if err != nil {
+			rejected.add(rejectUnauthenticated, msg.Raddr, err)
+			continue
+		}
+		packet, err := protocol.Unmarshal(envelope)
+		if err != nil {
+			rejected.add(rejectMalformed, msg.Raddr, err)
+			continue
+		}
+		if sender := claimedSender(packet); sender != packet.NodeID {
+			rejected.add(rejectImpersonating, msg.Raddr, errors.New("NETWORK:\t "+packet.NodeID+" sent a message as "+sender))
+			continue
+		}
+		if err := auth.checkReplay(packet.NodeID, counter); err != nil {
+			rejected.add(rejectReplayed, msg.Raddr, err)
+			continue
+		}
+		versions.update(packet.NodeID, packet.MaxVersion)
+		if packet.Ack != nil {
+			if packet.Ack.To == out.localID {
+				reliable.acked(packet.NodeID, packet.Ack.Seq)
 			}
+			continue
+		}
+		valid := (packet.Restore != nil && packet.Restore.IsValid(numFloors)) || (packet.Order != nil && packet.Order.IsValid(numFloors))
+		if !valid {
+			printDebug("Rejected an invalid message from " + packet.NodeID)
+			continue
+		}
+		isReliable := packet.Flags&protocol.FlagReliable != 0
+		if isReliable && received.duplicate(packet.NodeID, packet.Seq) {
+			printDebug("Dropped a duplicate of reliable message " + strconv.Itoa(int(packet.Seq)) + " from " + packet.NodeID)
+		} else if packet.Restore != nil {
+			reciveRestoreChannel <- *packet.Restore
+			printDebug("Recived an ElevRestoreMessage with Event " + EventType[packet.Restore.Event])
+		} else {
+			reciveOrderChannel <- *packet.Order
+			printDebug("Recived an ElevOrderMessage with Event " + EventType[packet.Order.Event])
+		}
+		if isReliable && packet.NodeID != out.localID {
+			out.send(protocol.Envelope{Version: protocol.VersionReliable}, protocol.Ack{To: packet.NodeID, Seq: packet.Seq})
 		}
 	}
 }
 
-func sendMessageHandler(sendOrderChannel <-chan ElevOrderMessage, sendRestoreChannel <-chan ElevRestoreMessage, UDPSendChannel chan<- udp.UDPMessage) {
+//claimedSender is the node a message says it is from. A node may only send messages as itself.
+func claimedSender(packet protocol.Packet) string {
+	switch {
+	case packet.Order != nil:
+		return packet.Order.SenderID
+	case packet.Restore != nil && packet.Restore.Event == EvRequestingState:
+		return packet.Restore.AskerID
+	case packet.Restore != nil:
+		return packet.Restore.ResponderID
+	}
+	return packet.NodeID
+}
+
+func sendMessageHandler(out transmitter, versions *peerVersions, reliable *reliableSender, sendOrderChannel <-chan ElevOrderMessage, sendRestoreChannel <-chan ElevRestoreMessage, sendReliableChannel <-chan ReliableMessage, versionChannel chan<- uint8) {
+	seq := uint32(rand.New(rand.NewSource(time.Now().UnixNano())).Int63()) //a restarted node must not reuse recent sequence numbers
+	reported := uint8(protocol.Version)
 	for {
+		seq++
+		header := protocol.Envelope{Version: versions.negotiated(), Seq: seq}
+		if header.Version != reported {
+			//The receiver may be waiting to give us a message, so it is told again next time if it is busy
+			select {
+			case versionChannel <- header.Version:
+				reported = header.Version
+			default:
+			}
+		}
+		var msg interface{}
 		select {
-		case msg := <-sendOrderChannel:
-			networkPack, err := json.Marshal(msg)
-			if err != nil {
-				printDebug("Error Marshalling an outgoing message")
-				log.Println(err)
-			} else {
-				UDPSendChannel <- udp.UDPMessage{Raddr: "broadcast", Data: networkPack}
-				printDebug("Sent an ElevOrderMessage with Event " + EventType[msg.Event])
+		case order := <-sendOrderChannel:
+			msg = order
+		case restore := <-sendRestoreChannel:
+			msg = restore
+		case message := <-sendReliableChannel:
+			msg = message.Msg
+			to := []string{}
+			for _, ID := range message.To {
+				if ID != out.localID {
+					to = append(to, ID)
+				}
 			}
-
-		case msg := <-sendRestoreChannel:
-			networkPack, err := json.Marshal(msg)
-			if err != nil {
-				printDebug("Error Marshalling an outgoing message")
-				log.Println(err)
-			} else {
-				UDPSendChannel <- udp.UDPMessage{Raddr: "broadcast", Data: networkPack}
-				printDebug("Sent an ElevOrderMessage with Event " + EventType[msg.Event])
+			message.To = to
+			if header.Version < protocol.VersionReliable {
+				//Somebody in the cluster does not know reliable messages. Send it once and hope for the best.
+				report(message, message.To, nil)
+			} else if reliable.add(seq, message) {
+				header.Flags = protocol.FlagReliable
+			}
+		case retransmitSeq := <-reliable.retransmitChannel:
+			var ok bool
+			if msg, ok = reliable.retransmit(retransmitSeq); !ok {
+				continue
+			}
+			version := header.Version
+			if version < protocol.VersionReliable { //somebody older has joined since the message was first sent
+				version = protocol.VersionReliable
 			}
+			header = protocol.Envelope{Version: version, Flags: protocol.FlagReliable, Seq: retransmitSeq}
 		}
+		out.send(header, msg)
+	}
+}
+
+//peerVersions remembers the newest protocol version every peer speaks,
+//so the cluster talks the newest version all of its members understand
+type peerVersions struct {
+	mutex    *sync.Mutex
+	versions map[string]uint8     //key = node ID
+	lastSeen map[string]time.Time //key = node ID
+}
+
+func newPeerVersions() *peerVersions {
+	return &peerVersions{
+		mutex:    &sync.Mutex{},
+		versions: make(map[string]uint8),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (v *peerVersions) update(nodeID string, maxVersion uint8) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if old, ok := v.versions[nodeID]; !ok || old != maxVersion {
+		log.Println("NETWORK:\t", nodeID, "speaks protocol version", maxVersion)
+	}
+	v.versions[nodeID] = maxVersion
+	v.lastSeen[nodeID] = time.Now()
+}
+
+//negotiated is the newest version every peer speaks
+func (v *peerVersions) negotiated() uint8 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	version := uint8(protocol.Version)
+	for nodeID, maxVersion := range v.versions {
+		if time.Since(v.lastSeen[nodeID]) > peerVersionTimeout {
+			delete(v.versions, nodeID)
+			delete(v.lastSeen, nodeID)
+		} else if maxVersion < version {
+			version = maxVersion
+		}
+	}
+	return version
+}
+
+//Reasons for rejecting a packet
+const (
+	rejectMalformed = iota
+	rejectUnauthenticated
+	rejectImpersonating
+	rejectReplayed
+)
+
+var rejectReason = [...]string{
+	"malformed",
+	"unauthenticated",
+	"impersonating",
+	"replayed",
+}
+
+//rejectLogInterval limits the logging of a flood of bad packets
+const rejectLogInterval = time.Second
+
+//rejectCounter counts the rejected packets by reason. Every reason is logged at most
+//once per rejectLogInterval, together with the counts so far.
+type rejectCounter struct {
+	counts     [len(rejectReason)]int
+	suppressed [len(rejectReason)]int
+	lastLog    [len(rejectReason)]time.Time
+}
+
+func newRejectCounter() *rejectCounter {
+	return &rejectCounter{}
+}
+
+func (r *rejectCounter) add(reason int, from string, err error) {
+	r.counts[reason]++
+	if time.Since(r.lastLog[reason]) < rejectLogInterval {
+		r.suppressed[reason]++
+		return
+	}
+	counts := ""
+	for i, count := range r.counts {
+		counts += " " + rejectReason[i] + "=" + strconv.Itoa(count)
+	}
+	if r.suppressed[reason] > 0 {
+		counts += ", " + strconv.Itoa(r.suppressed[reason]) + " " + rejectReason[reason] + " not logged"
 	}
+	log.Println("NETWORK:\t Rejected a packet from", from+":", err, "(rejected so far:"+counts+")")
+	r.lastLog[reason] = time.Now()
+	r.suppressed[reason] = 0
 }
 
 func printDebug(s string) {
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"../protocol"
+	. "../typedef"
+	"../udp"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//A reliable message is sent with protocol.FlagReliable and a sequence number that is unique for
+//the sender. Every receiver except the sender answers with an Ack, also to duplicates since the
+//first Ack may have been lost, and hands the message on only once. The sender retransmits the
+//message until everybody in To has acked it, backing off for every retransmission, and gives up
+//after maxRetransmissions.
+const (
+	retransmitTimeout    = 100 * time.Millisecond //before the first retransmission
+	maxRetransmitTimeout = 400 * time.Millisecond
+	maxRetransmissions   = 5
+	dedupMemory          = 10 * time.Second //how long a received sequence number is remembered, longer than the sender keeps trying
+)
+
+type pendingMessage struct {
+	message         ReliableMessage
+	missing         map[string]bool
+	delivered       []string
+	retransmissions int
+	timeout         time.Duration
+	timer           *time.Timer
+}
+
+//reliableSender keeps the reliable messages that have not been acked by everybody yet.
+//Retransmissions are due when their sequence number shows up on retransmitChannel.
+type reliableSender struct {
+	mutex             *sync.Mutex
+	pending           map[uint32]*pendingMessage //key = sequence number
+	retransmitChannel chan uint32
+}
+
+func newReliableSender() *reliableSender {
+	return &reliableSender{
+		mutex:             &sync.Mutex{},
+		pending:           make(map[uint32]*pendingMessage),
+		retransmitChannel: make(chan uint32, 64),
+	}
+}
+
+//add starts tracking message, which is about to be sent with seq. It returns false if
+//there is nobody to send it to, the message is reported as delivered right away then.
+func (r *reliableSender) add(seq uint32, message ReliableMessage) bool {
+	if len(message.To) == 0 {
+		report(message, nil, nil)
+		return false
+	}
+	p := &pendingMessage{message: message, missing: make(map[string]bool), timeout: retransmitTimeout}
+	for _, ID := range message.To {
+		p.missing[ID] = true
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending[seq] = p
+	r.arm(seq, p)
+	return true
+}
+
+//acked records that nodeID has received seq
+func (r *reliableSender) acked(nodeID string, seq uint32) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.pending[seq]
+	if !ok || !p.missing[nodeID] {
+		return
+	}
+	delete(p.missing, nodeID)
+	p.delivered = append(p.delivered, nodeID)
+	if len(p.missing) == 0 {
+		p.timer.Stop()
+		delete(r.pending, seq)
+		report(p.message, p.delivered, nil)
+	}
+}
+
+//retransmit returns the message to send again for seq. ok is false if it has been acked
+//in the meantime, or if the sender has given up on it.
+func (r *reliableSender) retransmit(seq uint32) (msg interface{}, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.pending[seq]
+	if !ok {
+		return nil, false
+	}
+	missing := []string{}
+	for ID := range p.missing {
+		missing = append(missing, ID)
+	}
+	sort.Strings(missing)
+	if p.retransmissions == maxRetransmissions {
+		delete(r.pending, seq)
+		log.Println("NETWORK:\t Giving up on reliable message", seq, "after", maxRetransmissions, "retransmissions. Missing acks from", missing)
+		report(p.message, p.delivered, missing)
+		return nil, false
+	}
+	p.retransmissions++
+	p.timeout *= 2
+	if p.timeout > maxRetransmitTimeout {
+		p.timeout = maxRetransmitTimeout
+	}
+	r.arm(seq, p)
+	printDebug("Retransmitting reliable message " + strconv.Itoa(int(seq)) + ", missing acks from " + strconv.Itoa(len(missing)))
+	return p.message.Msg, true
+}
+
+func (r *reliableSender) arm(seq uint32, p *pendingMessage) {
+	p.timer = time.AfterFunc(p.timeout, func() {
+		r.retransmitChannel <- seq
+	})
+}
+
+//report calls the Done callback of message on its own goroutine, so a slow callback never holds up the network
+func report(message ReliableMessage, delivered, missing []string) {
+	if message.Done == nil {
+		return
+	}
+	go message.Done(DeliveryReport{Msg: message.Msg, Delivered: delivered, Missing: missing})
+}
+
+//dedup remembers the reliable packets that have been received, so retransmissions are handed on only once
+type dedup struct {
+	seen      map[string]map[uint32]time.Time //key = node ID, sequence number
+	lastPrune time.Time
+}
+
+func newDedup() *dedup {
+	return &dedup{seen: make(map[string]map[uint32]time.Time), lastPrune: time.Now()}
+}
+
+//duplicate returns true if seq from nodeID has been received before
+func (d *dedup) duplicate(nodeID string, seq uint32) bool {
+	now := time.Now()
+	if now.Sub(d.lastPrune) > dedupMemory {
+		for ID, sequences := range d.seen {
+			for s, received := range sequences {
+				if now.Sub(received) > dedupMemory {
+					delete(sequences, s)
+				}
+			}
+			if len(sequences) == 0 {
+				delete(d.seen, ID)
+			}
+		}
+		d.lastPrune = now
+	}
+	if _, ok := d.seen[nodeID][seq]; ok {
+		return true
+	}
+	if d.seen[nodeID] == nil {
+		d.seen[nodeID] = make(map[uint32]time.Time)
+	}
+	d.seen[nodeID][seq] = now
+	return false
+}
+
+//transmitter encodes, signs and sends packets for both message handlers
+type transmitter struct {
+	localID        string
+	auth           *authenticator
+	UDPSendChannel chan<- udp.UDPMessage
+}
+
+func (t transmitter) send(header protocol.Envelope, msg interface{}) {
+	header.NodeID = t.localID
+	networkPack, err := protocol.Marshal(header, msg)
+	if err != nil {
+		printDebug("Error Marshalling an outgoing message")
+		log.Println(err)
+		return
+	}
+	t.UDPSendChannel <- udp.UDPMessage{Raddr: "broadcast", Data: t.auth.sign(networkPack)}
+}
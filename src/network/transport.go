@@ -0,0 +1,57 @@
+package network
+
+import (
+	"../udp"
+)
+
+//Transport moves raw packets between the nodes. A message to Raddr "broadcast" must reach
+//every node, the sender included, since the order protocol acks its own messages.
+type Transport interface {
+	Start(messageSize int, sendChannel <-chan udp.UDPMessage, receiveChannel chan<- udp.UDPMessage) (localIP string, err error)
+}
+
+//UDPTransport is the lab network: broadcast on 255.255.255.255, one node per host
+type UDPTransport struct {
+	LocalListenPort     int
+	BroadcastListenPort int
+}
+
+func DefaultUDPTransport() UDPTransport {
+	return UDPTransport{LocalListenPort: 22301, BroadcastListenPort: 22302}
+}
+
+func (t UDPTransport) Start(messageSize int, sendChannel <-chan udp.UDPMessage, receiveChannel chan<- udp.UDPMessage) (string, error) {
+	return udp.Init(t.LocalListenPort, t.BroadcastListenPort, messageSize, sendChannel, receiveChannel)
+}
+
+//LoopbackTransport runs several nodes on one host, each on its own localhost port.
+//PeerPorts lists the ports of every node in the cluster.
+type LoopbackTransport struct {
+	LocalListenPort int
+	PeerPorts       []int
+}
+
+func (t LoopbackTransport) Start(messageSize int, sendChannel <-chan udp.UDPMessage, receiveChannel chan<- udp.UDPMessage) (string, error) {
+	return udp.InitLoopback(t.LocalListenPort, t.PeerPorts, messageSize, sendChannel, receiveChannel)
+}
+
+//BusTransport attaches a node to an in-memory Bus under the address LocalIP
+type BusTransport struct {
+	Bus     *Bus
+	LocalIP string
+}
+
+func (t BusTransport) Start(messageSize int, sendChannel <-chan udp.UDPMessage, receiveChannel chan<- udp.UDPMessage) (string, error) {
+	inbox := t.Bus.Attach(t.LocalIP)
+	go func() {
+		for msg := range sendChannel {
+			t.Bus.Broadcast(t.LocalIP, msg.Data)
+		}
+	}()
+	go func() {
+		for msg := range inbox {
+			receiveChannel <- msg
+		}
+	}()
+	return t.LocalIP, nil
+}
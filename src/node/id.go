@@ -0,0 +1,48 @@
+package node
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+//LoadOrCreateID returns the node ID stored in path. The first time a node starts
+//a random UUID is generated and stored, so the node keeps its identity across restarts
+//and address changes.
+func LoadOrCreateID(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if id == "" {
+			return "", errors.New("NODE:\t The ID file " + path + " is empty")
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	log.Println("NODE:\t Generated the new node ID", id, "in", path)
+	return id, nil
+}
+
+//newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
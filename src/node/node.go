@@ -0,0 +1,604 @@
+package node
+
+import (
+	"../cost"
+	"../elev"
+	"../faults"
+	"../fsm"
+	"../journal"
+	"../membership"
+	"../ordermanager"
+	"../protocol"
+	. "../typedef"
+	"errors"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const debug = false
+
+//DefaultObstructionTimeout is shorter than the OrderTimeout, so the orders are handed off before they time out
+const DefaultObstructionTimeout = 4 * time.Second
+
+type Config struct {
+	ID                     string //identifies the node to its peers, must be stable across restarts
+	NumFloors              int
+	DoorWaitTime           time.Duration
+	ObstructionTimeout     time.Duration //how long the doors can be obstructed before the external orders are handed off, 0 for never
+	StopResetTime          time.Duration //how long until an emergency stop is reset by itself, 0 to wait for the stop button
+	PollDelay              time.Duration
+	Debounce               time.Duration //how long a button or switch must be read pressed or released before it is believed
+	OrderTimeout           time.Duration
+	JournalPath            string //where the orders are kept across restarts, "" to not keep them
+	Faults                 faults.Config
+	Membership             membership.Config
+	Cost                   cost.CostFunction
+	Global                 *cost.GlobalAssigner //moves the hall orders when there is a better assignment, nil to leave them
+	CyclicOrders           bool                 //distribute the external orders with ordermanager.Cyclic instead of the handshake
+	DestinationDispatch    bool                 //the hall panels take destinations, see RequestDestination
+	OrderBroadcastInterval time.Duration        //how often the whole order matrix is broadcast in the cyclic mode
+}
+
+//DefaultConfig returns the timing used in the lab. OrderTimeout is randomised so the
+//elevators do not time out on the same order at the same time.
+func DefaultConfig(id string, numFloors int) Config {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return Config{
+		ID:                     id,
+		NumFloors:              numFloors,
+		DoorWaitTime:           3000 * time.Millisecond,
+		ObstructionTimeout:     DefaultObstructionTimeout,
+		PollDelay:              50 * time.Millisecond,
+		Debounce:               20 * time.Millisecond,
+		OrderTimeout:           5*time.Second + time.Duration(r.Intn(2000))*time.Millisecond,
+		OrderBroadcastInterval: 100 * time.Millisecond,
+		Faults: faults.Config{
+			SelfTestInterval: 3 * time.Second,
+			SelfTestTimeout:  10 * time.Second,
+			RejoinAfter:      10 * time.Second,
+		},
+		Membership: membership.DefaultConfig(),
+		Cost:       cost.Heuristic{},
+	}
+}
+
+//NetworkInit starts the network layer on the given channels and returns the local network address
+type NetworkInit func(localID string, numFloors int,
+	receiveOrderChannel chan<- ElevOrderMessage,
+	sendOrderChannel <-chan ElevOrderMessage,
+	receiveRestoreChannel chan<- ElevRestoreMessage,
+	sendRestoreChannel <-chan ElevRestoreMessage,
+	sendReliableChannel <-chan ReliableMessage,
+	versionChannel chan<- uint8) (localAddr string, err error)
+
+//Node is one complete elevator: hardware, network, order manager and FSM wired together
+type Node struct {
+	config                Config
+	localID               string
+	knownElevators        map[string]*Elevator //key = node ID
+	activeElevators       map[string]bool      //key = node ID
+	manager               ordermanager.Protocol
+	journal               *journal.Journal
+	elevator              *fsm.FSM
+	faults                *faults.Handler
+	membership            *membership.Service
+	buttonChannel         chan elev.ElevButton
+	lightChannel          chan elev.Lamps
+	motorChannel          chan int
+	floorChannel          chan elev.FloorEvent
+	obstructionChannel    chan bool
+	motorFaultChannel     chan elev.MotorFault
+	destinationChannel    chan ordermanager.DestinationRequested
+	receiveOrderChannel   chan ElevOrderMessage
+	sendOrderChannel      chan ElevOrderMessage
+	receiveRestoreChannel chan ElevRestoreMessage
+	sendRestoreChannel    chan ElevRestoreMessage
+	sendReliableChannel   chan ReliableMessage
+	versionChannel        chan uint8
+	deliveryChannel       chan DeliveryReport
+	orderTimers           map[ordermanager.TimerID]*time.Timer
+	timeoutChannel        chan ordermanager.TimerExpired
+	quit                  chan bool
+	done                  chan bool
+}
+
+//Start initialises the hardware and the network, restores the previous state and runs the node until Stop is called
+func Start(config Config, io elev.IODriver, initNetwork NetworkInit) (*Node, error) {
+	if config.ID == "" {
+		return nil, errors.New("NODE:\t A node needs an ID")
+	}
+	if config.DestinationDispatch && config.NumFloors > MaxFloorSet {
+		return nil, errors.New("NODE:\t Destination dispatch takes at most " + strconv.Itoa(MaxFloorSet) + " floors")
+	}
+	localID := config.ID
+	n := &Node{
+		config:                config,
+		localID:               localID,
+		knownElevators:        make(map[string]*Elevator),
+		activeElevators:       make(map[string]bool),
+		buttonChannel:         make(chan elev.ElevButton, 10),
+		lightChannel:          make(chan elev.Lamps),
+		motorChannel:          make(chan int),
+		floorChannel:          make(chan elev.FloorEvent),
+		obstructionChannel:    make(chan bool),
+		motorFaultChannel:     make(chan elev.MotorFault),
+		destinationChannel:    make(chan ordermanager.DestinationRequested),
+		receiveOrderChannel:   make(chan ElevOrderMessage, 5),
+		sendOrderChannel:      make(chan ElevOrderMessage),
+		receiveRestoreChannel: make(chan ElevRestoreMessage, 5),
+		sendRestoreChannel:    make(chan ElevRestoreMessage),
+		sendReliableChannel:   make(chan ReliableMessage),
+		versionChannel:        make(chan uint8, 1),
+		deliveryChannel:       make(chan DeliveryReport),
+		orderTimers:           make(map[ordermanager.TimerID]*time.Timer),
+		timeoutChannel:        make(chan ordermanager.TimerExpired),
+		quit:                  make(chan bool),
+		done:                  make(chan bool),
+	}
+
+	//-----Initialise hardware------
+	if err := elev.Init(io, config.NumFloors, n.buttonChannel, n.lightChannel, n.motorChannel, n.floorChannel, n.obstructionChannel, n.motorFaultChannel, config.PollDelay, config.Debounce); err != nil {
+		log.Println("NODE:\t Hardware init failed!")
+		return nil, err
+	}
+	printDebug("Hardware init successful!")
+
+	//-----Initialise network------
+	localAddr, err := initNetwork(localID, config.NumFloors, n.receiveOrderChannel, n.sendOrderChannel, n.receiveRestoreChannel, n.sendRestoreChannel, n.sendReliableChannel, n.versionChannel)
+	if err != nil {
+		log.Println("NODE:\t Network init failed")
+		return nil, err
+	}
+	log.Println("NODE:\t Node", localID, "is on the network at", localAddr)
+
+	//-----Initialise state------
+	log.Println("NODE:\t Sending out a request after my previus state")
+	n.sendRestoreChannel <- ElevRestoreMessage{
+		AskerID: localID,
+		State:   ElevState{},
+		Event:   EvRequestingState,
+	}
+	n.knownElevators[localID] = ResolveElevator(NewElevState(localID, 0, config.NumFloors))
+	n.membership = membership.Start(config.Membership, localID, n.knownElevators[localID].State.Copy(), n.sendRestoreChannel)
+	orderConfig := ordermanager.Config{
+		LocalID:      localID,
+		NumFloors:    config.NumFloors,
+		OrderTimeout: config.OrderTimeout,
+		Cost:         config.Cost,
+		Global:       config.Global,
+	}
+	if config.CyclicOrders {
+		log.Println("NODE:\t Distributing the external orders with the cyclic counters")
+		n.manager = ordermanager.NewCyclic(orderConfig, n.knownElevators, n.activeElevators)
+	} else {
+		n.manager = ordermanager.New(orderConfig, n.knownElevators, n.activeElevators)
+	}
+	n.elevator = fsm.New(n.knownElevators[localID], n.manager, fsm.SystemClock{}, fsm.Config{
+		DoorOpenTime:       config.DoorWaitTime,
+		ObstructionTimeout: config.ObstructionTimeout,
+		StopResetTime:      config.StopResetTime,
+	})
+	n.faults = faults.New(config.Faults, fsm.SystemClock{})
+	if config.JournalPath != "" {
+		n.journal = journal.Open(config.JournalPath)
+		n.replayJournal()
+	}
+	initialFloor := <-n.floorChannel
+	n.handleElevatorEvent(fsm.FloorReached{Floor: initialFloor.Floor, Time: initialFloor.Time})
+	log.Println("NODE:\t State init finished. Starting from floor:", n.knownElevators[localID].State.LastFloor)
+
+	go n.run()
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.localID
+}
+
+//RequestDestination is a passenger at floor asking for destination at the hall panel,
+//in destination dispatch. The elevator that picks the passenger up goes to destination.
+func (n *Node) RequestDestination(floor, destination int) error {
+	if !n.config.DestinationDispatch {
+		return errors.New("NODE:\t Destination dispatch is off")
+	}
+	if floor < 0 || floor >= n.config.NumFloors || destination < 0 || destination >= n.config.NumFloors {
+		return errors.New("NODE:\t There is no floor " + strconv.Itoa(floor) + " or " + strconv.Itoa(destination))
+	}
+	if floor == destination {
+		return errors.New("NODE:\t The passenger is already on floor " + strconv.Itoa(floor))
+	}
+	select {
+	case n.destinationChannel <- ordermanager.DestinationRequested{Floor: floor, Destination: destination}:
+		return nil
+	case <-n.done:
+		return errors.New("NODE:\t The node has stopped")
+	}
+}
+
+//Stop halts the motor and stops the event loop. The node is dead to the others from then on.
+func (n *Node) Stop() {
+	close(n.quit)
+	<-n.done
+}
+
+func (n *Node) run() {
+	fsmTick := time.NewTicker(n.config.PollDelay)
+	defer fsmTick.Stop()
+	orderTick := time.NewTicker(n.config.OrderBroadcastInterval)
+	defer orderTick.Stop()
+	log.Println("NODE:\t Starting event loop")
+	for {
+		select {
+		//------------------------------------NETWORK------------------------------------------------
+		case msg := <-n.receiveRestoreChannel:
+			n.handleRestoreMessage(msg)
+
+		case msg := <-n.receiveOrderChannel:
+			n.handleOrderEvent(ordermanager.OrderMessageReceived{Msg: msg})
+
+		case expired := <-n.timeoutChannel:
+			n.handleOrderEvent(expired)
+
+		case version := <-n.versionChannel:
+			n.handleOrderEvent(ordermanager.ProtocolNegotiated{Acks: version < protocol.VersionReliable})
+
+		case event := <-n.membership.Events():
+			n.handleMembershipEvent(event)
+
+		case report := <-n.deliveryChannel:
+			if msg, ok := report.Msg.(ElevOrderMessage); ok {
+				n.handleOrderEvent(ordermanager.DeliveryReported{Msg: msg, Delivered: report.Delivered, Missing: report.Missing})
+			}
+
+		//-------HARDWARE-------
+		case button := <-n.buttonChannel:
+			log.Println("NODE:\t Received a", ButtonType[button.Type], "from floor", button.Floor, ".Number of activeElevators", len(n.activeElevators))
+			switch button.Type {
+			case BUTTON_CALL_UP, BUTTON_CALL_DOWN:
+				n.handleOrderEvent(ordermanager.HallButtonPressed{Floor: button.Floor, Type: button.Type})
+			case BUTTON_COMMAND:
+				n.handleElevatorEvent(fsm.CabButtonPressed{Floor: button.Floor})
+			case BUTTON_STOP:
+				log.Println("NODE:\t Somebody pressed the stop button!")
+				n.handleElevatorEvent(fsm.StopButtonPressed{})
+			default:
+				printDebug("Recived an ButtonType from the elev driver")
+			}
+
+		case request := <-n.destinationChannel:
+			log.Println("NODE:\t Received a destination request from floor", request.Floor, "to floor", request.Destination)
+			n.handleOrderEvent(request)
+
+		case event := <-n.floorChannel:
+			if event.Floor == -1 {
+				printDebug("evFloorLeft")
+				n.handleElevatorEvent(fsm.FloorLeft{Time: event.Time})
+			} else {
+				log.Println("NODE:\t evFloorReached: ", event.Floor)
+				n.handleElevatorEvent(fsm.FloorReached{Floor: event.Floor, Time: event.Time})
+			}
+
+		case active := <-n.obstructionChannel:
+			log.Println("NODE:\t Obstruction switch changed, active:", active)
+			n.handleElevatorEvent(fsm.ObstructionChanged{Active: active})
+
+		case fault := <-n.motorFaultChannel:
+			n.handleFaultEvent(faults.FaultReported{Type: faults.FaultMotor, Detail: fault.String()})
+
+		//-------TIMERS-------
+		case <-fsmTick.C:
+			n.handleElevatorEvent(fsm.Tick{})
+			n.handleFaultEvent(faults.Tick{})
+			n.updateLights()
+
+		case <-orderTick.C:
+			n.handleOrderEvent(ordermanager.Tick{})
+
+		case <-n.quit:
+			n.motorChannel <- STOP
+			n.membership.Stop()
+			for _, timer := range n.orderTimers {
+				timer.Stop()
+			}
+			close(n.done)
+			return
+		}
+	}
+}
+
+//------STATE RESTORE AND BACKUP-----------
+func (n *Node) handleRestoreMessage(msg ElevRestoreMessage) {
+	switch msg.Event {
+	case EvIAmAlive:
+		if _, ok := n.knownElevators[msg.ResponderID]; !ok {
+			printDebug("Recived EvIAmAlive from a new elevator with ID " + msg.ResponderID)
+			n.knownElevators[msg.ResponderID] = ResolveElevator(msg.State)
+		}
+		n.membership.HeartbeatReceived(msg.ResponderID)
+
+	case EvBackupState:
+		n.handleOrderEvent(ordermanager.BackupStateReceived{ResponderID: msg.ResponderID})
+		if msg.ResponderID != n.localID {
+			if msg.ResponderID == msg.State.ID {
+				if _, ok := n.knownElevators[msg.ResponderID]; ok {
+					n.knownElevators[msg.ResponderID].State = msg.State
+				} else {
+					printDebug("Recived EvBackupState from an unknown elevator with ID " + msg.ResponderID)
+					n.knownElevators[msg.ResponderID] = ResolveElevator(msg.State)
+				}
+			} else {
+				printDebug("Recived EvBackupState with an inconsisten ID. Rejecting...")
+			}
+		}
+
+	case EvRequestingState:
+		if msg.AskerID != n.localID {
+			log.Println("NODE:\t Received an ElevRestoreMessage from from:", msg.AskerID)
+			if _, ok := n.knownElevators[msg.AskerID]; ok {
+				log.Println("NODE:\t I have a stored state for this elevator. Returning the stored state.....")
+				n.sendReliableChannel <- ReliableMessage{
+					Msg: ElevRestoreMessage{
+						Event:               EvRestoredStateReturned,
+						AskerID:             msg.AskerID,
+						ResponderID:         n.localID,
+						State:               n.knownElevators[msg.AskerID].State.Copy(),
+						ExternalOrderMatrix: CopyExternalOrderMatrix(n.manager.ExternalOrderMatrix()),
+					},
+					To: []string{msg.AskerID},
+				}
+			} else {
+				log.Println("NODE:\t I do not have a stored state for this elevator.")
+			}
+		}
+
+	case EvReconcileState:
+		if msg.AskerID != n.localID {
+			printDebug("This EvReconcileState is NOT for me!")
+			return
+		}
+		log.Println("NODE:\t Reconciling the orders with", msg.ResponderID)
+		if msg.ResponderID == msg.State.ID {
+			n.knownElevators[msg.ResponderID] = ResolveElevator(msg.State)
+		}
+		n.handleOrderEvent(ordermanager.PeerStateReceived{ID: msg.ResponderID, ExternalOrderMatrix: msg.ExternalOrderMatrix})
+		n.handleElevatorEvent(fsm.OrdersChanged{})
+
+	case EvOrderState:
+		if msg.ResponderID == n.localID {
+			return
+		}
+		if _, ok := n.knownElevators[msg.ResponderID]; ok && msg.ResponderID == msg.State.ID {
+			n.knownElevators[msg.ResponderID] = ResolveElevator(msg.State)
+		}
+		n.handleOrderEvent(ordermanager.OrderStateReceived{ID: msg.ResponderID, ExternalOrderMatrix: msg.ExternalOrderMatrix})
+
+	case EvRestoredStateReturned:
+		if msg.AskerID == n.localID {
+			log.Println("NODE:\t This ElevRestoreMessage is for me!")
+			n.handleOrderEvent(ordermanager.RestoredStateReceived{ExternalOrderMatrix: msg.ExternalOrderMatrix})
+			if changes := n.knownElevators[n.localID].MergeStates(msg.State); changes {
+				n.saveJournal()
+			}
+			n.handleElevatorEvent(fsm.OrdersChanged{})
+		} else {
+			printDebug("This ElevRestoreMessage is NOT for me!")
+		}
+
+	default:
+		printDebug("Recived an invalid ElevRestoreMessage from " + msg.ResponderID)
+	}
+}
+
+//------JOURNAL-----------
+//replayJournal restores the orders from before the last restart. Anything restored from the
+//network later is merged on top, so an order is only lost if it is lost everywhere.
+func (n *Node) replayJournal() {
+	record, ok, err := n.journal.Load()
+	if err != nil {
+		log.Println("NODE:\t Could not replay the journal:", err)
+		return
+	}
+	if !ok || record.ID != n.localID {
+		log.Println("NODE:\t No journal to replay")
+		return
+	}
+	log.Println("NODE:\t Replaying the journal")
+	n.knownElevators[n.localID].MergeStates(ElevState{InternalOrders: record.InternalOrders})
+	n.handleOrderEvent(ordermanager.RestoredStateReceived{ExternalOrderMatrix: record.ExternalOrderMatrix})
+}
+
+func (n *Node) saveJournal() {
+	if n.journal == nil {
+		return
+	}
+	err := n.journal.Save(journal.Record{
+		ID:                  n.localID,
+		InternalOrders:      n.knownElevators[n.localID].State.Copy().InternalOrders,
+		ExternalOrderMatrix: CopyExternalOrderMatrix(n.manager.ExternalOrderMatrix()),
+	})
+	if err != nil {
+		log.Println("NODE:\t Could not save the journal:", err)
+	}
+}
+
+//updateLights works out every lamp from the orders and the FSM, and sends them all to the light
+//controller, which writes the ones that are wrong. A lamp that is wrong is put right on the next tick.
+func (n *Node) updateLights() {
+	lamps := elev.NewLamps(n.config.NumFloors)
+	hallLights := n.manager.HallLights()
+	for floor, internal := range n.knownElevators[n.localID].State.InternalOrders {
+		lamps.Buttons[floor] = [3]bool{hallLights[floor][BUTTON_CALL_UP], hallLights[floor][BUTTON_CALL_DOWN], internal}
+	}
+	lamps.Door = n.elevator.DoorsOpen()
+	lamps.Stop = n.elevator.EmergencyStopped()
+	n.lightChannel <- lamps
+}
+
+//handleOrderEvent and handleElevatorEvent pass an event to the order manager or the elevator FSM
+//and execute the resulting actions
+func (n *Node) handleOrderEvent(event ordermanager.Event) {
+	actions := n.manager.Handle(event)
+	n.saveJournal() //before anybody is told about the orders. An unchanged record is not written again.
+	for _, action := range actions {
+		switch a := action.(type) {
+		case ordermanager.SendMessage:
+			n.sendOrderChannel <- a.Msg
+		case ordermanager.SendReliable:
+			n.sendReliableChannel <- ReliableMessage{Msg: a.Msg, To: a.To, Done: n.reportDelivery}
+		case ordermanager.BroadcastOrders:
+			n.sendRestoreChannel <- ElevRestoreMessage{
+				Event:               EvOrderState,
+				ResponderID:         n.localID,
+				State:               n.knownElevators[n.localID].State.Copy(),
+				ExternalOrderMatrix: a.ExternalOrderMatrix,
+			}
+		case ordermanager.StartTimer:
+			if timer, ok := n.orderTimers[a.Timer]; ok {
+				timer.Stop()
+			}
+			n.orderTimers[a.Timer] = time.AfterFunc(a.Duration, func() {
+				select {
+				case n.timeoutChannel <- ordermanager.TimerExpired{Timer: a.Timer, Seq: a.Seq}:
+				case <-n.done:
+				}
+			})
+		case ordermanager.StopTimer:
+			if timer, ok := n.orderTimers[a.Timer]; ok {
+				timer.Stop()
+				delete(n.orderTimers, a.Timer)
+			}
+		case ordermanager.OrderAssigned:
+			n.handleElevatorEvent(fsm.OrderAssigned{Floor: a.Floor, Type: a.Type})
+		case ordermanager.PassengersPickedUp:
+			log.Println("NODE:\t Picked up passengers on floor", a.Floor, "going to", a.Destinations.Floors())
+			for _, destination := range a.Destinations.Floors() {
+				n.handleElevatorEvent(fsm.CabButtonPressed{Floor: destination})
+			}
+		case ordermanager.ExecutionTimedOut: //Something is blocking the elevator from finishing the order
+			n.handleFaultEvent(faults.FaultReported{
+				Type:   faults.FaultExecutionTimedOut,
+				Detail: ButtonType[a.Type] + " on floor " + strconv.Itoa(a.Floor),
+			})
+		case ordermanager.AssignmentFailed:
+			n.handleFaultEvent(faults.FaultReported{Type: faults.FaultAssignmentFailed, Detail: a.Err.Error()})
+		}
+	}
+}
+
+func (n *Node) handleElevatorEvent(event fsm.Event) {
+	for _, action := range n.elevator.Handle(event) {
+		switch a := action.(type) {
+		case fsm.SetMotor:
+			n.motorChannel <- a.Direction
+		case fsm.ServeExternalOrders:
+			n.handleOrderEvent(ordermanager.OrdersServed{Floor: a.Floor})
+		case fsm.BroadcastState:
+			n.saveJournal()
+			n.sendBackupState()
+		case fsm.Initialized:
+			n.handleFaultEvent(faults.SelfTestPassed{})
+		case fsm.OutOfService:
+			log.Println("NODE:\t Out of service, handing off the external orders")
+			n.updateDegraded()
+			n.handleOrderEvent(ordermanager.HandOffOrders{})
+		case fsm.BackInService:
+			n.updateDegraded()
+		}
+	}
+}
+
+func (n *Node) handleFaultEvent(event faults.Event) {
+	for _, action := range n.faults.Handle(event) {
+		switch action.(type) {
+		case faults.EnterDegraded:
+			n.updateDegraded()
+			n.handleElevatorEvent(fsm.Halt{})
+			n.handleOrderEvent(ordermanager.HandOffOrders{})
+		case faults.StartSelfTest:
+			n.handleElevatorEvent(fsm.SelfTest{})
+		case faults.AbortSelfTest:
+			n.handleElevatorEvent(fsm.Halt{})
+		case faults.Rejoin:
+			n.updateDegraded()
+		}
+	}
+}
+
+//updateDegraded tells the others whether they can assign external orders to this elevator.
+//They can not while it is degraded by a fault or out of service.
+func (n *Node) updateDegraded() {
+	n.knownElevators[n.localID].State.Degraded = n.faults.Degraded() || n.elevator.OutOfService()
+	n.sendBackupState()
+}
+
+//sendBackupState sends the state of this elevator reliably to the others
+func (n *Node) sendBackupState() {
+	n.membership.UpdateState(n.knownElevators[n.localID].State.Copy())
+	to := []string{}
+	for ID := range n.activeElevators {
+		to = append(to, ID)
+	}
+	n.sendReliableChannel <- ReliableMessage{
+		Msg: ResolveBackupState(n.knownElevators[n.localID], n.manager.ExternalOrderMatrix()),
+		To:  to,
+	}
+}
+
+//sendReconcileState sends the orders of this elevator to an elevator that has just joined, so it can
+//reconcile them with its own. It may have been in another partition and missed some of the messages.
+func (n *Node) sendReconcileState(ID string) {
+	n.sendReliableChannel <- ReliableMessage{
+		Msg: ElevRestoreMessage{
+			Event:               EvReconcileState,
+			AskerID:             ID,
+			ResponderID:         n.localID,
+			State:               n.knownElevators[n.localID].State.Copy(),
+			ExternalOrderMatrix: CopyExternalOrderMatrix(n.manager.ExternalOrderMatrix()),
+		},
+		To: []string{ID},
+	}
+}
+
+//reportDelivery is the Done callback of the reliable messages. It runs on a goroutine of the network.
+func (n *Node) reportDelivery(report DeliveryReport) {
+	select {
+	case n.deliveryChannel <- report:
+	case <-n.done:
+	}
+}
+
+//handleMembershipEvent keeps activeElevators up to date, reconciles the orders with the elevators
+//that join and lets the order manager take over the orders of the lost ones.
+//Only the members are expected to take part in the order protocol.
+func (n *Node) handleMembershipEvent(event membership.Event) {
+	switch e := event.(type) {
+	case membership.PeerJoined:
+		if _, ok := n.knownElevators[e.ID]; !ok {
+			printDebug("The new member " + e.ID + " has not been heard from")
+			return
+		}
+		if !n.activeElevators[e.ID] {
+			n.activeElevators[e.ID] = true
+			log.Printf("NODE:\t Added elevator %s in activeElevators\n", e.ID)
+			if e.ID != n.localID {
+				n.sendReconcileState(e.ID)
+			}
+		}
+	case membership.PeerSuspected:
+		log.Println("NODE:\t Elevator", e.ID, "is late with its heartbeats")
+	case membership.PeerLost:
+		if n.activeElevators[e.ID] {
+			delete(n.activeElevators, e.ID)
+			log.Printf("NODE:\t Removed elevator %s in activeElevators\n", e.ID)
+			n.handleOrderEvent(ordermanager.PeerLost{ID: e.ID})
+		}
+	}
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("NODE:\t", s)
+	}
+}
@@ -0,0 +1,408 @@
+package ordermanager
+
+import (
+	"../cost"
+	. "../typedef"
+	"log"
+	"strconv"
+	"time"
+)
+
+//States of a cell in the cyclic mode. They share their values with the statuses of the handshake,
+//so the FSM and the cost function read the matrix the same way in both modes.
+//Every cell goes round the cycle NoOrder -> Unconfirmed -> Confirmed -> NoOrder. An elevator takes
+//the state of another one when it is one step ahead, and ignores it otherwise. Unknown is the
+//state of a cell nothing has been heard about yet. It is left for any other state.
+const (
+	Unknown     = -1
+	NoOrder     = NotActive
+	Unconfirmed = Awaiting
+	Confirmed   = UnderExecution
+)
+
+var CyclicState = map[int]string{
+	Unknown:     "Unknown",
+	NoOrder:     "NoOrder",
+	Unconfirmed: "Unconfirmed",
+	Confirmed:   "Confirmed",
+}
+
+//Cyclic distributes the external orders with a cyclic counter per cell, a CRDT. Every elevator
+//broadcasts its whole matrix every Tick and merges the ones it receives. An Unconfirmed order
+//is Confirmed, and lit, once every active elevator has seen it (ConfirmedBy). Then every elevator
+//assigns it with the cost function, and they settle on the same owner when they merge.
+//An order that is moved to another elevator later gets a newer Created stamp, which wins the merge.
+//Like Manager it is a pure state machine.
+type Cyclic struct {
+	localID         string
+	orderTimeout    time.Duration
+	costFunction    cost.CostFunction
+	global          *cost.GlobalAssigner
+	matrix          [][2]ElevOrder
+	timers          [][2]orderTimer
+	knownElevators  map[string]*Elevator
+	activeElevators map[string]bool
+}
+
+func NewCyclic(config Config, knownElevators map[string]*Elevator, activeElevators map[string]bool) *Cyclic {
+	c := &Cyclic{
+		localID:         config.LocalID,
+		orderTimeout:    config.OrderTimeout,
+		costFunction:    config.Cost,
+		global:          config.Global,
+		matrix:          NewExternalOrderMatrix(config.NumFloors),
+		timers:          make([][2]orderTimer, config.NumFloors),
+		knownElevators:  knownElevators,
+		activeElevators: activeElevators,
+	}
+	for floor := range c.matrix {
+		for button := range c.matrix[floor] {
+			c.matrix[floor][button].Status = Unknown
+		}
+	}
+	return c
+}
+
+//ExternalOrderMatrix returns the matrix. It must not be modified by the caller.
+func (c *Cyclic) ExternalOrderMatrix() [][2]ElevOrder {
+	return c.matrix
+}
+
+//HallLights lights the Confirmed orders
+func (c *Cyclic) HallLights() [][2]bool {
+	lights := make([][2]bool, len(c.matrix))
+	for floor := range c.matrix {
+		for button := BUTTON_CALL_UP; button <= BUTTON_CALL_DOWN; button++ {
+			lights[floor][button] = c.matrix[floor][button].Status == Confirmed
+		}
+	}
+	return lights
+}
+
+func (c *Cyclic) Handle(event Event) []Action {
+	switch e := event.(type) {
+	case HallButtonPressed:
+		return c.handleHallButton(e.Floor, e.Type)
+	case DestinationRequested:
+		return c.handleDestination(e.Floor, e.Destination)
+	case OrderStateReceived:
+		return c.handleOrderState(e.ExternalOrderMatrix)
+	case Tick:
+		return c.handleTick()
+	case OrdersServed:
+		return c.handleOrdersServed(e.Floor)
+	case TimerExpired:
+		return c.handleTimerExpired(e.Timer, e.Seq)
+	case RestoredStateReceived:
+		return c.handleRestoredState(e.ExternalOrderMatrix)
+	case BackupStateReceived:
+		return append(c.handleBackupState(e.ResponderID), c.rebalance()...)
+	case PeerLost, HandOffOrders:
+		return c.reassign()
+	case OrderMessageReceived, DeliveryReported, PeerStateReceived, ProtocolNegotiated:
+		return nil //the whole state is broadcast all the time, there is no handshake and nothing to reconcile
+	}
+	log.Printf("ORDERMANAGER:\t Can not handle event of type %T\n", event)
+	return nil
+}
+
+//------------EVENT HANDLERS-------
+func (c *Cyclic) handleHallButton(floor, button int) []Action {
+	if !c.activeElevators[c.localID] {
+		log.Println("ORDERMANAGER:\t Can not accept new external order while offline!")
+		return nil
+	}
+	order := &c.matrix[floor][button]
+	if order.Status != NoOrder && order.Status != Unknown {
+		printDebug("The order is already " + CyclicState[order.Status])
+		return nil
+	}
+	actions := c.set(floor, button, Unconfirmed, "")
+	c.ack(floor, button, nil)
+	return append(actions, c.confirmIfSeen(floor, button)...)
+}
+
+//handleDestination adds the destination to the hall order in its direction, and places the order if
+//there is none. The destinations of an order are merged like ConfirmedBy, so they reach the elevator
+//it is assigned to unless it has picked the passengers up already.
+func (c *Cyclic) handleDestination(floor, destination int) []Action {
+	if !c.activeElevators[c.localID] {
+		log.Println("ORDERMANAGER:\t Can not accept new external order while offline!")
+		return nil
+	}
+	button := DestinationButton(floor, destination)
+	actions := []Action{}
+	if order := c.matrix[floor][button]; order.Status == NoOrder || order.Status == Unknown {
+		actions = c.set(floor, button, Unconfirmed, "")
+		c.ack(floor, button, nil)
+	}
+	c.matrix[floor][button].Destinations = c.matrix[floor][button].Destinations.With(destination)
+	return append(actions, c.confirmIfSeen(floor, button)...)
+}
+
+func (c *Cyclic) handleOrderState(matrix [][2]ElevOrder) []Action {
+	actions := []Action{}
+	confirmed := false
+	for floor := range matrix {
+		if floor >= len(c.matrix) {
+			break
+		}
+		for button, remote := range matrix[floor] {
+			local := c.matrix[floor][button]
+			switch {
+			case remote.Status == Unknown:
+			case local.Status == Unknown || remote.Status == next(local.Status):
+				actions = append(actions, c.set(floor, button, remote.Status, remote.AssignedTo)...)
+				c.matrix[floor][button].Created = remote.Created
+				confirmed = confirmed || remote.Status == Confirmed
+				if remote.Status == Unconfirmed {
+					c.ack(floor, button, remote.ConfirmedBy)
+				}
+			case remote.Status == Unconfirmed && local.Status == Unconfirmed:
+				c.ack(floor, button, remote.ConfirmedBy)
+			case remote.Status == Confirmed && local.Status == Confirmed && remote.Created != local.Created:
+				if local.Created.Before(remote.Created) {
+					actions = append(actions, c.set(floor, button, Confirmed, remote.AssignedTo)...)
+					c.matrix[floor][button].Created = remote.Created
+				}
+			case remote.Status == Confirmed && local.Status == Confirmed && c.prefer(remote.AssignedTo, local.AssignedTo):
+				actions = append(actions, c.set(floor, button, Confirmed, remote.AssignedTo)...)
+			}
+			if order := &c.matrix[floor][button]; order.Status == remote.Status && order.Status != NoOrder {
+				order.Destinations |= remote.Destinations
+			}
+			actions = append(actions, c.confirmIfSeen(floor, button)...)
+		}
+	}
+	if confirmed {
+		actions = append(actions, c.rebalance()...)
+	}
+	return actions
+}
+
+//handleTick confirms the orders the elevators that have been lost were holding up, reassigns the
+//orders of lost and degraded elevators and broadcasts the matrix
+func (c *Cyclic) handleTick() []Action {
+	actions := []Action{}
+	for floor := range c.matrix {
+		for button := range c.matrix[floor] {
+			actions = append(actions, c.confirmIfSeen(floor, button)...)
+		}
+	}
+	actions = append(actions, c.reassign()...)
+	return append(actions, BroadcastOrders{c.copyMatrix()})
+}
+
+func (c *Cyclic) handleOrdersServed(floor int) []Action {
+	actions := []Action{}
+	for _, button := range []int{BUTTON_CALL_UP, BUTTON_CALL_DOWN} {
+		if order := c.matrix[floor][button]; order.Status == Confirmed && order.AssignedTo == c.localID {
+			if order.Destinations != 0 {
+				actions = append(actions, PassengersPickedUp{Floor: floor, Destinations: order.Destinations})
+			}
+			actions = append(actions, c.set(floor, button, NoOrder, "")...)
+		}
+	}
+	return actions
+}
+
+//handleBackupState refreshes the execution timers while the local elevator is still working
+func (c *Cyclic) handleBackupState(responderID string) []Action {
+	actions := []Action{}
+	if responderID != c.localID {
+		return actions
+	}
+	for floor := range c.matrix {
+		for button := range c.matrix[floor] {
+			if order := c.matrix[floor][button]; order.Status == Confirmed && order.AssignedTo == c.localID && c.timers[floor][button].Running {
+				actions = append(actions, c.startTimer(floor, button))
+			}
+		}
+	}
+	return actions
+}
+
+func (c *Cyclic) handleTimerExpired(id TimerID, seq int) []Action {
+	timer := &c.timers[id.Floor][id.Type]
+	if !timer.Running || timer.Seq != seq {
+		printDebug("Ignoring a stale timer")
+		return nil
+	}
+	timer.Running = false
+	if order := c.matrix[id.Floor][id.Type]; order.Status == Confirmed && order.AssignedTo == c.localID {
+		log.Println("ORDERMANAGER:\t", TimerKind[timer.Kind], "timed out on order", ButtonType[id.Type], "on floor", id.Floor)
+		return []Action{ExecutionTimedOut{Floor: id.Floor, Type: id.Type}}
+	}
+	return nil
+}
+
+//handleRestoredState takes the orders under execution in cells nothing is known about. In the
+//others the broadcasts are newer than what is restored.
+func (c *Cyclic) handleRestoredState(matrix [][2]ElevOrder) []Action {
+	actions := []Action{}
+	for floor := range matrix {
+		if floor >= len(c.matrix) {
+			break
+		}
+		for button, order := range matrix[floor] {
+			if order.Status == UnderExecution && c.matrix[floor][button].Status == Unknown {
+				actions = append(actions, c.set(floor, button, Confirmed, order.AssignedTo)...)
+				c.matrix[floor][button].Destinations = order.Destinations
+			}
+		}
+	}
+	return actions
+}
+
+//------------SUPPORT FUNCTIONS-------
+func next(state int) int {
+	return (state + 1) % 3
+}
+
+//set moves a cell to state and assignedTo, and turns the execution timer and the FSM on
+//or off to match. The destinations go when the order does.
+func (c *Cyclic) set(floor, button, state int, assignedTo string) []Action {
+	order := &c.matrix[floor][button]
+	wasMine := order.Status == Confirmed && order.AssignedTo == c.localID
+	if order.Status != state {
+		printDebug("Order " + ButtonType[button] + " on floor " + strconv.Itoa(floor) + " is " + CyclicState[state])
+		order.DeleteConfirmedBy()
+		order.Created = Stamp{}
+	}
+	if state == NoOrder {
+		order.Destinations = 0
+	}
+	order.Status = state
+	order.AssignedTo = assignedTo
+	mine := state == Confirmed && assignedTo == c.localID
+	actions := []Action{}
+	if mine && !wasMine {
+		actions = append(actions, c.startTimer(floor, button), OrderAssigned{Floor: floor, Type: button})
+	} else if !mine && wasMine {
+		c.timers[floor][button].Running = false
+		actions = append(actions, StopTimer{TimerID{floor, button}})
+	}
+	return actions
+}
+
+//ack records that the local elevator, and the ones in seenBy, have seen the Unconfirmed order
+func (c *Cyclic) ack(floor, button int, seenBy map[string]bool) {
+	order := &c.matrix[floor][button]
+	if order.ConfirmedBy == nil {
+		order.ConfirmedBy = make(map[string]bool)
+	}
+	for ID, seen := range seenBy {
+		if seen {
+			order.ConfirmedBy[ID] = true
+		}
+	}
+	order.ConfirmedBy[c.localID] = true
+}
+
+//confirmIfSeen confirms an Unconfirmed order once every active elevator has seen it, and assigns it
+func (c *Cyclic) confirmIfSeen(floor, button int) []Action {
+	order := c.matrix[floor][button]
+	if order.Status != Unconfirmed || !c.activeElevators[c.localID] {
+		return nil
+	}
+	for ID := range c.activeElevators {
+		if !order.ConfirmedBy[ID] {
+			return nil
+		}
+	}
+	assignedID, err := cost.AssignNewOrder(c.costFunction, c.knownElevators, c.activeElevators, c.matrix, floor, button)
+	actions := c.set(floor, button, Confirmed, assignedID)
+	if err != nil {
+		return append(actions, AssignmentFailed{err})
+	}
+	return append(actions, c.rebalance()...)
+}
+
+//reassign gives the confirmed orders of elevators that are lost or degraded to somebody else
+func (c *Cyclic) reassign() []Action {
+	actions := []Action{}
+	for floor := range c.matrix {
+		for button := range c.matrix[floor] {
+			order := c.matrix[floor][button]
+			if order.Status != Confirmed || c.valid(order.AssignedTo) {
+				continue
+			}
+			assignedID, err := cost.AssignNewOrder(c.costFunction, c.knownElevators, c.activeElevators, c.matrix, floor, button)
+			if err != nil {
+				continue
+			}
+			log.Println("ORDERMANAGER:\t Reassigning order", ButtonType[button], "on floor", floor, "from", order.AssignedTo, "to", assignedID)
+			actions = append(actions, c.move(floor, button, assignedID)...)
+		}
+	}
+	return actions
+}
+
+//rebalance moves the orders to the elevators the global assignment gives them to. Only the
+//coordinator does it, the others learn about it from its broadcasts.
+func (c *Cyclic) rebalance() []Action {
+	if c.global == nil || c.coordinator() != c.localID {
+		return nil
+	}
+	actions := []Action{}
+	for _, move := range c.global.Reassign(c.knownElevators, c.activeElevators, c.matrix) {
+		log.Println("ORDERMANAGER:\t Moving order", ButtonType[move.Type], "on floor", move.Floor, "from", move.From, "to", move.To)
+		actions = append(actions, c.move(move.Floor, move.Type, move.To)...)
+	}
+	return actions
+}
+
+//move gives a confirmed order to assignedTo, with a newer stamp than the assignment it replaces
+func (c *Cyclic) move(floor, button int, assignedTo string) []Action {
+	created := Stamp{Time: c.matrix[floor][button].Created.Time + 1, Node: c.localID}
+	actions := c.set(floor, button, Confirmed, assignedTo)
+	c.matrix[floor][button].Created = created
+	return actions
+}
+
+//coordinator returns the active elevator with the lowest ID, or "" if the local elevator is not active
+func (c *Cyclic) coordinator() string {
+	if !c.activeElevators[c.localID] {
+		return ""
+	}
+	coordinator := c.localID
+	for ID := range c.activeElevators {
+		if ID < coordinator {
+			coordinator = ID
+		}
+	}
+	return coordinator
+}
+
+//valid is true for the elevators that can take orders
+func (c *Cyclic) valid(ID string) bool {
+	elevator, ok := c.knownElevators[ID]
+	return ok && c.activeElevators[ID] && !elevator.State.Degraded
+}
+
+//prefer decides between two owners of the same order, the same way on every elevator
+func (c *Cyclic) prefer(ID, over string) bool {
+	return ID != over && c.valid(ID) && (!c.valid(over) || ID < over)
+}
+
+func (c *Cyclic) startTimer(floor, button int) Action {
+	timer := &c.timers[floor][button]
+	timer.Kind = TimerExecution
+	timer.Seq++
+	timer.Running = true
+	return StartTimer{Timer: TimerID{floor, button}, Seq: timer.Seq, Duration: c.orderTimeout}
+}
+
+//copyMatrix copies the matrix with ConfirmedBy, which CopyExternalOrderMatrix leaves out
+func (c *Cyclic) copyMatrix() [][2]ElevOrder {
+	matrix := CopyExternalOrderMatrix(c.matrix)
+	for floor := range matrix {
+		for button := range matrix[floor] {
+			matrix[floor][button].ConfirmedBy = make(map[string]bool)
+			for ID, seen := range c.matrix[floor][button].ConfirmedBy {
+				matrix[floor][button].ConfirmedBy[ID] = seen
+			}
+		}
+	}
+	return matrix
+}
@@ -0,0 +1,958 @@
+package ordermanager
+
+import (
+	"../cost"
+	. "../typedef"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const debug = false
+
+//Timer kinds. Every order in the externalOrderMatrix has at most one running timer.
+//Getting the messages through is left to the network, see SendReliable.
+const (
+	TimerExecution = iota
+)
+
+var TimerKind = []string{
+	"TimerExecution",
+}
+
+type TimerID struct {
+	Floor int
+	Type  int
+}
+
+//------------EVENTS-------
+type Event interface{}
+
+type OrderMessageReceived struct {
+	Msg ElevOrderMessage
+}
+
+type HallButtonPressed struct {
+	Floor int
+	Type  int
+}
+
+//DestinationRequested is a passenger at Floor asking for Destination at the hall panel, in destination
+//dispatch. The passenger waits for the hall order in the direction of the destination, and the elevator
+//assigned to it is given the destination when it picks the passenger up.
+type DestinationRequested struct {
+	Floor       int
+	Destination int
+}
+
+//TimerExpired must carry the Seq of the StartTimer action that started the timer.
+//Expired timers that have been stopped or restarted since are ignored.
+type TimerExpired struct {
+	Timer TimerID
+	Seq   int
+}
+
+//OrdersServed tells the manager that the local elevator has stopped at Floor
+//and served the external orders assigned to it there.
+type OrdersServed struct {
+	Floor int
+}
+
+type BackupStateReceived struct {
+	ResponderID string
+}
+
+//RestoredStateReceived carries a matrix restored from a peer or from the local journal.
+//Orders under execution are adopted, also the ones assigned to this elevator before it restarted.
+type RestoredStateReceived struct {
+	ExternalOrderMatrix [][2]ElevOrder
+}
+
+//DeliveryReported carries the outcome of a SendReliable
+type DeliveryReported struct {
+	Msg       ElevOrderMessage
+	Delivered []string
+	Missing   []string
+}
+
+//PeerStateReceived carries the matrix of an elevator that has just joined, or joined again
+//after it was lost. See handlePeerState.
+type PeerStateReceived struct {
+	ID                  string
+	ExternalOrderMatrix [][2]ElevOrder
+}
+
+//OrderStateReceived carries the matrix another elevator broadcasts in the cyclic mode, see Cyclic
+type OrderStateReceived struct {
+	ID                  string
+	ExternalOrderMatrix [][2]ElevOrder
+}
+
+//Tick must be handled every broadcast interval
+type Tick struct{}
+
+//PeerLost tells the manager that ID has been removed from activeElevators
+type PeerLost struct {
+	ID string
+}
+
+//HandOffOrders asks the other elevators to take over the external orders assigned to this one
+type HandOffOrders struct{}
+
+//ProtocolNegotiated tells whether the cluster talks a protocol version from before the reliable messages.
+//Only the elevators from then need the acks.
+type ProtocolNegotiated struct {
+	Acks bool
+}
+
+//------------ACTIONS-------
+type Action interface{}
+
+type SendMessage struct {
+	Msg ElevOrderMessage
+}
+
+//SendReliable sends Msg to every elevator in To until they have all received it or the network
+//gives up. The outcome must be handled as DeliveryReported.
+type SendReliable struct {
+	Msg ElevOrderMessage
+	To  []string
+}
+
+//BroadcastOrders sends the matrix to every elevator as an EvOrderState
+type BroadcastOrders struct {
+	ExternalOrderMatrix [][2]ElevOrder
+}
+
+//StartTimer (re)starts the timer of an order. When it runs out, TimerExpired{Timer, Seq} should be handled.
+type StartTimer struct {
+	Timer    TimerID
+	Seq      int
+	Duration time.Duration
+}
+
+type StopTimer struct {
+	Timer TimerID
+}
+
+//OrderAssigned is emitted when an external order assigned to the local elevator is confirmed by all.
+type OrderAssigned struct {
+	Floor int
+	Type  int
+}
+
+//PassengersPickedUp is emitted when the local elevator serves a hall order with destinations.
+//The destinations become cab orders.
+type PassengersPickedUp struct {
+	Floor        int
+	Destinations FloorSet
+}
+
+//ExecutionTimedOut is emitted when the local elevator has failed to finish one of its own orders in time.
+type ExecutionTimedOut struct {
+	Floor int
+	Type  int
+}
+
+type AssignmentFailed struct {
+	Err error
+}
+
+//------------MANAGER-------
+type Config struct {
+	LocalID      string
+	NumFloors    int
+	OrderTimeout time.Duration
+	Cost         cost.CostFunction    //every elevator in a cluster must use the same one
+	Global       *cost.GlobalAssigner //moves the orders when there is a better assignment, nil to leave them
+}
+
+//Protocol distributes the external orders between the elevators. Manager does it with a handshake,
+//Cyclic with a state that is broadcast all the time. Every elevator in a cluster must use the same one.
+type Protocol interface {
+	Handle(event Event) []Action
+	ExternalOrderMatrix() [][2]ElevOrder
+	HallLights() [][2]bool //the hall lamps that should be lit, the same on every elevator
+}
+
+type orderTimer struct {
+	Kind    int
+	Seq     int
+	Running bool
+}
+
+//Manager runs the order consensus protocol
+//EvNewOrder -> EvOrderConfirmed -> EvOrderDone
+//as a pure state machine. It never blocks, starts goroutines or touches the network or hardware,
+//the caller executes the returned actions.
+//Every step is sent reliably, and the next one is taken once all active elevators have received it.
+//While an elevator from before the reliable messages is in the cluster, see ProtocolNegotiated, the
+//elevators also answer with EvAckNewOrder, EvAckOrderConfirmed and EvAckOrderDone, which it waits for.
+//knownElevators and activeElevators are owned and kept up to date by the caller.
+//
+//Every order is identified by the Lamport Stamp it was created with, and every cell of the matrix
+//remembers the orders it has had in a VersionVector. That tells an order that has been served from
+//one that has never been heard of when the matrices of two partitions are reconciled.
+type Manager struct {
+	localID             string
+	clock               uint64 //Lamport time
+	orderTimeout        time.Duration
+	costFunction        cost.CostFunction
+	global              *cost.GlobalAssigner
+	externalOrderMatrix [][2]ElevOrder
+	origins             [][2]string
+	timers              [][2]orderTimer
+	delivering          [][2]*ElevOrderMessage //the message sent reliably for the order, nil when there is none
+	pendingDestinations [][2]FloorSet          //requested here and not yet sent, see sendDestinations
+	knownElevators      map[string]*Elevator
+	activeElevators     map[string]bool
+	acks                bool //answer with EvAck*, see ProtocolNegotiated
+}
+
+func New(config Config, knownElevators map[string]*Elevator, activeElevators map[string]bool) *Manager {
+	return &Manager{
+		localID:             config.LocalID,
+		orderTimeout:        config.OrderTimeout,
+		costFunction:        config.Cost,
+		global:              config.Global,
+		externalOrderMatrix: NewExternalOrderMatrix(config.NumFloors),
+		origins:             make([][2]string, config.NumFloors),
+		timers:              make([][2]orderTimer, config.NumFloors),
+		delivering:          make([][2]*ElevOrderMessage, config.NumFloors),
+		pendingDestinations: make([][2]FloorSet, config.NumFloors),
+		knownElevators:      knownElevators,
+		activeElevators:     activeElevators,
+	}
+}
+
+//ExternalOrderMatrix returns the managers matrix. It must not be modified by the caller.
+func (m *Manager) ExternalOrderMatrix() [][2]ElevOrder {
+	return m.externalOrderMatrix
+}
+
+//HallLights lights the orders that are under execution. Every active elevator has acknowledged them.
+func (m *Manager) HallLights() [][2]bool {
+	lights := make([][2]bool, len(m.externalOrderMatrix))
+	for floor := range m.externalOrderMatrix {
+		for button := BUTTON_CALL_UP; button <= BUTTON_CALL_DOWN; button++ {
+			lights[floor][button] = m.externalOrderMatrix[floor][button].Status == UnderExecution
+		}
+	}
+	return lights
+}
+
+func (m *Manager) Handle(event Event) []Action {
+	switch e := event.(type) {
+	case OrderMessageReceived:
+		return m.handleOrderMessage(e.Msg)
+	case HallButtonPressed:
+		return m.handleHallButton(e.Floor, e.Type)
+	case DestinationRequested:
+		return m.handleDestination(e.Floor, e.Destination)
+	case TimerExpired:
+		return m.handleTimerExpired(e.Timer, e.Seq)
+	case OrdersServed:
+		return m.handleOrdersServed(e.Floor)
+	case BackupStateReceived:
+		return append(m.handleBackupState(e.ResponderID), m.rebalance()...)
+	case RestoredStateReceived:
+		return m.handleRestoredState(e.ExternalOrderMatrix)
+	case HandOffOrders:
+		return m.handleHandOffOrders()
+	case PeerLost:
+		return m.handlePeerLost(e.ID)
+	case PeerStateReceived:
+		return m.handlePeerState(e.ID, e.ExternalOrderMatrix)
+	case DeliveryReported:
+		return m.handleDeliveryReported(e.Msg, e.Delivered)
+	case Tick:
+		return m.handleTick()
+	case ProtocolNegotiated:
+		m.acks = e.Acks
+		return nil
+	case OrderStateReceived:
+		return nil
+	}
+	log.Printf("ORDERMANAGER:\t Can not handle event of type %T\n", event)
+	return nil
+}
+
+//------------EVENT HANDLERS-------
+func (m *Manager) handleOrderMessage(msg ElevOrderMessage) []Action {
+	printDebug("Received an " + EventType[msg.Event] + " from " + msg.SenderID + " with OriginID " + msg.OriginID)
+	switch msg.Event {
+	case EvNewOrder:
+		return m.handleNewOrder(msg)
+	case EvOrderConfirmed:
+		return append(m.handleOrderConfirmed(msg), m.rebalance()...)
+	case EvOrderDone:
+		return m.handleOrderDone(msg)
+	case EvReassignOrder:
+		return m.handleReassignOrder(msg)
+	case EvAckNewOrder, EvAckOrderConfirmed, EvAckOrderDone:
+		return nil
+	}
+	printDebug("Recived an invalid ElevOrderMessage from " + msg.SenderID)
+	return nil
+}
+
+func (m *Manager) handleNewOrder(msg ElevOrderMessage) []Action {
+	if msg.SenderID == m.localID {
+		printDebug("Received my own EvNewOrder")
+		return nil
+	}
+	order := &m.externalOrderMatrix[msg.Floor][msg.ButtonType]
+	switch {
+	case order.Status == NotActive || m.originLost(msg.Floor, msg.ButtonType) || m.announcedAgain(msg):
+		printDebug("Order " + ButtonType[msg.ButtonType] + " on floor " + strconv.Itoa(msg.Floor) + " assignedTo " + msg.AssignedTo)
+		printDebug("The order has status " + ElevOrderStatus[order.Status] + ". Setting it to Awaiting from " + msg.OriginID)
+		order.Status = Awaiting
+		order.AssignedTo = msg.AssignedTo
+		order.SetCreated(msg.Created)
+		order.Destinations = msg.Destinations
+		order.DeleteConfirmedBy()
+		m.observe(msg.Created.Time)
+		m.origins[msg.Floor][msg.ButtonType] = msg.OriginID
+		m.delivering[msg.Floor][msg.ButtonType] = nil
+	case order.Status == Awaiting:
+		printDebug("Received an EvNewOrder which is already Awaiting. Acking it again.")
+	case order.Status == UnderExecution:
+		printDebug("Received an EvNewOrder which is already UnderExecution.")
+		return nil
+	}
+	return m.reply(msg, EvAckNewOrder)
+}
+
+//announce makes the local elevator the origin of the order, assigns it to assignedID and
+//sends event (EvNewOrder or EvReassignOrder) to the others. The order is confirmed when they all have it.
+func (m *Manager) announce(floor, button int, assignedID string, event int) []Action {
+	order := &m.externalOrderMatrix[floor][button]
+	order.Status = Awaiting
+	order.AssignedTo = assignedID
+	order.DeleteConfirmedBy()
+	m.origins[floor][button] = m.localID
+	return []Action{
+		m.stopTimer(floor, button),
+		m.sendReliable(ElevOrderMessage{
+			Floor:        floor,
+			ButtonType:   button,
+			AssignedTo:   assignedID,
+			OriginID:     m.localID,
+			SenderID:     m.localID,
+			Event:        event,
+			Created:      order.Created,
+			Destinations: order.Destinations,
+		}),
+	}
+}
+
+func (m *Manager) confirmOrder(floor, button int) []Action {
+	order := &m.externalOrderMatrix[floor][button]
+	order.DeleteConfirmedBy()
+	return []Action{m.sendReliable(ElevOrderMessage{
+		Floor:        floor,
+		ButtonType:   button,
+		AssignedTo:   order.AssignedTo,
+		OriginID:     m.origins[floor][button],
+		SenderID:     m.localID,
+		Event:        EvOrderConfirmed,
+		Created:      order.Created,
+		Destinations: order.Destinations,
+	})}
+}
+
+func (m *Manager) handleOrderConfirmed(msg ElevOrderMessage) []Action {
+	order := &m.externalOrderMatrix[msg.Floor][msg.ButtonType]
+	actions := []Action{}
+	switch order.Status {
+	case NotActive:
+		printDebug("Recived an EvOrderConfirmed on an order who is not active.")
+		if msg.SenderID != m.localID && msg.AssignedTo != m.localID {
+			printDebug("Adding it to list since it is not assigned to me.")
+			order.Status = UnderExecution
+			order.AssignedTo = msg.AssignedTo
+			order.SetCreated(msg.Created)
+			order.Destinations = msg.Destinations
+			order.DeleteConfirmedBy()
+			m.observe(msg.Created.Time)
+			m.origins[msg.Floor][msg.ButtonType] = msg.OriginID
+		}
+	case Awaiting:
+		if msg.OriginID != m.origins[msg.Floor][msg.ButtonType] {
+			printDebug("Ignoring an EvOrderConfirmed from " + msg.OriginID + " who is no longer the origin")
+			return nil
+		}
+		printDebug("Sending EvAckOrderConfirmed on " + ButtonType[msg.ButtonType] + " on floor " + strconv.Itoa(msg.Floor) + " assigned to " + msg.AssignedTo)
+		actions = append(actions, m.reply(msg, EvAckOrderConfirmed)...)
+		order.Status = UnderExecution
+		if msg.AssignedTo == m.localID {
+			actions = append(actions, OrderAssigned{Floor: msg.Floor, Type: msg.ButtonType})
+		}
+		if msg.OriginID != m.localID {
+			actions = append(actions, m.startExecutionTimer(msg.Floor, msg.ButtonType))
+		}
+	case UnderExecution:
+		actions = append(actions, m.reply(msg, EvAckOrderConfirmed)...)
+		if order.AssignedTo != msg.AssignedTo {
+			log.Println("ORDERMANAGER:\t Received an EvOrderConfirmed on an order witch is UnderExecution by another elevator!")
+			log.Printf("          \t The order %v on floor %v was AssignedTo %v and %v had assigned it to %v\n",
+				ButtonType[msg.ButtonType], msg.Floor, order.AssignedTo, msg.SenderID, msg.AssignedTo)
+		}
+	}
+	return actions
+}
+
+func (m *Manager) handleOrderDone(msg ElevOrderMessage) []Action {
+	if msg.SenderID == m.localID {
+		printDebug("Received my own EvOrderDone")
+		return nil
+	}
+	order := &m.externalOrderMatrix[msg.Floor][msg.ButtonType]
+	if !msg.Created.IsZero() && msg.Created.Before(order.Created) {
+		printDebug("Ignoring an EvOrderDone of an order older than the one on " + ButtonType[msg.ButtonType] + " on floor " + strconv.Itoa(msg.Floor))
+		return m.reply(msg, EvAckOrderDone)
+	}
+	log.Println("ORDERMANAGER:\t " + msg.AssignedTo + " is done with order " + ButtonType[msg.ButtonType] + " on floor " + strconv.Itoa(msg.Floor))
+	order.Status = NotActive
+	order.AssignedTo = ""
+	order.Destinations = 0
+	if !msg.Created.IsZero() {
+		order.SetCreated(msg.Created)
+		m.observe(msg.Created.Time)
+	}
+	order.DeleteConfirmedBy()
+	m.delivering[msg.Floor][msg.ButtonType] = nil
+	return append([]Action{m.stopTimer(msg.Floor, msg.ButtonType)}, m.reply(msg, EvAckOrderDone)...)
+}
+
+//handleDeliveryReported takes the next step of the protocol once every active elevator has received
+//msg. The ones that have not, but are still active, get it again.
+func (m *Manager) handleDeliveryReported(msg ElevOrderMessage, delivered []string) []Action {
+	pending := m.delivering[msg.Floor][msg.ButtonType]
+	if pending == nil || *pending != msg {
+		printDebug("Ignoring the delivery report of an outdated " + EventType[msg.Event])
+		return nil
+	}
+	order := &m.externalOrderMatrix[msg.Floor][msg.ButtonType]
+	for _, ID := range delivered {
+		order.ConfirmedBy[ID] = true
+	}
+	if missing := m.missingConfirmations(msg.Floor, msg.ButtonType); len(missing) != 0 {
+		log.Println("ORDERMANAGER:\t", EventType[msg.Event], "on order", ButtonType[msg.ButtonType], "on floor", msg.Floor, "did not reach", missing, "Resending")
+		return []Action{SendReliable{Msg: msg, To: missing}}
+	}
+	printDebug("All active elevators have received " + EventType[msg.Event])
+	m.delivering[msg.Floor][msg.ButtonType] = nil
+	order.DeleteConfirmedBy()
+	switch msg.Event {
+	case EvNewOrder, EvReassignOrder:
+		return m.confirmOrder(msg.Floor, msg.ButtonType)
+	case EvOrderConfirmed:
+		return append([]Action{m.startExecutionTimer(msg.Floor, msg.ButtonType)}, m.rebalance()...)
+	}
+	return nil
+}
+
+//handleReassignOrder starts the handshake over with a new origin and assignee. An order that is still
+//being confirmed is only taken over by an origin with a lower ID, so every elevator picks the same one.
+func (m *Manager) handleReassignOrder(msg ElevOrderMessage) []Action {
+	order := &m.externalOrderMatrix[msg.Floor][msg.ButtonType]
+	if order.Status == NotActive || (order.Status == Awaiting && msg.OriginID >= m.origins[msg.Floor][msg.ButtonType]) {
+		printDebug("Received an EvReassignOrder on an order that is " + ElevOrderStatus[order.Status])
+		return nil
+	}
+	printDebug("Received an EvReassignOrder on an order that is " + ElevOrderStatus[order.Status])
+	order.Status = NotActive
+	order.DeleteConfirmedBy()
+	actions := []Action{m.stopTimer(msg.Floor, msg.ButtonType)}
+	msg.Event = EvNewOrder
+	return append(actions, m.handleNewOrder(msg)...)
+}
+
+func (m *Manager) handleHallButton(floor, button int) []Action {
+	if _, ok := m.activeElevators[m.localID]; !ok {
+		log.Println("ORDERMANAGER:\t Can not accept new external order while offline!")
+		return nil
+	}
+	if status := m.externalOrderMatrix[floor][button].Status; status != NotActive && !m.originLost(floor, button) {
+		printDebug("The order is already " + ElevOrderStatus[status])
+		return nil
+	}
+	if m.originLost(floor, button) {
+		log.Println("ORDERMANAGER:\t", m.origins[floor][button], "was lost before it confirmed order", ButtonType[button], "on floor", floor, "Starting it over")
+	}
+	assignedID, err := cost.AssignNewOrder(m.costFunction, m.knownElevators, m.activeElevators, m.externalOrderMatrix, floor, button)
+	if err != nil {
+		return []Action{AssignmentFailed{err}}
+	}
+	m.clock++
+	m.externalOrderMatrix[floor][button].SetCreated(Stamp{Time: m.clock, Node: m.localID})
+	return m.announce(floor, button, assignedID, EvNewOrder)
+}
+
+//handleDestination adds the destination to the hall order in its direction. It is sent to the
+//others with the order, or with the order again if the order is already under execution.
+func (m *Manager) handleDestination(floor, destination int) []Action {
+	if _, ok := m.activeElevators[m.localID]; !ok {
+		log.Println("ORDERMANAGER:\t Can not accept new external order while offline!")
+		return nil
+	}
+	button := DestinationButton(floor, destination)
+	if m.externalOrderMatrix[floor][button].Status == UnderExecution && m.externalOrderMatrix[floor][button].Destinations.Has(destination) {
+		printDebug("Floor " + strconv.Itoa(destination) + " is already a destination of the order")
+		return nil
+	}
+	m.pendingDestinations[floor][button] = m.pendingDestinations[floor][button].With(destination)
+	return m.sendDestinations(floor, button)
+}
+
+//sendDestinations sends the destinations requested here with a new order, or adds them to the order
+//under execution, which is then sent again to the elevator it is assigned to. An order going through
+//the handshake is left alone, and its destinations are sent on a later Tick.
+func (m *Manager) sendDestinations(floor, button int) []Action {
+	pending := m.pendingDestinations[floor][button]
+	order := &m.externalOrderMatrix[floor][button]
+	switch {
+	case pending == 0:
+		return nil
+	case order.Status == NotActive:
+		m.pendingDestinations[floor][button] = 0
+		order.Destinations = pending
+		assignedID, err := cost.AssignNewOrder(m.costFunction, m.knownElevators, m.activeElevators, m.externalOrderMatrix, floor, button)
+		if err != nil {
+			order.Destinations = 0
+			return []Action{AssignmentFailed{err}}
+		}
+		m.clock++
+		order.SetCreated(Stamp{Time: m.clock, Node: m.localID})
+		return m.announce(floor, button, assignedID, EvNewOrder)
+	case order.Status == UnderExecution && m.delivering[floor][button] == nil:
+		m.pendingDestinations[floor][button] = 0
+		order.Destinations |= pending
+		log.Println("ORDERMANAGER:\t Adding the destinations", pending.Floors(), "to order", ButtonType[button], "on floor", floor, "assigned to", order.AssignedTo)
+		return m.announce(floor, button, order.AssignedTo, EvReassignOrder)
+	}
+	return nil
+}
+
+func (m *Manager) handleTick() []Action {
+	actions := []Action{}
+	for floor := range m.pendingDestinations {
+		for button := range m.pendingDestinations[floor] {
+			actions = append(actions, m.sendDestinations(floor, button)...)
+		}
+	}
+	return actions
+}
+
+func (m *Manager) handleTimerExpired(id TimerID, seq int) []Action {
+	timer := &m.timers[id.Floor][id.Type]
+	if !timer.Running || timer.Seq != seq {
+		printDebug("Ignoring a stale timer")
+		return nil
+	}
+	timer.Running = false
+	order := &m.externalOrderMatrix[id.Floor][id.Type]
+	log.Println("ORDERMANAGER:\t", TimerKind[timer.Kind], "timed out on order", ButtonType[id.Type], "on floor", id.Floor, "assigned to", order.AssignedTo)
+	switch timer.Kind {
+	case TimerExecution:
+		if order.Status != UnderExecution {
+			return nil
+		}
+		if order.AssignedTo == m.localID {
+			return []Action{ExecutionTimedOut{Floor: id.Floor, Type: id.Type}}
+		}
+		//Somebody else have to take the order... The first elevator to timeout will be new OriginID
+		log.Println("ORDERMANAGER:\t An order has not been done... Somebody else need to take it.")
+		assignedID, err := cost.AssignNewOrder(m.costFunction, m.knownElevators, m.activeElevators, m.externalOrderMatrix, id.Floor, id.Type)
+		if err != nil {
+			return []Action{AssignmentFailed{err}, m.startExecutionTimer(id.Floor, id.Type)}
+		}
+		return m.announce(id.Floor, id.Type, assignedID, EvReassignOrder)
+	}
+	return nil
+}
+
+//handleHandOffOrders reassigns every order under execution by this elevator to the others.
+//Orders nobody else can take are kept.
+func (m *Manager) handleHandOffOrders() []Action {
+	others := make(map[string]bool)
+	for ID := range m.activeElevators {
+		if ID != m.localID {
+			others[ID] = true
+		}
+	}
+	actions := []Action{}
+	for floor := range m.externalOrderMatrix {
+		for button := range m.externalOrderMatrix[floor] {
+			if order := m.externalOrderMatrix[floor][button]; order.Status != UnderExecution || order.AssignedTo != m.localID {
+				continue
+			}
+			assignedID, err := cost.AssignNewOrder(m.costFunction, m.knownElevators, others, m.externalOrderMatrix, floor, button)
+			if err != nil {
+				log.Println("ORDERMANAGER:\t Nobody can take over order", ButtonType[button], "on floor", floor, "I have to keep it")
+				actions = append(actions, m.startExecutionTimer(floor, button))
+				continue
+			}
+			log.Println("ORDERMANAGER:\t Handing off order", ButtonType[button], "on floor", floor, "to", assignedID)
+			actions = append(actions, m.announce(floor, button, assignedID, EvReassignOrder)...)
+		}
+	}
+	return actions
+}
+
+//handlePeerLost reassigns the orders under execution by elevators that are no longer active, and
+//announces again the ones they were confirming. Only the active elevator with the lowest ID does it,
+//so every order is reassigned once.
+//The others keep their execution timers in case it is lost as well. They drop the orders that were
+//being confirmed, which the coordinator announces again if it has heard of them.
+func (m *Manager) handlePeerLost(lostID string) []Action {
+	if coordinator := m.coordinator(); coordinator != m.localID {
+		printDebug("Leaving the orders of " + lostID + " to " + coordinator)
+		actions := []Action{}
+		for floor := range m.externalOrderMatrix {
+			for button := range m.externalOrderMatrix[floor] {
+				if m.originLost(floor, button) {
+					printDebug("Dropping order " + ButtonType[button] + " on floor " + strconv.Itoa(floor) + " Awaiting " + lostID)
+					actions = append(actions, m.clear(floor, button)...)
+				}
+			}
+		}
+		return actions
+	}
+	return m.reassignOrphans("")
+}
+
+//handlePeerState reconciles the matrix with the one of peerID. The two may have been in different
+//partitions, each serving the orders it knew of. Both end up with the same matrix: an order only one
+//of them has is kept, an order one of them has served is removed, and an order both have under
+//execution gets a single owner. Orders left to elevators that are not active are reassigned,
+//except to peerID, which may not have been added to activeElevators yet.
+func (m *Manager) handlePeerState(peerID string, matrix [][2]ElevOrder) []Action {
+	actions := []Action{}
+	for floor := range matrix {
+		if floor >= len(m.externalOrderMatrix) {
+			break
+		}
+		for button, remote := range matrix[floor] {
+			actions = append(actions, m.reconcile(floor, button, peerID, remote)...)
+		}
+	}
+	if m.coordinator() == m.localID {
+		actions = append(actions, m.reassignOrphans(peerID)...)
+	}
+	return actions
+}
+
+//reconcile merges the order of peerID into the local order in the same cell
+func (m *Manager) reconcile(floor, button int, peerID string, remote ElevOrder) []Action {
+	local := &m.externalOrderMatrix[floor][button]
+	actions := []Action{}
+	switch {
+	case remote.Status == UnderExecution && local.Status == NotActive:
+		if local.Seen.Covers(remote.Created) {
+			printDebug("The order of " + peerID + " on floor " + strconv.Itoa(floor) + " has been served here")
+			break
+		}
+		log.Println("ORDERMANAGER:\t Taking order", ButtonType[button], "on floor", floor, "from", peerID)
+		actions = m.adopt(floor, button, remote)
+	case remote.Status != UnderExecution && local.Status != NotActive:
+		if remote.Status == NotActive && remote.Seen.Covers(local.Created) {
+			log.Println("ORDERMANAGER:\t Order", ButtonType[button], "on floor", floor, "has been served by", peerID)
+			actions = m.clear(floor, button)
+		}
+	case remote.Status == UnderExecution && local.Status == Awaiting:
+		if m.activeElevators[m.origins[floor][button]] {
+			printDebug("The order on floor " + strconv.Itoa(floor) + " is still being confirmed")
+			break
+		}
+		log.Println("ORDERMANAGER:\t Taking order", ButtonType[button], "on floor", floor, "from", peerID, "since its origin is gone")
+		actions = m.adopt(floor, button, remote)
+	case remote.Status == UnderExecution && local.Status == UnderExecution:
+		takeRemote := false
+		if remote.Created == local.Created {
+			takeRemote = remote.AssignedTo < local.AssignedTo
+		} else {
+			servedThere, servedHere := remote.Seen.Covers(local.Created), local.Seen.Covers(remote.Created)
+			takeRemote = (servedThere && !servedHere) || (servedThere == servedHere && remote.Created.Before(local.Created))
+		}
+		if takeRemote {
+			log.Println("ORDERMANAGER:\t Order", ButtonType[button], "on floor", floor, "goes to", remote.AssignedTo, "as", peerID, "has it")
+			actions = m.adopt(floor, button, remote)
+		}
+	}
+	if local.Status == UnderExecution && remote.Created == local.Created {
+		local.Destinations |= remote.Destinations
+	}
+	local.MergeSeen(remote.Seen)
+	m.observe(remote.Seen.Max())
+	return actions
+}
+
+//reassignOrphans reassigns the orders under execution by elevators that are not active, but alive.
+//An order Awaiting an origin that is not active is announced again as a new order, since the others
+//may never have heard of it, or have it Awaiting the lost origin.
+func (m *Manager) reassignOrphans(alive string) []Action {
+	actions := []Action{}
+	for floor := range m.externalOrderMatrix {
+		for button := range m.externalOrderMatrix[floor] {
+			order := m.externalOrderMatrix[floor][button]
+			if m.originLost(floor, button) && m.origins[floor][button] != alive {
+				assignedID, err := cost.AssignNewOrder(m.costFunction, m.knownElevators, m.activeElevators, m.externalOrderMatrix, floor, button)
+				if err != nil {
+					actions = append(actions, AssignmentFailed{err})
+					continue
+				}
+				log.Println("ORDERMANAGER:\t", m.origins[floor][button], "was lost before it confirmed order", ButtonType[button], "on floor", floor, "Announcing it again")
+				actions = append(actions, m.announce(floor, button, assignedID, EvNewOrder)...)
+				continue
+			}
+			if order.Status != UnderExecution || m.activeElevators[order.AssignedTo] || order.AssignedTo == alive {
+				continue
+			}
+			assignedID, err := cost.AssignNewOrder(m.costFunction, m.knownElevators, m.activeElevators, m.externalOrderMatrix, floor, button)
+			if err != nil {
+				actions = append(actions, AssignmentFailed{err})
+				continue
+			}
+			log.Println("ORDERMANAGER:\t Reassigning order", ButtonType[button], "on floor", floor, "from", order.AssignedTo, "to", assignedID)
+			actions = append(actions, m.announce(floor, button, assignedID, EvReassignOrder)...)
+		}
+	}
+	return actions
+}
+
+//rebalance moves the orders to the elevators the global assignment gives them to. Only the coordinator
+//does it, and only when none of its orders are going through the handshake. An order Awaiting a lost
+//origin is not going anywhere, and does not hold it up.
+func (m *Manager) rebalance() []Action {
+	if m.global == nil || m.coordinator() != m.localID {
+		return nil
+	}
+	for floor := range m.externalOrderMatrix {
+		for button, order := range m.externalOrderMatrix[floor] {
+			if (order.Status == Awaiting && !m.originLost(floor, button)) || m.delivering[floor][button] != nil {
+				return nil
+			}
+		}
+	}
+	actions := []Action{}
+	for _, move := range m.global.Reassign(m.knownElevators, m.activeElevators, m.externalOrderMatrix) {
+		log.Println("ORDERMANAGER:\t Moving order", ButtonType[move.Type], "on floor", move.Floor, "from", move.From, "to", move.To)
+		actions = append(actions, m.announce(move.Floor, move.Type, move.To, EvReassignOrder)...)
+	}
+	return actions
+}
+
+//adopt puts the order remote under execution by the elevator it is assigned to
+func (m *Manager) adopt(floor, button int, remote ElevOrder) []Action {
+	order := &m.externalOrderMatrix[floor][button]
+	assignedTo := remote.AssignedTo
+	order.Status = UnderExecution
+	order.AssignedTo = assignedTo
+	order.SetCreated(remote.Created)
+	order.Destinations |= remote.Destinations
+	order.DeleteConfirmedBy()
+	m.observe(remote.Created.Time)
+	m.delivering[floor][button] = nil
+	actions := []Action{m.startExecutionTimer(floor, button)}
+	if assignedTo == m.localID {
+		actions = append(actions, OrderAssigned{Floor: floor, Type: button})
+	}
+	return actions
+}
+
+//clear removes an order that has been served
+func (m *Manager) clear(floor, button int) []Action {
+	order := &m.externalOrderMatrix[floor][button]
+	order.Status = NotActive
+	order.AssignedTo = ""
+	order.Destinations = 0
+	order.DeleteConfirmedBy()
+	m.delivering[floor][button] = nil
+	return []Action{m.stopTimer(floor, button)}
+}
+
+func (m *Manager) handleOrdersServed(floor int) []Action {
+	actions := []Action{}
+	for _, button := range []int{BUTTON_CALL_UP, BUTTON_CALL_DOWN} {
+		order := &m.externalOrderMatrix[floor][button]
+		if order.Status != UnderExecution || order.AssignedTo != m.localID {
+			continue
+		}
+		if order.Destinations != 0 {
+			actions = append(actions, PassengersPickedUp{Floor: floor, Destinations: order.Destinations})
+		}
+		order.Status = NotActive
+		order.AssignedTo = ""
+		order.Destinations = 0
+		order.DeleteConfirmedBy()
+		printDebug("Sending orderDoneMessage on " + ButtonType[button] + " on floor " + strconv.Itoa(floor))
+		actions = append(actions,
+			m.stopTimer(floor, button),
+			m.sendReliable(ElevOrderMessage{
+				Floor:      floor,
+				ButtonType: button,
+				AssignedTo: m.localID,
+				OriginID:   m.origins[floor][button],
+				SenderID:   m.localID,
+				Event:      EvOrderDone,
+				Created:    order.Created,
+			}))
+	}
+	return actions
+}
+
+//handleBackupState refreshes the execution timers of the orders assigned to an elevator that is still working
+func (m *Manager) handleBackupState(responderID string) []Action {
+	actions := []Action{}
+	for floor := range m.externalOrderMatrix {
+		for button := range m.externalOrderMatrix[floor] {
+			order := m.externalOrderMatrix[floor][button]
+			timer := m.timers[floor][button]
+			if order.Status == UnderExecution && order.AssignedTo == responderID && timer.Running && timer.Kind == TimerExecution {
+				printDebug("Refreshing order execution timer on order " + ButtonType[button] + " on floor " + strconv.Itoa(floor))
+				actions = append(actions, m.startExecutionTimer(floor, button))
+			}
+		}
+	}
+	return actions
+}
+
+func (m *Manager) handleRestoredState(externalOrderMatrix [][2]ElevOrder) []Action {
+	actions := []Action{}
+	for floor, ordersAtFloor := range externalOrderMatrix {
+		if floor >= len(m.externalOrderMatrix) {
+			break
+		}
+		for button, order := range ordersAtFloor {
+			local := &m.externalOrderMatrix[floor][button]
+			local.MergeSeen(order.Seen)
+			m.observe(order.Seen.Max())
+			if order.Status == UnderExecution && local.Status == NotActive {
+				printDebug("Adding external order " + ButtonType[button] + " on floor " + strconv.Itoa(floor))
+				local.Status = UnderExecution
+				local.AssignedTo = order.AssignedTo
+				local.SetCreated(order.Created)
+				local.Destinations = order.Destinations
+				local.DeleteConfirmedBy()
+				m.observe(order.Created.Time)
+				m.delivering[floor][button] = nil
+				actions = append(actions, m.startExecutionTimer(floor, button))
+				if order.AssignedTo == m.localID {
+					actions = append(actions, OrderAssigned{Floor: floor, Type: button})
+				}
+			}
+		}
+	}
+	return actions
+}
+
+//------------SUPPORT FUNCTIONS-------
+//reply acks msg with event, if anybody waits for the acks
+func (m *Manager) reply(msg ElevOrderMessage, event int) []Action {
+	if !m.acks {
+		return nil
+	}
+	return []Action{SendMessage{ElevOrderMessage{
+		Floor:        msg.Floor,
+		ButtonType:   msg.ButtonType,
+		AssignedTo:   msg.AssignedTo,
+		OriginID:     msg.OriginID,
+		SenderID:     m.localID,
+		Event:        event,
+		Created:      msg.Created,
+		Destinations: msg.Destinations,
+	}}}
+}
+
+//observe moves the Lamport clock up to at
+func (m *Manager) observe(at uint64) {
+	if at > m.clock {
+		m.clock = at
+	}
+}
+
+//sendReliable sends msg to every other active elevator. The order waits for it to be delivered,
+//see handleDeliveryReported.
+func (m *Manager) sendReliable(msg ElevOrderMessage) Action {
+	m.delivering[msg.Floor][msg.ButtonType] = &msg
+	to := []string{}
+	for ID := range m.activeElevators {
+		if ID != m.localID {
+			to = append(to, ID)
+		}
+	}
+	sort.Strings(to)
+	return SendReliable{Msg: msg, To: to}
+}
+
+func (m *Manager) startTimer(floor, button, kind int, duration time.Duration) Action {
+	timer := &m.timers[floor][button]
+	timer.Kind = kind
+	timer.Seq++
+	timer.Running = true
+	printDebug("Starting " + TimerKind[kind] + " on order " + ButtonType[button] + " on floor " + strconv.Itoa(floor))
+	return StartTimer{Timer: TimerID{floor, button}, Seq: timer.Seq, Duration: duration}
+}
+
+func (m *Manager) startExecutionTimer(floor, button int) Action {
+	timeout := m.orderTimeout
+	if m.externalOrderMatrix[floor][button].AssignedTo != m.localID {
+		timeout = 2 * m.orderTimeout
+	}
+	return m.startTimer(floor, button, TimerExecution, timeout)
+}
+
+func (m *Manager) stopTimer(floor, button int) Action {
+	m.timers[floor][button].Running = false
+	return StopTimer{TimerID{floor, button}}
+}
+
+//coordinator returns the active elevator with the lowest ID, or "" if the local elevator is not active
+func (m *Manager) coordinator() string {
+	if !m.activeElevators[m.localID] {
+		return ""
+	}
+	coordinator := m.localID
+	for ID := range m.activeElevators {
+		if ID < coordinator {
+			coordinator = ID
+		}
+	}
+	return coordinator
+}
+
+//originLost tells whether the order is Awaiting an origin that is no longer active. Nobody else takes
+//the handshake further, so it is left to whoever has the order pressed again.
+func (m *Manager) originLost(floor, button int) bool {
+	origin := m.origins[floor][button]
+	return m.externalOrderMatrix[floor][button].Status == Awaiting && origin != m.localID && !m.activeElevators[origin]
+}
+
+//announcedAgain tells whether msg is the order Awaiting another origin, announced again by a new one.
+//The old origin has been lost, but that may not be known here yet.
+func (m *Manager) announcedAgain(msg ElevOrderMessage) bool {
+	order := m.externalOrderMatrix[msg.Floor][msg.ButtonType]
+	origin := m.origins[msg.Floor][msg.ButtonType]
+	return order.Status == Awaiting && origin != m.localID && origin != msg.OriginID && order.Created == msg.Created
+}
+
+//missingConfirmations returns the active elevators that have not received the latest message on the order
+func (m *Manager) missingConfirmations(floor, button int) []string {
+	missing := []string{}
+	for elevator := range m.activeElevators {
+		if elevator != m.localID && !m.externalOrderMatrix[floor][button].ConfirmedBy[elevator] {
+			missing = append(missing, elevator)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("ORDERMANAGER:\t", s)
+	}
+}
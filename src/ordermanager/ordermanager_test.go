@@ -0,0 +1,454 @@
+package ordermanager
+
+import (
+	"../cost"
+	. "../typedef"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFloors = 4
+
+//newTestManager is A in a cluster of A at floor 2 and B at floor 0, which are both active.
+//The orders on floor 2 are assigned to A.
+func newTestManager() *Manager {
+	knownElevators := map[string]*Elevator{
+		"A": ResolveElevator(NewElevState("A", 2, testFloors)),
+		"B": ResolveElevator(NewElevState("B", 0, testFloors)),
+	}
+	activeElevators := map[string]bool{"A": true, "B": true}
+	return New(Config{LocalID: "A", NumFloors: testFloors, OrderTimeout: time.Second, Cost: cost.Heuristic{}}, knownElevators, activeElevators)
+}
+
+//describe names an action by its type and, for messages, their event
+func describe(action Action) string {
+	switch a := action.(type) {
+	case SendMessage:
+		return "SendMessage " + EventType[a.Msg.Event]
+	case SendReliable:
+		return "SendReliable " + EventType[a.Msg.Event] + " to " + strings.Join(a.To, ",")
+	}
+	return reflect.TypeOf(action).Name()
+}
+
+//fromB is a message on the up order on floor 2, created by B
+func fromB(event int, assignedTo string) ElevOrderMessage {
+	return ElevOrderMessage{
+		Floor:      2,
+		ButtonType: BUTTON_CALL_UP,
+		AssignedTo: assignedTo,
+		OriginID:   "B",
+		SenderID:   "B",
+		Event:      event,
+		Created:    Stamp{Time: 1, Node: "B"},
+	}
+}
+
+//sent returns the last message the actions send reliably
+func sent(actions []Action) ElevOrderMessage {
+	var msg ElevOrderMessage
+	for _, action := range actions {
+		if a, ok := action.(SendReliable); ok {
+			msg = a.Msg
+		}
+	}
+	return msg
+}
+
+//started returns the last timer the actions start
+func started(actions []Action) StartTimer {
+	var timer StartTimer
+	for _, action := range actions {
+		if a, ok := action.(StartTimer); ok {
+			timer = a
+		}
+	}
+	return timer
+}
+
+func TestHandshake(t *testing.T) {
+	pressed := func(m *Manager) []Action {
+		return m.Handle(HallButtonPressed{Floor: 2, Type: BUTTON_CALL_UP})
+	}
+	delivered := func(m *Manager, actions []Action) []Action {
+		return m.Handle(DeliveryReported{Msg: sent(actions), Delivered: []string{"B"}})
+	}
+	newFromB := func(m *Manager) []Action {
+		return m.Handle(OrderMessageReceived{fromB(EvNewOrder, "B")})
+	}
+	confirmedFromB := func(assignedTo string) func(m *Manager) []Action {
+		return func(m *Manager) []Action {
+			m.Handle(OrderMessageReceived{fromB(EvNewOrder, assignedTo)})
+			return m.Handle(OrderMessageReceived{fromB(EvOrderConfirmed, assignedTo)})
+		}
+	}
+	tests := []struct {
+		name       string
+		setup      func(m *Manager) []Action //the actions are passed to event
+		event      func(m *Manager, actions []Action) []Action
+		status     int
+		assignedTo string
+		actions    []string
+	}{
+		{
+			name:       "a hall button starts the handshake",
+			setup:      func(m *Manager) []Action { return nil },
+			event:      func(m *Manager, _ []Action) []Action { return pressed(m) },
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{"StopTimer", "SendReliable EvNewOrder to B"},
+		},
+		{
+			name:       "a hall button on an order that is Awaiting does nothing",
+			setup:      pressed,
+			event:      func(m *Manager, _ []Action) []Action { return pressed(m) },
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{},
+		},
+		{
+			name:       "EvNewOrder is confirmed once every active elevator has it",
+			setup:      pressed,
+			event:      delivered,
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{"SendReliable EvOrderConfirmed to B"},
+		},
+		{
+			name:  "EvNewOrder is sent again to the elevators that did not get it",
+			setup: pressed,
+			event: func(m *Manager, actions []Action) []Action {
+				return m.Handle(DeliveryReported{Msg: sent(actions), Missing: []string{"B"}})
+			},
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{"SendReliable EvNewOrder to B"},
+		},
+		{
+			name:  "the own EvOrderConfirmed puts the order under execution",
+			setup: func(m *Manager) []Action { return delivered(m, pressed(m)) },
+			event: func(m *Manager, actions []Action) []Action {
+				return m.Handle(OrderMessageReceived{sent(actions)})
+			},
+			status:     UnderExecution,
+			assignedTo: "A",
+			actions:    []string{"OrderAssigned"},
+		},
+		{
+			name:       "EvNewOrder from another elevator is taken",
+			setup:      func(m *Manager) []Action { return nil },
+			event:      func(m *Manager, _ []Action) []Action { return newFromB(m) },
+			status:     Awaiting,
+			assignedTo: "B",
+			actions:    []string{},
+		},
+		{
+			name: "EvNewOrder is acknowledged while an elevator from before the reliable messages is in the cluster",
+			setup: func(m *Manager) []Action {
+				return m.Handle(ProtocolNegotiated{Acks: true})
+			},
+			event:      func(m *Manager, _ []Action) []Action { return newFromB(m) },
+			status:     Awaiting,
+			assignedTo: "B",
+			actions:    []string{"SendMessage EvAckNewOrder"},
+		},
+		{
+			name: "EvOrderDone is acknowledged while an elevator from before the reliable messages is in the cluster",
+			setup: func(m *Manager) []Action {
+				m.Handle(ProtocolNegotiated{Acks: true})
+				return confirmedFromB("B")(m)
+			},
+			event: func(m *Manager, _ []Action) []Action {
+				return m.Handle(OrderMessageReceived{fromB(EvOrderDone, "B")})
+			},
+			status:     NotActive,
+			assignedTo: "",
+			actions:    []string{"StopTimer", "SendMessage EvAckOrderDone"},
+		},
+		{
+			name:  "EvOrderConfirmed from the origin puts the order under execution",
+			setup: newFromB,
+			event: func(m *Manager, _ []Action) []Action {
+				return m.Handle(OrderMessageReceived{fromB(EvOrderConfirmed, "B")})
+			},
+			status:     UnderExecution,
+			assignedTo: "B",
+			actions:    []string{"StartTimer"},
+		},
+		{
+			name:  "EvOrderConfirmed from an elevator that is not the origin is ignored",
+			setup: newFromB,
+			event: func(m *Manager, _ []Action) []Action {
+				msg := fromB(EvOrderConfirmed, "B")
+				msg.OriginID = "C"
+				return m.Handle(OrderMessageReceived{msg})
+			},
+			status:     Awaiting,
+			assignedTo: "B",
+			actions:    []string{},
+		},
+		{
+			name:  "an order assigned here is served",
+			setup: confirmedFromB("A"),
+			event: func(m *Manager, _ []Action) []Action {
+				return m.Handle(OrdersServed{Floor: 2})
+			},
+			status:     NotActive,
+			assignedTo: "",
+			actions:    []string{"StopTimer", "SendReliable EvOrderDone to B"},
+		},
+		{
+			name:  "EvOrderDone clears the order",
+			setup: confirmedFromB("B"),
+			event: func(m *Manager, _ []Action) []Action {
+				return m.Handle(OrderMessageReceived{fromB(EvOrderDone, "B")})
+			},
+			status:     NotActive,
+			assignedTo: "",
+			actions:    []string{"StopTimer"},
+		},
+		{
+			name: "an EvOrderDone of an older order is ignored",
+			setup: func(m *Manager) []Action {
+				m.Handle(OrderMessageReceived{fromB(EvNewOrder, "B")})
+				m.Handle(OrderMessageReceived{fromB(EvOrderDone, "B")})
+				return pressed(m)
+			},
+			event: func(m *Manager, _ []Action) []Action {
+				return m.Handle(OrderMessageReceived{fromB(EvOrderDone, "B")}) //sent again by the network
+			},
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{},
+		},
+		{
+			name:  "an order that is not done in time is reassigned, here",
+			setup: confirmedFromB("B"),
+			event: func(m *Manager, actions []Action) []Action {
+				timer := started(actions)
+				return m.Handle(TimerExpired{Timer: timer.Timer, Seq: timer.Seq})
+			},
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{"StopTimer", "SendReliable EvReassignOrder to B"},
+		},
+		{
+			name:  "a timer that has been restarted is ignored",
+			setup: confirmedFromB("B"),
+			event: func(m *Manager, actions []Action) []Action {
+				timer := started(actions)
+				m.Handle(BackupStateReceived{ResponderID: "B"})
+				return m.Handle(TimerExpired{Timer: timer.Timer, Seq: timer.Seq})
+			},
+			status:     UnderExecution,
+			assignedTo: "B",
+			actions:    []string{},
+		},
+		{
+			name:  "a hall button starts an order Awaiting a lost origin over",
+			setup: newFromB,
+			event: func(m *Manager, _ []Action) []Action {
+				delete(m.activeElevators, "B")
+				return pressed(m)
+			},
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{"StopTimer", "SendReliable EvNewOrder to "},
+		},
+		{
+			name:  "the coordinator announces an order Awaiting a lost origin again",
+			setup: newFromB,
+			event: func(m *Manager, _ []Action) []Action {
+				delete(m.activeElevators, "B")
+				return m.Handle(PeerLost{ID: "B"})
+			},
+			status:     Awaiting,
+			assignedTo: "A",
+			actions:    []string{"StopTimer", "SendReliable EvNewOrder to "},
+		},
+	}
+	for _, test := range tests {
+		m := newTestManager()
+		actions := test.event(m, test.setup(m))
+		got := []string{}
+		for _, action := range actions {
+			got = append(got, describe(action))
+		}
+		if !reflect.DeepEqual(got, test.actions) {
+			t.Errorf("%s: got the actions %q, want %q", test.name, got, test.actions)
+		}
+		order := m.ExternalOrderMatrix()[2][BUTTON_CALL_UP]
+		if order.Status != test.status || order.AssignedTo != test.assignedTo {
+			t.Errorf("%s: the order is %s assigned to %q, want %s assigned to %q", test.name,
+				ElevOrderStatus[order.Status], order.AssignedTo, ElevOrderStatus[test.status], test.assignedTo)
+		}
+	}
+}
+
+func TestHallLights(t *testing.T) {
+	m := newTestManager()
+	m.Handle(OrderMessageReceived{fromB(EvNewOrder, "B")})
+	if m.HallLights()[2][BUTTON_CALL_UP] {
+		t.Error("an order that is Awaiting is lit")
+	}
+	m.Handle(OrderMessageReceived{fromB(EvOrderConfirmed, "B")})
+	if !m.HallLights()[2][BUTTON_CALL_UP] {
+		t.Error("an order that is UnderExecution is not lit")
+	}
+}
+
+//newTestCyclic is A in the cyclic mode, in the same cluster as newTestManager
+func newTestCyclic() *Cyclic {
+	knownElevators := map[string]*Elevator{
+		"A": ResolveElevator(NewElevState("A", 2, testFloors)),
+		"B": ResolveElevator(NewElevState("B", 0, testFloors)),
+	}
+	activeElevators := map[string]bool{"A": true, "B": true}
+	return NewCyclic(Config{LocalID: "A", NumFloors: testFloors, OrderTimeout: time.Second, Cost: cost.Heuristic{}}, knownElevators, activeElevators)
+}
+
+//broadcast is a matrix from B where nothing is known but the up order on floor 2
+func broadcast(status int, assignedTo string, created Stamp, seenBy ...string) OrderStateReceived {
+	matrix := NewExternalOrderMatrix(testFloors)
+	for floor := range matrix {
+		for button := range matrix[floor] {
+			matrix[floor][button].Status = Unknown
+		}
+	}
+	order := &matrix[2][BUTTON_CALL_UP]
+	order.Status, order.AssignedTo, order.Created = status, assignedTo, created
+	order.ConfirmedBy = make(map[string]bool)
+	for _, ID := range seenBy {
+		order.ConfirmedBy[ID] = true
+	}
+	return OrderStateReceived{ID: "B", ExternalOrderMatrix: matrix}
+}
+
+func TestCyclicMerge(t *testing.T) {
+	pressed := func(c *Cyclic) []Action {
+		return c.Handle(HallButtonPressed{Floor: 2, Type: BUTTON_CALL_UP})
+	}
+	confirmedHere := func(c *Cyclic) {
+		pressed(c)
+		c.Handle(broadcast(Unconfirmed, "", Stamp{}, "B"))
+	}
+	tests := []struct {
+		name       string
+		setup      func(c *Cyclic)
+		event      Event
+		status     int
+		assignedTo string
+		actions    []string
+	}{
+		{
+			name:    "a press is Unconfirmed until every active elevator has seen it",
+			setup:   func(c *Cyclic) {},
+			event:   HallButtonPressed{Floor: 2, Type: BUTTON_CALL_UP},
+			status:  Unconfirmed,
+			actions: []string{},
+		},
+		{
+			name:       "presses on two elevators at once confirm the order",
+			setup:      func(c *Cyclic) { pressed(c) },
+			event:      broadcast(Unconfirmed, "", Stamp{}, "B"),
+			status:     Confirmed,
+			assignedTo: "A",
+			actions:    []string{"StartTimer", "OrderAssigned"},
+		},
+		{
+			name:       "an elevator that knows nothing takes the order of the others",
+			setup:      func(c *Cyclic) {},
+			event:      broadcast(Confirmed, "A", Stamp{Time: 3, Node: "B"}),
+			status:     Confirmed,
+			assignedTo: "A",
+			actions:    []string{"StartTimer", "OrderAssigned"},
+		},
+		{
+			name:    "an order served by the other elevator is done",
+			setup:   func(c *Cyclic) { c.Handle(broadcast(Confirmed, "B", Stamp{Time: 1, Node: "B"})) },
+			event:   broadcast(NoOrder, "", Stamp{}),
+			status:  NoOrder,
+			actions: []string{},
+		},
+		{
+			name: "a done order is not brought back by an older broadcast",
+			setup: func(c *Cyclic) {
+				c.Handle(broadcast(Confirmed, "B", Stamp{Time: 1, Node: "B"}))
+				c.Handle(broadcast(NoOrder, "", Stamp{}))
+			},
+			event:   broadcast(Confirmed, "B", Stamp{Time: 1, Node: "B"}),
+			status:  NoOrder,
+			actions: []string{},
+		},
+		{
+			name:    "a new press is not undone by an older broadcast of the order being done",
+			setup:   func(c *Cyclic) { pressed(c) },
+			event:   broadcast(NoOrder, "", Stamp{}),
+			status:  Unconfirmed,
+			actions: []string{},
+		},
+		{
+			name:       "a confirmed order is moved by a newer stamp",
+			setup:      func(c *Cyclic) { c.Handle(broadcast(Confirmed, "A", Stamp{Time: 1, Node: "B"})) },
+			event:      broadcast(Confirmed, "B", Stamp{Time: 2, Node: "B"}),
+			status:     Confirmed,
+			assignedTo: "B",
+			actions:    []string{"StopTimer"},
+		},
+		{
+			name:       "a confirmed order is not moved by an older stamp",
+			setup:      func(c *Cyclic) { c.Handle(broadcast(Confirmed, "A", Stamp{Time: 3, Node: "B"})) },
+			event:      broadcast(Confirmed, "B", Stamp{Time: 2, Node: "B"}),
+			status:     Confirmed,
+			assignedTo: "A",
+			actions:    []string{},
+		},
+		{
+			name: "after a partition the order moved by the other side is taken",
+			setup: func(c *Cyclic) {
+				confirmedHere(c)
+				delete(c.activeElevators, "B")
+				c.Handle(PeerLost{ID: "B"})
+				c.activeElevators["B"] = true
+			},
+			event:      broadcast(Confirmed, "B", Stamp{Time: 1, Node: "B"}),
+			status:     Confirmed,
+			assignedTo: "B",
+			actions:    []string{"StopTimer"},
+		},
+		{
+			name:       "after a partition an order assigned on both sides goes to the lowest ID",
+			setup:      func(c *Cyclic) { c.Handle(broadcast(Confirmed, "B", Stamp{Time: 1, Node: "B"})) },
+			event:      broadcast(Confirmed, "A", Stamp{Time: 1, Node: "B"}),
+			status:     Confirmed,
+			assignedTo: "A",
+			actions:    []string{"StartTimer", "OrderAssigned"},
+		},
+		{
+			name:       "after a partition a press made on the other side is confirmed here",
+			setup:      func(c *Cyclic) { c.Handle(broadcast(NoOrder, "", Stamp{})) },
+			event:      broadcast(Unconfirmed, "", Stamp{}, "B"),
+			status:     Confirmed,
+			assignedTo: "A",
+			actions:    []string{"StartTimer", "OrderAssigned"},
+		},
+	}
+	for _, test := range tests {
+		c := newTestCyclic()
+		test.setup(c)
+		got := []string{}
+		for _, action := range c.Handle(test.event) {
+			got = append(got, describe(action))
+		}
+		if !reflect.DeepEqual(got, test.actions) {
+			t.Errorf("%s: got the actions %q, want %q", test.name, got, test.actions)
+		}
+		order := c.ExternalOrderMatrix()[2][BUTTON_CALL_UP]
+		if order.Status != test.status || order.AssignedTo != test.assignedTo {
+			t.Errorf("%s: the order is %s assigned to %q, want %s assigned to %q", test.name,
+				CyclicState[order.Status], order.AssignedTo, CyclicState[test.status], test.assignedTo)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package protocol
+
+import (
+	. "../typedef"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+//The binary payloads are a fixed sequence of fields. Integers are varints,
+//strings, slices and maps are prefixed with their length.
+const maxFloors = 256
+const maxVersionVector = 256 //elevators in a VersionVector or a set
+
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) int(v int) {
+	var buf [binary.MaxVarintLen64]byte
+	e.data = append(e.data, buf[:binary.PutVarint(buf[:], int64(v))]...)
+}
+
+func (e *encoder) uint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.data = append(e.data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (e *encoder) string(s string) {
+	e.int(len(s))
+	e.data = append(e.data, s...)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.data = append(e.data, 1)
+	} else {
+		e.data = append(e.data, 0)
+	}
+}
+
+//decoder remembers the first error, so a message can be decoded field by field and checked once
+type decoder struct {
+	data []byte
+	err  error
+}
+
+var errTruncated = errors.New("PROTOCOL:\t Truncated payload")
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 || v != int64(int(v)) {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) length(limit int) int {
+	n := d.int()
+	if d.err == nil && (n < 0 || n > limit) {
+		d.err = errors.New("PROTOCOL:\t Length out of range")
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) string() string {
+	n := d.length(maxIDLength)
+	if d.err != nil {
+		return ""
+	}
+	if len(d.data) < n {
+		d.err = errTruncated
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *decoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.data) < 1 || d.data[0] > 1 {
+		d.err = errors.New("PROTOCOL:\t Invalid bool")
+		return false
+	}
+	b := d.data[0] == 1
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("PROTOCOL:\t Trailing bytes after the payload")
+	}
+	return d.err
+}
+
+//The Stamp and the VersionVector only from VersionStamped on
+func (e *encoder) stamp(s Stamp) {
+	e.uint(s.Time)
+	e.string(s.Node)
+}
+
+func (d *decoder) stamp() Stamp {
+	return Stamp{Time: d.uint(), Node: d.string()}
+}
+
+func (e *encoder) versionVector(v VersionVector) error {
+	if len(v) > maxVersionVector {
+		return errors.New("PROTOCOL:\t Too many elevators in a VersionVector")
+	}
+	nodes := []string{}
+	for node := range v {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	e.int(len(nodes))
+	for _, node := range nodes {
+		e.string(node)
+		e.uint(v[node])
+	}
+	return nil
+}
+
+func (d *decoder) versionVector() VersionVector {
+	n := d.length(maxVersionVector)
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	v := make(VersionVector, n)
+	for i := 0; i < n; i++ {
+		v[d.string()] = d.uint()
+	}
+	return v
+}
+
+//set encodes the elevators that are true in s, from VersionConfirmed on
+func (e *encoder) set(s map[string]bool) error {
+	nodes := []string{}
+	for node, ok := range s {
+		if ok {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) > maxVersionVector {
+		return errors.New("PROTOCOL:\t Too many elevators in a set")
+	}
+	sort.Strings(nodes)
+	e.int(len(nodes))
+	for _, node := range nodes {
+		e.string(node)
+	}
+	return nil
+}
+
+func (d *decoder) set() map[string]bool {
+	n := d.length(maxVersionVector)
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	s := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		s[d.string()] = true
+	}
+	return s
+}
+
+//timing encodes the durations in milliseconds, from VersionTimed on
+func (e *encoder) timing(t TimingModel) {
+	for _, d := range []time.Duration{t.DoorWait, t.Travel, t.Acceleration, t.SensorPassage} {
+		e.int(int(d / time.Millisecond))
+	}
+}
+
+func (d *decoder) timing() TimingModel {
+	ms := func() time.Duration { return time.Duration(d.int()) * time.Millisecond }
+	return TimingModel{DoorWait: ms(), Travel: ms(), Acceleration: ms(), SensorPassage: ms()}
+}
+
+func marshalOrder(msg ElevOrderMessage, version uint8) []byte {
+	e := &encoder{}
+	e.int(msg.Event)
+	e.int(msg.Floor)
+	e.int(msg.ButtonType)
+	e.string(msg.AssignedTo)
+	e.string(msg.OriginID)
+	e.string(msg.SenderID)
+	if version >= VersionStamped {
+		e.stamp(msg.Created)
+	}
+	if version >= VersionDestination {
+		e.uint(uint64(msg.Destinations))
+	}
+	return e.data
+}
+
+func unmarshalOrder(data []byte, version uint8) (ElevOrderMessage, error) {
+	d := &decoder{data: data}
+	msg := ElevOrderMessage{
+		Event:      d.int(),
+		Floor:      d.int(),
+		ButtonType: d.int(),
+		AssignedTo: d.string(),
+		OriginID:   d.string(),
+		SenderID:   d.string(),
+	}
+	if version >= VersionStamped {
+		msg.Created = d.stamp()
+	}
+	if version >= VersionDestination {
+		msg.Destinations = FloorSet(d.uint())
+	}
+	return msg, d.finish()
+}
+
+func marshalRestore(msg ElevRestoreMessage, version uint8) ([]byte, error) {
+	if len(msg.State.InternalOrders) > maxFloors || len(msg.ExternalOrderMatrix) > maxFloors {
+		return nil, errors.New("PROTOCOL:\t Too many floors")
+	}
+	e := &encoder{}
+	e.int(msg.Event)
+	e.string(msg.AskerID)
+	e.string(msg.ResponderID)
+	e.string(msg.State.ID)
+	e.int(msg.State.LastFloor)
+	e.int(msg.State.Direction)
+	e.int(msg.State.Behaviour)
+	e.bool(msg.State.Degraded)
+	if version >= VersionTimed {
+		e.timing(msg.State.Timing)
+	}
+	e.int(len(msg.State.InternalOrders))
+	for _, order := range msg.State.InternalOrders {
+		e.bool(order)
+	}
+	e.int(len(msg.ExternalOrderMatrix))
+	for _, orders := range msg.ExternalOrderMatrix {
+		for _, order := range orders {
+			e.int(order.Status)
+			e.string(order.AssignedTo)
+			if version >= VersionStamped {
+				e.stamp(order.Created)
+				if err := e.versionVector(order.Seen); err != nil {
+					return nil, err
+				}
+			}
+			if version >= VersionConfirmed {
+				if err := e.set(order.ConfirmedBy); err != nil {
+					return nil, err
+				}
+			}
+			if version >= VersionDestination {
+				e.uint(uint64(order.Destinations))
+			}
+		}
+	}
+	return e.data, nil
+}
+
+func unmarshalRestore(data []byte, version uint8) (ElevRestoreMessage, error) {
+	d := &decoder{data: data}
+	msg := ElevRestoreMessage{
+		Event:       d.int(),
+		AskerID:     d.string(),
+		ResponderID: d.string(),
+	}
+	msg.State.ID = d.string()
+	msg.State.LastFloor = d.int()
+	msg.State.Direction = d.int()
+	msg.State.Behaviour = d.int()
+	msg.State.Degraded = d.bool()
+	if version >= VersionTimed {
+		msg.State.Timing = d.timing()
+	}
+	if n := d.length(maxFloors); n > 0 {
+		msg.State.InternalOrders = make([]bool, n)
+		for i := range msg.State.InternalOrders {
+			msg.State.InternalOrders[i] = d.bool()
+		}
+	}
+	if n := d.length(maxFloors); n > 0 {
+		msg.ExternalOrderMatrix = make([][2]ElevOrder, n)
+		for floor := range msg.ExternalOrderMatrix {
+			for button := range msg.ExternalOrderMatrix[floor] {
+				msg.ExternalOrderMatrix[floor][button].Status = d.int()
+				msg.ExternalOrderMatrix[floor][button].AssignedTo = d.string()
+				if version >= VersionStamped {
+					msg.ExternalOrderMatrix[floor][button].Created = d.stamp()
+					msg.ExternalOrderMatrix[floor][button].Seen = d.versionVector()
+				}
+				if version >= VersionConfirmed {
+					msg.ExternalOrderMatrix[floor][button].ConfirmedBy = d.set()
+				}
+				if version >= VersionDestination {
+					msg.ExternalOrderMatrix[floor][button].Destinations = FloorSet(d.uint())
+				}
+			}
+		}
+	}
+	return msg, d.finish()
+}
+
+func marshalAck(ack Ack) ([]byte, error) {
+	if len(ack.To) > maxIDLength {
+		return nil, errors.New("PROTOCOL:\t The node ID is too long")
+	}
+	e := &encoder{}
+	e.string(ack.To)
+	e.int(int(ack.Seq))
+	return e.data, nil
+}
+
+func unmarshalAck(data []byte) (Ack, error) {
+	d := &decoder{data: data}
+	ack := Ack{To: d.string()}
+	seq := d.int()
+	if d.err == nil && (seq < 0 || int64(seq) > math.MaxUint32) {
+		d.err = errors.New("PROTOCOL:\t Sequence number out of range")
+	}
+	ack.Seq = uint32(seq)
+	return ack, d.finish()
+}
@@ -0,0 +1,325 @@
+package protocol
+
+import (
+	. "../typedef"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+)
+
+const debug = false
+
+//Protocol versions
+const (
+	VersionLegacyJSON  = 0 //bare JSON without an envelope, spoken by elevators from before the envelope
+	VersionJSON        = 1 //envelope with a JSON payload
+	VersionBinary      = 2 //envelope with a binary payload
+	VersionReliable    = 3 //envelope with flags and a binary payload, reliable messages are acknowledged
+	VersionStamped     = 4 //the binary payloads carry the Stamps and VersionVectors of the orders
+	VersionConfirmed   = 5 //the binary matrices carry ConfirmedBy, which the cyclic orders are confirmed with
+	VersionTimed       = 6 //the binary states carry the TimingModel of the elevator
+	VersionDestination = 7 //the binary orders and matrices carry the destinations of destination dispatch
+)
+
+//Version is the newest version this elevator speaks. It understands every older one.
+const Version = VersionDestination
+
+//Message kinds
+const (
+	KindOrder   = 1 //ElevOrderMessage
+	KindRestore = 2 //ElevRestoreMessage
+	KindAck     = 3 //Ack, from VersionReliable on
+)
+
+//Flags, from VersionReliable on
+const (
+	FlagReliable = 1 << iota //the receivers must acknowledge the packet with an Ack
+)
+
+//Every envelope starts with these two bytes. Legacy packets start with '{'.
+var magic = [2]byte{0xE1, 0xEF}
+
+const maxIDLength = 255
+const maxPayloadLength = 0xFFFF
+
+//Envelope layout (big endian):
+//
+//	magic      2 bytes
+//	version    1 byte   the version this packet is encoded with
+//	maxVersion 1 byte   the newest version the sender speaks
+//	kind       1 byte
+//	flags      1 byte   only from VersionReliable on
+//	idLength   1 byte
+//	nodeID     idLength bytes
+//	seq        4 bytes
+//	length     2 bytes
+//	payload    length bytes
+type Envelope struct {
+	Version    uint8
+	MaxVersion uint8
+	Kind       uint8
+	Flags      uint8
+	NodeID     string
+	Seq        uint32
+	Payload    []byte
+}
+
+//Ack tells the node To that its reliable packet Seq has been received
+type Ack struct {
+	To  string
+	Seq uint32
+}
+
+//Packet is a decoded packet. Exactly one of Order, Restore and Ack is set.
+type Packet struct {
+	Envelope
+	Order   *ElevOrderMessage
+	Restore *ElevRestoreMessage
+	Ack     *Ack
+}
+
+//Marshal encodes msg (an ElevOrderMessage, an ElevRestoreMessage or an Ack) with the Version,
+//NodeID, Seq and Flags of header. Flags and Acks need VersionReliable.
+func Marshal(header Envelope, msg interface{}) ([]byte, error) {
+	version, nodeID := header.Version, header.NodeID
+	if version == VersionLegacyJSON && header.Flags == 0 {
+		return marshalLegacy(msg)
+	}
+	if version > Version {
+		return nil, errors.New("PROTOCOL:\t Can not encode unknown version " + strconv.Itoa(int(version)))
+	}
+	if version < VersionReliable && header.Flags != 0 {
+		return nil, errors.New("PROTOCOL:\t Version " + strconv.Itoa(int(version)) + " has no flags")
+	}
+	if len(nodeID) > maxIDLength {
+		return nil, errors.New("PROTOCOL:\t The node ID is too long")
+	}
+	var kind uint8
+	var payload []byte
+	var err error
+	switch m := msg.(type) {
+	case ElevOrderMessage:
+		kind = KindOrder
+		if version == VersionJSON {
+			payload, err = json.Marshal(m)
+		} else {
+			payload = marshalOrder(m, version)
+		}
+	case ElevRestoreMessage:
+		kind = KindRestore
+		if version == VersionJSON {
+			payload, err = json.Marshal(m)
+		} else {
+			payload, err = marshalRestore(m, version)
+		}
+	case Ack:
+		if version < VersionReliable {
+			return nil, errors.New("PROTOCOL:\t Version " + strconv.Itoa(int(version)) + " has no acks")
+		}
+		kind = KindAck
+		payload, err = marshalAck(m)
+	default:
+		return nil, errors.New("PROTOCOL:\t Can not encode a message of unknown type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxPayloadLength {
+		return nil, errors.New("PROTOCOL:\t The payload is too long")
+	}
+	data := make([]byte, 0, 13+len(nodeID)+len(payload))
+	data = append(data, magic[0], magic[1], version, Version, kind)
+	if version >= VersionReliable {
+		data = append(data, header.Flags)
+	}
+	data = append(data, uint8(len(nodeID)))
+	data = append(data, nodeID...)
+	data = append(data, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-6:], header.Seq)
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(payload)))
+	return append(data, payload...), nil
+}
+
+//Unmarshal decodes a packet of any version up to Version. Anything else is rejected with an error.
+func Unmarshal(data []byte) (Packet, error) {
+	if len(data) > 0 && data[0] == '{' {
+		return unmarshalLegacy(data)
+	}
+	var p Packet
+	if len(data) < 6 || data[0] != magic[0] || data[1] != magic[1] {
+		return p, errors.New("PROTOCOL:\t Not an elevator packet")
+	}
+	p.Version, p.MaxVersion, p.Kind = data[2], data[3], data[4]
+	if p.Version == VersionLegacyJSON || p.Version > Version {
+		return p, errors.New("PROTOCOL:\t Unknown version " + strconv.Itoa(int(p.Version)))
+	}
+	header := data[5:]
+	if p.Version >= VersionReliable {
+		p.Flags = header[0]
+		header = header[1:]
+	}
+	if len(header) < 1 || len(header) < 1+int(header[0])+6 {
+		return p, errors.New("PROTOCOL:\t Truncated envelope")
+	}
+	idLength := int(header[0])
+	p.NodeID = string(header[1 : 1+idLength])
+	rest := header[1+idLength:]
+	p.Seq = binary.BigEndian.Uint32(rest[0:4])
+	length := int(binary.BigEndian.Uint16(rest[4:6]))
+	if len(rest[6:]) != length {
+		return p, errors.New("PROTOCOL:\t The payload length does not match")
+	}
+	p.Payload = rest[6:]
+	var err error
+	switch p.Kind {
+	case KindOrder:
+		var order ElevOrderMessage
+		if p.Version == VersionJSON {
+			err = json.Unmarshal(p.Payload, &order)
+		} else {
+			order, err = unmarshalOrder(p.Payload, p.Version)
+		}
+		p.Order = &order
+	case KindRestore:
+		var restore ElevRestoreMessage
+		if p.Version == VersionJSON {
+			err = json.Unmarshal(p.Payload, &restore)
+		} else {
+			restore, err = unmarshalRestore(p.Payload, p.Version)
+		}
+		p.Restore = &restore
+	case KindAck:
+		if p.Version < VersionReliable {
+			return p, errors.New("PROTOCOL:\t Version " + strconv.Itoa(int(p.Version)) + " has no acks")
+		}
+		var ack Ack
+		ack, err = unmarshalAck(p.Payload)
+		p.Ack = &ack
+	default:
+		return p, errors.New("PROTOCOL:\t Unknown message kind " + strconv.Itoa(int(p.Kind)))
+	}
+	if err != nil {
+		return Packet{}, err
+	}
+	return p, nil
+}
+
+//Legacy packets carry the newest version of the sender in an extra field. The legacy
+//elevators ignore it, the others use it to negotiate up again when the legacy ones are gone.
+//They also carry the fields under the names the legacy elevators know them by, which identified
+//the elevators by their IP and had the state of an elevator in IsMoving and DoorIsOpen.
+type legacyOrder struct {
+	ElevOrderMessage
+	OriginIP   string
+	SenderIP   string
+	MaxVersion uint8
+}
+
+type legacyRestore struct {
+	ElevRestoreMessage
+	AskerIP     string
+	ResponderIP string
+	State       legacyState
+	MaxVersion  uint8
+}
+
+type legacyState struct {
+	ElevState
+	LocalIP    string
+	IsMoving   bool
+	DoorIsOpen bool
+}
+
+func marshalLegacy(msg interface{}) ([]byte, error) {
+	switch m := msg.(type) {
+	case ElevOrderMessage:
+		return json.Marshal(legacyOrder{m, m.OriginID, m.SenderID, Version})
+	case ElevRestoreMessage:
+		state := legacyState{m.State, m.State.ID, m.State.IsMoving(), m.State.DoorIsOpen()}
+		return json.Marshal(legacyRestore{m, m.AskerID, m.ResponderID, state, Version})
+	}
+	return nil, errors.New("PROTOCOL:\t Can not encode a message of unknown type")
+}
+
+//order is the message with the IDs of a legacy elevator, if it has sent only those
+func (l legacyOrder) order() ElevOrderMessage {
+	msg := l.ElevOrderMessage
+	if msg.OriginID == "" && msg.SenderID == "" {
+		msg.OriginID, msg.SenderID = l.OriginIP, l.SenderIP
+	}
+	return msg
+}
+
+func (l legacyRestore) restore() ElevRestoreMessage {
+	msg := l.ElevRestoreMessage
+	if msg.AskerID == "" && msg.ResponderID == "" {
+		msg.AskerID, msg.ResponderID = l.AskerIP, l.ResponderIP
+	}
+	msg.State = l.State.state()
+	return msg
+}
+
+//state is the state of a legacy elevator, which has sent no ID and no Behaviour, in ElevState
+func (l legacyState) state() ElevState {
+	s := l.ElevState
+	if s.ID != "" || l.LocalIP == "" {
+		return s
+	}
+	s.ID = l.LocalIP
+	switch {
+	case l.IsMoving:
+		s.Behaviour = ElevMoving
+	case l.DoorIsOpen:
+		s.Behaviour = ElevDoorOpen
+	default:
+		s.Behaviour = ElevIdle
+	}
+	return s
+}
+
+//unmarshalLegacy decodes the bare JSON of the elevators from before the envelope.
+//The message type is given by the event, see IsRestoreEvent.
+func unmarshalLegacy(data []byte) (Packet, error) {
+	var probe struct {
+		Event      *int
+		MaxVersion uint8
+	}
+	p := Packet{Envelope: Envelope{Version: VersionLegacyJSON, MaxVersion: VersionLegacyJSON, Payload: data}}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return p, err
+	}
+	if probe.Event == nil {
+		return p, errors.New("PROTOCOL:\t Legacy message without an Event")
+	}
+	p.MaxVersion = probe.MaxVersion
+	switch event := *probe.Event; {
+	case IsRestoreEvent(event):
+		var legacy legacyRestore
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return p, err
+		}
+		restore := legacy.restore()
+		p.Kind, p.Restore, p.NodeID = KindRestore, &restore, restore.ResponderID
+		if event == EvRequestingState {
+			p.NodeID = restore.AskerID
+		}
+	case event >= EvNewOrder && event <= EvReassignOrder:
+		var legacy legacyOrder
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return p, err
+		}
+		order := legacy.order()
+		p.Kind, p.Order, p.NodeID = KindOrder, &order, order.SenderID
+	default:
+		return p, errors.New("PROTOCOL:\t Legacy message with unknown Event " + strconv.Itoa(event))
+	}
+	return p, nil
+}
+
+func printDebug(s string) {
+	if debug {
+		log.Println("PROTOCOL:\t", s)
+	}
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	. "../typedef"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+//What the elevators from before the envelope send, as encoding/json wrote their messages
+const (
+	baselineOrder   = `{"Floor":1,"ButtonType":0,"AssignedTo":"10.0.0.3","OriginIP":"10.0.0.2","SenderIP":"10.0.0.2","Event":4}`
+	baselineRestore = `{"AskerIP":"","ResponderIP":"10.0.0.2","Event":1,` +
+		`"State":{"LocalIP":"10.0.0.2","LastFloor":2,"Direction":0,"IsMoving":false,"DoorIsOpen":true,"InternalOrders":[false,true,false,false]},` +
+		`"ExternalOrderMatrix":[[{"Status":0,"AssignedTo":"","ConfirmedBy":null},{"Status":0,"AssignedTo":"","ConfirmedBy":null}],` +
+		`[{"Status":2,"AssignedTo":"10.0.0.3","ConfirmedBy":{"10.0.0.2":true}},{"Status":0,"AssignedTo":"","ConfirmedBy":null}],` +
+		`[{"Status":0,"AssignedTo":"","ConfirmedBy":null},{"Status":0,"AssignedTo":"","ConfirmedBy":null}],` +
+		`[{"Status":0,"AssignedTo":"","ConfirmedBy":null},{"Status":0,"AssignedTo":"","ConfirmedBy":null}]]}`
+)
+
+//The messages of the elevators from before the envelope, as they decode them
+type baselineOrderMessage struct {
+	Floor      int
+	ButtonType int
+	AssignedTo string
+	OriginIP   string
+	SenderIP   string
+	Event      int
+}
+
+type baselineRestoreMessage struct {
+	AskerIP     string
+	ResponderIP string
+	Event       int
+	State       struct {
+		LocalIP        string
+		LastFloor      int
+		Direction      int
+		IsMoving       bool
+		DoorIsOpen     bool
+		InternalOrders [4]bool
+	}
+}
+
+func TestUnmarshalBaseline(t *testing.T) {
+	packet, err := Unmarshal([]byte(baselineOrder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := ElevOrderMessage{Floor: 1, ButtonType: BUTTON_CALL_UP, AssignedTo: "10.0.0.3", OriginID: "10.0.0.2", SenderID: "10.0.0.2", Event: EvNewOrder}
+	if packet.Order == nil || *packet.Order != order || packet.NodeID != "10.0.0.2" {
+		t.Errorf("got the order %+v from %q, want %+v from %q", packet.Order, packet.NodeID, order, "10.0.0.2")
+	}
+	if !packet.Order.IsValid(4) {
+		t.Error("the order is not valid")
+	}
+
+	packet, err = Unmarshal([]byte(baselineRestore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := packet.Restore
+	if restore == nil || restore.ResponderID != "10.0.0.2" || restore.Event != EvBackupState || packet.NodeID != "10.0.0.2" {
+		t.Fatalf("got the restore message %+v from %q", restore, packet.NodeID)
+	}
+	state := ElevState{ID: "10.0.0.2", LastFloor: 2, Direction: STOP, Behaviour: ElevDoorOpen, InternalOrders: []bool{false, true, false, false}}
+	if !reflect.DeepEqual(restore.State, state) {
+		t.Errorf("got the state %+v, want %+v", restore.State, state)
+	}
+	if order := restore.ExternalOrderMatrix[1][BUTTON_CALL_UP]; order.Status != UnderExecution || order.AssignedTo != "10.0.0.3" {
+		t.Errorf("got the order %+v on floor 1", order)
+	}
+	if !restore.IsValid(4) {
+		t.Error("the restore message is not valid")
+	}
+}
+
+func TestMarshalForBaseline(t *testing.T) {
+	order := ElevOrderMessage{Floor: 1, AssignedTo: "B", OriginID: "A", SenderID: "A", Event: EvNewOrder, Created: Stamp{Time: 3, Node: "A"}}
+	data, err := Marshal(Envelope{Version: VersionLegacyJSON}, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var baseline baselineOrderMessage
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		t.Fatal(err)
+	}
+	if baseline.OriginIP != "A" || baseline.SenderIP != "A" || baseline.AssignedTo != "B" || baseline.Event != EvNewOrder {
+		t.Errorf("a baseline elevator reads the order as %+v", baseline)
+	}
+	if packet, err := Unmarshal(data); err != nil || *packet.Order != order {
+		t.Errorf("got the order %+v back, want %+v (%v)", packet.Order, order, err)
+	}
+
+	state := ElevState{ID: "A", LastFloor: 3, Direction: DOWN, Behaviour: ElevMoving, InternalOrders: []bool{true, false, false, false}}
+	restore := ElevRestoreMessage{ResponderID: "A", Event: EvIAmAlive, State: state}
+	data, err = Marshal(Envelope{Version: VersionLegacyJSON}, restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var baselineRestore baselineRestoreMessage
+	if err := json.Unmarshal(data, &baselineRestore); err != nil {
+		t.Fatal(err)
+	}
+	if baselineRestore.ResponderIP != "A" || baselineRestore.State.LocalIP != "A" || !baselineRestore.State.IsMoving ||
+		baselineRestore.State.InternalOrders != [4]bool{true, false, false, false} {
+		t.Errorf("a baseline elevator reads the restore message as %+v", baselineRestore)
+	}
+	if packet, err := Unmarshal(data); err != nil || !reflect.DeepEqual(*packet.Restore, restore) {
+		t.Errorf("got the restore message %+v back, want %+v (%v)", packet.Restore, restore, err)
+	}
+}
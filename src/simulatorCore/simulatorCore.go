@@ -19,21 +19,92 @@ type motorCommand struct {
 	Direction int
 }
 
-var elevator SimulatorElevator
-var elevator_mutex = &sync.Mutex{}
-var simulatedMotorChannel = make(chan motorCommand, 3)
+//Simulator is the IODriver for a simulated elevator controlled from the simulator interface
+type Simulator struct {
+	elevator              SimulatorElevator
+	elevator_mutex        *sync.Mutex
+	simulatedMotorChannel chan motorCommand
+	buttons               map[int]matrixIndex //channel -> ButtonMatrix index
+	lamps                 map[int]matrixIndex //channel -> ButtonLightMatrix index
+	floorSensors          map[int]int         //channel -> floor
+	floorIndicator        map[int]int         //channel -> the bit of the floor it shows
+	startFloor            int
+	headless              bool
+	motorBroken           bool
+	motorJammed           bool
+	jammedCommand         motorCommand  //what a jammed motor keeps doing
+	slowdown              time.Duration //how many times slower the elevator travels than the configured travel times
+}
+
+type matrixIndex struct {
+	Floor int
+	Type  int
+}
+
+func New() *Simulator {
+	return &Simulator{
+		elevator_mutex:        &sync.Mutex{},
+		simulatedMotorChannel: make(chan motorCommand, 3),
+		startFloor:            1,
+		slowdown:              1,
+	}
+}
+
+//NewHeadless creates a simulator that does not listen for the Simulator interface.
+//It is controlled through PressButton and PressStopButton, so several can run in one process.
+func NewHeadless(startFloor int) *Simulator {
+	sim := New()
+	sim.startFloor = startFloor
+	sim.headless = true
+	return sim
+}
+
+//SetSlowdown makes the elevator travel factor times slower, so a slow shaft can be simulated.
+//It must be called before Init.
+func (sim *Simulator) SetSlowdown(factor int) {
+	sim.slowdown = time.Duration(factor)
+}
 
 //INITIALISATION
-func IOInit() error {
-	log.Println("SIMULATOR:\t Starting simulator")
-	if N_FLOORS != 4 {
-		log.Println("SIMULATOR:\t Can´t run the simulator with other than four floors.")
-		return errors.New("Could not initialise Simulator with other than 4 floors!")
-	}
-	elevator_mutex.Lock()
-	elevator.LastFloor = 1
-	elevator.FloorSensor[elevator.LastFloor] = true
-	elevator_mutex.Unlock()
+func (sim *Simulator) Init(numFloors int) error {
+	log.Println("SIMULATOR:\t Starting simulator with", numFloors, "floors")
+	if numFloors < 2 {
+		log.Println("SIMULATOR:\t Can´t run the simulator with less than two floors.")
+		return errors.New("Could not initialise Simulator with less than 2 floors!")
+	}
+	if sim.startFloor < 0 || sim.startFloor >= numFloors {
+		return errors.New("Could not start the Simulator outside the shaft!")
+	}
+	sim.elevator_mutex.Lock()
+	sim.elevator.FloorSensor = make([]bool, numFloors)
+	sim.elevator.ButtonMatrix = make([][3]bool, numFloors)
+	sim.elevator.ButtonLightMatrix = make([][3]bool, numFloors)
+	sim.buttons = make(map[int]matrixIndex)
+	sim.lamps = make(map[int]matrixIndex)
+	sim.floorSensors = make(map[int]int)
+	sim.floorIndicator = make(map[int]int)
+	channels := NewChannelMap(numFloors)
+	for floor := 0; floor < numFloors; floor++ {
+		for button := 0; button < 3; button++ {
+			if channels.Buttons[floor][button] != -1 {
+				sim.buttons[channels.Buttons[floor][button]] = matrixIndex{floor, button}
+			}
+			if channels.Lamps[floor][button] != -1 {
+				sim.lamps[channels.Lamps[floor][button]] = matrixIndex{floor, button}
+			}
+		}
+		sim.floorSensors[channels.FloorSensors[floor]] = floor
+	}
+	for i, channel := range channels.FloorIndicator {
+		sim.floorIndicator[channel] = 1 << uint(len(channels.FloorIndicator)-1-i)
+	}
+	sim.elevator.LastFloor = sim.startFloor
+	sim.elevator.FloorSensor[sim.elevator.LastFloor] = true
+	sim.elevator_mutex.Unlock()
+	if sim.headless {
+		go sim.simulatedMotor()
+		return nil
+	}
 	//Generating localhost adress
 	laddr, err := net.ResolveUDPAddr("udp4", "localhost:"+strconv.Itoa(PortFromInterface))
 	if err != nil {
@@ -50,41 +121,42 @@ func IOInit() error {
 		log.Println("SIMULATOR:\t Simulator is listening on: ", conn.LocalAddr().String())
 	}
 
-	go simulatedMotor()
-	go listenForIncommingButtons(conn)
+	go sim.simulatedMotor()
+	go sim.listenForIncommingButtons(conn)
 	return nil
 }
 
 //MOTOR DYNAMICS
-func simulatedMotor() {
+func (sim *Simulator) simulatedMotor() {
 	var motorState = S_stoppedAtFloor
 	var unfinishedDirection int
 	var timeTraveledFromLastFloor time.Duration
 	var startedMoving time.Time
+	var travelTime = sim.slowdown * TravelTimeBetweenFloors_ms * time.Millisecond
 	var timer = time.NewTimer(time.Hour)
 	timer.Stop()
 	for {
 		select {
-		case command := <-simulatedMotorChannel:
+		case command := <-sim.simulatedMotorChannel:
 			if debug {
-				log.Println("MOTOR:\t Got motor command; speed, dir: ", elevator.MotorSpeed, elevator.Direction)
+				log.Println("MOTOR:\t Got motor command; speed, dir: ", sim.elevator.MotorSpeed, sim.elevator.Direction)
 				log.Println("MOTOR:\t Previus motorstate =", MotorStates[motorState])
 				log.Println("MOTOR:\t Waiting on mutex")
 			}
-			elevator_mutex.Lock()
+			sim.elevator_mutex.Lock()
 			if debug {
 				log.Println("MOTOR:\t Got mutex")
 			}
 			switch motorState {
 			case S_stoppedBetweenFloors:
 				if command.Speed != 0 && command.Direction != 0 {
-					if command.Direction == unfinishedDirection {
-						startedMoving = time.Now().Add(-timeTraveledFromLastFloor)
-						timer.Reset((TravelTimeBetweenFloors_ms - timeTraveledFromLastFloor) * time.Millisecond)
-					} else if command.Direction == -unfinishedDirection {
-						startedMoving = time.Now().Add(-(TravelTimeBetweenFloors_ms - timeTraveledFromLastFloor))
-						timer.Reset(timeTraveledFromLastFloor * time.Millisecond)
+					if command.Direction == -unfinishedDirection { //Going back to the floor that was left
+						sim.elevator.LastFloor += unfinishedDirection
+						unfinishedDirection = command.Direction
+						timeTraveledFromLastFloor = travelTime - timeTraveledFromLastFloor
 					}
+					startedMoving = time.Now().Add(-timeTraveledFromLastFloor)
+					timer.Reset(travelTime - timeTraveledFromLastFloor)
 					if command.Direction == UP {
 						motorState = S_movingUp
 					} else {
@@ -95,9 +167,9 @@ func simulatedMotor() {
 				}
 			case S_stoppedAtFloor:
 				if command.Speed != 0 && command.Direction != 0 {
-					timer.Reset((TravelTimePassingFloor_ms / 2) * time.Millisecond)
+					timer.Reset(sim.slowdown * (TravelTimePassingFloor_ms / 2) * time.Millisecond)
 					startedMoving = time.Now()
-					if elevator.Direction == UP {
+					if sim.elevator.Direction == UP {
 						motorState = S_movingUpInsideSensor
 						unfinishedDirection = UP
 					} else {
@@ -110,12 +182,14 @@ func simulatedMotor() {
 			case S_movingUp, S_movingDown:
 				if command.Speed == 0 {
 					timeTraveledFromLastFloor = time.Since(startedMoving)
+					timer.Stop()
 					motorState = S_stoppedBetweenFloors
 				} else if command.Direction == -unfinishedDirection && command.Direction != 0 {
+					sim.elevator.LastFloor += unfinishedDirection
 					unfinishedDirection = command.Direction
-					timeTraveledFromLastFloor = time.Since(startedMoving)
-					timer.Reset(timeTraveledFromLastFloor * time.Millisecond)
-					startedMoving = time.Now().Add(timeTraveledFromLastFloor - TravelTimeBetweenFloors_ms)
+					timeTraveledFromLastFloor = travelTime - time.Since(startedMoving)
+					timer.Reset(travelTime - timeTraveledFromLastFloor)
+					startedMoving = time.Now().Add(-timeTraveledFromLastFloor)
 					if command.Direction == UP {
 						motorState = S_movingUp
 					} else {
@@ -133,8 +207,8 @@ func simulatedMotor() {
 				} else if command.Direction == -unfinishedDirection && command.Direction != 0 {
 					unfinishedDirection = command.Direction
 					timeTraveledFromLastFloor = time.Since(startedMoving)
-					timer.Reset(timeTraveledFromLastFloor * time.Millisecond)
-					startedMoving = time.Now().Add(timeTraveledFromLastFloor - TravelTimePassingFloor_ms)
+					timer.Reset(timeTraveledFromLastFloor)
+					startedMoving = time.Now().Add(timeTraveledFromLastFloor - sim.slowdown*TravelTimePassingFloor_ms*time.Millisecond)
 					if command.Direction == UP {
 						motorState = S_movingUpInsideSensor
 					} else {
@@ -144,7 +218,7 @@ func simulatedMotor() {
 					log.Println("MOTOR:\t Did nothing")
 				}
 			}
-			elevator_mutex.Unlock()
+			sim.elevator_mutex.Unlock()
 			if debug {
 				log.Println("MOTOR:\t Released mutex")
 				log.Println("MOTOR:\t New motorstate =", MotorStates[motorState])
@@ -157,7 +231,7 @@ func simulatedMotor() {
 				log.Println("MOTOR:\t Waiting on mutex")
 			}
 			timer.Stop()
-			elevator_mutex.Lock()
+			sim.elevator_mutex.Lock()
 			if debug {
 				log.Println("MOTOR:\t Got mutex")
 			}
@@ -165,43 +239,46 @@ func simulatedMotor() {
 			case S_movingUp: //Entering sensor from underneath
 				motorState = S_movingUpInsideSensor
 				startedMoving = time.Now()
-				timer.Reset(TravelTimePassingFloor_ms * time.Millisecond)
-				elevator.LastFloor++
-				elevator.FloorSensor[elevator.LastFloor] = true
+				timer.Reset(sim.slowdown * TravelTimePassingFloor_ms * time.Millisecond)
+				sim.elevator.LastFloor++
+				sim.elevator.FloorSensor[sim.elevator.LastFloor] = true
 
 			case S_movingDown: //Entering sensor from above
 				motorState = S_movingDownInsideSensor
 				startedMoving = time.Now()
-				timer.Reset(TravelTimePassingFloor_ms * time.Millisecond)
-				elevator.LastFloor--
-				elevator.FloorSensor[elevator.LastFloor] = true
+				timer.Reset(sim.slowdown * TravelTimePassingFloor_ms * time.Millisecond)
+				sim.elevator.LastFloor--
+				sim.elevator.FloorSensor[sim.elevator.LastFloor] = true
 			case S_movingUpInsideSensor: //Leaving sensor
-				if elevator.LastFloor < N_FLOORS-1 {
+				if sim.elevator.LastFloor < len(sim.elevator.FloorSensor)-1 {
 					motorState = S_movingUp
 					startedMoving = time.Now()
-					timer.Reset(TravelTimeBetweenFloors_ms * time.Millisecond)
-					elevator.FloorSensor[elevator.LastFloor] = false
+					timer.Reset(sim.slowdown * TravelTimeBetweenFloors_ms * time.Millisecond)
+					sim.elevator.FloorSensor[sim.elevator.LastFloor] = false
 				} else {
-					log.Println("MOTOR:\t Last floor:", elevator.LastFloor)
-					log.Fatal("MOTOR:\t You drove the elevator over the top!!!")
+					log.Println("MOTOR:\t You drove the elevator into the top end stop!!! Last floor:", sim.elevator.LastFloor)
+					motorState = S_stoppedAtFloor
+					unfinishedDirection = 0
 				}
 			case S_movingDownInsideSensor: //Leaving sensor
-				if elevator.LastFloor > 0 {
+				if sim.elevator.LastFloor > 0 {
 					motorState = S_movingDown
 					startedMoving = time.Now()
-					timer.Reset(TravelTimeBetweenFloors_ms * time.Millisecond)
-					elevator.FloorSensor[elevator.LastFloor] = false
+					timer.Reset(sim.slowdown * TravelTimeBetweenFloors_ms * time.Millisecond)
+					sim.elevator.FloorSensor[sim.elevator.LastFloor] = false
 				} else {
-					log.Fatal("MOTOR:\t You drove the elevator under the edge!!!")
+					log.Println("MOTOR:\t You drove the elevator into the bottom end stop!!!")
+					motorState = S_stoppedAtFloor
+					unfinishedDirection = 0
 				}
 
 			default:
-				log.Println("MOTOR:\t Last floor:", elevator.LastFloor)
+				log.Println("MOTOR:\t Last floor:", sim.elevator.LastFloor)
 				log.Println("MOTOR:\t Invalid state at timer timeout!")
 			}
-			elevator_mutex.Unlock()
+			sim.elevator_mutex.Unlock()
 			if debug {
-				printFloorSensors()
+				sim.printFloorSensors()
 				log.Println("MOTOR:\t Released mutex")
 				log.Println("MOTOR:\t Current motorstate =", MotorStates[motorState])
 			}
@@ -209,7 +286,7 @@ func simulatedMotor() {
 	}
 }
 
-func listenForIncommingButtons(conn *net.UDPConn) {
+func (sim *Simulator) listenForIncommingButtons(conn *net.UDPConn) {
 	buf := make([]byte, 1024)
 	for {
 		n, _, err := conn.ReadFromUDP(buf[:])
@@ -226,227 +303,262 @@ func listenForIncommingButtons(conn *net.UDPConn) {
 			if debug {
 				log.Println("SIMULATOR:\t Received command: ", command)
 			}
+			if key, ok := keyboardCommands[command]; ok {
+				command = key
+			}
 			switch command {
-			case "q": //UP1
-				go simulateButtonPress(&elevator.ButtonMatrix[0][0])
-			case "w": //UP2
-				go simulateButtonPress(&elevator.ButtonMatrix[1][0])
-			case "e": //UP3
-				go simulateButtonPress(&elevator.ButtonMatrix[2][0])
-			case "s": //DWN2
-				go simulateButtonPress(&elevator.ButtonMatrix[1][1])
-			case "d": //DWN3
-				go simulateButtonPress(&elevator.ButtonMatrix[2][1])
-			case "f": //DWN4
-				go simulateButtonPress(&elevator.ButtonMatrix[3][1])
-			case "z": //OUT1
-				go simulateButtonPress(&elevator.ButtonMatrix[0][2])
-			case "x": //OUT2
-				go simulateButtonPress(&elevator.ButtonMatrix[1][2])
-			case "c": //OUT3
-				go simulateButtonPress(&elevator.ButtonMatrix[2][2])
-			case "v": //OUT4
-				go simulateButtonPress(&elevator.ButtonMatrix[3][2])
 			case "k": //STOP
-				go simulateButtonPress(&elevator.StopButton)
+				go sim.simulateButtonPress(&sim.elevator.StopButton)
+			default: //"u5", "d5" or "c5": UP, DOWN or COMMAND on floor 5
+				if floor, button, ok := sim.parseButtonCommand(command); ok {
+					go sim.simulateButtonPress(&sim.elevator.ButtonMatrix[floor][button])
+				} else {
+					log.Println("SIMULATOR:\t Unknown command from Simulator interface:", command)
+				}
 			}
 		}
 	}
 }
 
+//The original four floor keyboard layout of the Simulator interface
+var keyboardCommands = map[string]string{
+	"q": "u1",
+	"w": "u2",
+	"e": "u3",
+	"s": "d2",
+	"d": "d3",
+	"f": "d4",
+	"z": "c1",
+	"x": "c2",
+	"c": "c3",
+	"v": "c4",
+}
+
+//PressButton presses button (BUTTON_CALL_UP, BUTTON_CALL_DOWN or BUTTON_COMMAND) on floor
+func (sim *Simulator) PressButton(floor, button int) error {
+	if floor < 0 || floor >= len(sim.elevator.ButtonMatrix) || button < 0 || button > 2 {
+		return errors.New("SIMULATOR:\t No such button")
+	}
+	go sim.simulateButtonPress(&sim.elevator.ButtonMatrix[floor][button])
+	return nil
+}
+
+func (sim *Simulator) PressStopButton() {
+	go sim.simulateButtonPress(&sim.elevator.StopButton)
+}
+
+func (sim *Simulator) ButtonLight(floor, button int) bool {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
+	return sim.elevator.ButtonLightMatrix[floor][button]
+}
+
+func (sim *Simulator) DoorOpen() bool {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
+	return sim.elevator.DoorOpen
+}
+
+//LastFloor returns the last floor the car has entered
+func (sim *Simulator) LastFloor() int {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
+	return sim.elevator.LastFloor
+}
+
 //This simulation should be done different to avoid spawning of mulitple threads per button
-func simulateButtonPress(button *bool) {
-	elevator_mutex.Lock()
+func (sim *Simulator) simulateButtonPress(button *bool) {
+	sim.elevator_mutex.Lock()
 	*button = true
-	elevator_mutex.Unlock()
+	sim.elevator_mutex.Unlock()
 	time.Sleep(BtnDepressedTime_ms * time.Millisecond)
-	elevator_mutex.Lock()
+	sim.elevator_mutex.Lock()
 	*button = false
-	elevator_mutex.Unlock()
+	sim.elevator_mutex.Unlock()
 }
 
-//FUNCTIONS
-func IO_set_bit(channel int) {
-	elevator_mutex.Lock()
-	switch channel {
-	case LIGHT_UP1:
-		elevator.ButtonLightMatrix[0][0] = true
-	case LIGHT_UP2:
-		elevator.ButtonLightMatrix[1][0] = true
-	case LIGHT_UP3:
-		elevator.ButtonLightMatrix[2][0] = true
-	case LIGHT_DOWN2:
-		elevator.ButtonLightMatrix[1][1] = true
-	case LIGHT_DOWN3:
-		elevator.ButtonLightMatrix[2][1] = true
-	case LIGHT_DOWN4:
-		elevator.ButtonLightMatrix[3][1] = true
-	case LIGHT_COMMAND1:
-		elevator.ButtonLightMatrix[0][2] = true
-	case LIGHT_COMMAND2:
-		elevator.ButtonLightMatrix[1][2] = true
-	case LIGHT_COMMAND3:
-		elevator.ButtonLightMatrix[2][2] = true
-	case LIGHT_COMMAND4:
-		elevator.ButtonLightMatrix[3][2] = true
-	case LIGHT_STOP:
-		elevator.StopButtonLight = true
-	case LIGHT_DOOR_OPEN:
-		elevator.DoorOpen = true
-	case MOTORDIR:
-		elevator.Direction = -1 //Down
-		if elevator.MotorSpeed != 0 {
-			simulatedMotorChannel <- motorCommand{elevator.MotorSpeed, elevator.Direction}
-		}
-	case LIGHT_FLOOR_IND1, LIGHT_FLOOR_IND2:
-
+func (sim *Simulator) parseButtonCommand(command string) (floor, button int, ok bool) {
+	if len(command) < 2 {
+		return 0, 0, false
+	}
+	switch command[0] {
+	case 'u':
+		button = 0
+	case 'd':
+		button = 1
+	case 'c':
+		button = 2
+	default:
+		return 0, 0, false
+	}
+	floor, err := strconv.Atoi(command[1:])
+	if err != nil || floor < 1 || floor > len(sim.elevator.ButtonMatrix) {
+		return 0, 0, false
 	}
-	elevator_mutex.Unlock()
+	return floor - 1, button, true
+}
+
+//FUNCTIONS
+func (sim *Simulator) SetBit(channel int) {
+	sim.writeBit(channel, true)
 	if debug {
 		log.Println("SIMULATOR:\t Setting bit on channel: ", channel)
 	}
 }
 
-func IO_clear_bit(channel int) {
-	elevator_mutex.Lock()
+func (sim *Simulator) ClearBit(channel int) {
+	sim.writeBit(channel, false)
+	if debug {
+		log.Println("SIMULATOR:\t Clearing bit on channel: ", channel)
+	}
+}
+
+func (sim *Simulator) writeBit(channel int, value bool) {
+	sim.elevator_mutex.Lock()
+	turning := false
 	switch channel {
-	case LIGHT_UP1:
-		elevator.ButtonLightMatrix[0][0] = false
-	case LIGHT_UP2:
-		elevator.ButtonLightMatrix[1][0] = false
-	case LIGHT_UP3:
-		elevator.ButtonLightMatrix[2][0] = false
-	case LIGHT_DOWN2:
-		elevator.ButtonLightMatrix[1][1] = false
-	case LIGHT_DOWN3:
-		elevator.ButtonLightMatrix[2][1] = false
-	case LIGHT_DOWN4:
-		elevator.ButtonLightMatrix[3][1] = false
-	case LIGHT_COMMAND1:
-		elevator.ButtonLightMatrix[0][2] = false
-	case LIGHT_COMMAND2:
-		elevator.ButtonLightMatrix[1][2] = false
-	case LIGHT_COMMAND3:
-		elevator.ButtonLightMatrix[2][2] = false
-	case LIGHT_COMMAND4:
-		elevator.ButtonLightMatrix[3][2] = false
 	case LIGHT_STOP:
-		elevator.StopButtonLight = false
+		sim.elevator.StopButtonLight = value
 	case LIGHT_DOOR_OPEN:
-		elevator.DoorOpen = false
+		sim.elevator.DoorOpen = value
 	case MOTORDIR:
-		elevator.Direction = 1 //UP
-		if elevator.MotorSpeed != 0 {
-			simulatedMotorChannel <- motorCommand{elevator.MotorSpeed, elevator.Direction}
+		if value {
+			sim.elevator.Direction = DOWN
+		} else {
+			sim.elevator.Direction = UP
+		}
+		turning = sim.elevator.MotorSpeed != 0
+	default:
+		if lamp, ok := sim.lamps[channel]; ok {
+			sim.elevator.ButtonLightMatrix[lamp.Floor][lamp.Type] = value
 		}
-	case LIGHT_FLOOR_IND1, LIGHT_FLOOR_IND2:
 	}
-	elevator_mutex.Unlock()
-	if debug {
-		log.Println("SIMULATOR:\t Clearing bit on channel: ", channel)
+	command := sim.motorCommand()
+	sim.elevator_mutex.Unlock()
+	if turning {
+		sim.simulatedMotorChannel <- command
 	}
 }
 
-func IO_write_analog(channel, value int) {
+func (sim *Simulator) WriteAnalog(channel, value int) {
 	switch channel {
 	case MOTOR:
-		elevator_mutex.Lock()
-		elevator.MotorSpeed = value
-		simulatedMotorChannel <- motorCommand{elevator.MotorSpeed, elevator.Direction}
-		elevator_mutex.Unlock()
+		sim.elevator_mutex.Lock()
+		sim.elevator.MotorSpeed = value
+		command := sim.motorCommand()
+		sim.elevator_mutex.Unlock()
+		sim.simulatedMotorChannel <- command
 	}
 	if debug {
-		log.Printf("Writing %i on channel %i \n", value, channel)
+		log.Printf("SIMULATOR:\t Writing %d on channel %d \n", value, channel)
+	}
+}
+
+//motorCommand is the command the motor actually gets. A broken motor does not turn,
+//and a jammed one keeps doing what it did when it jammed.
+//It must be called with elevator_mutex held, and sent after the mutex is released:
+//simulatedMotor takes the mutex for every command, so sending with it held deadlocks once the buffer is full.
+func (sim *Simulator) motorCommand() motorCommand {
+	switch {
+	case sim.motorBroken:
+		return motorCommand{0, sim.elevator.Direction}
+	case sim.motorJammed:
+		return sim.jammedCommand
 	}
+	return motorCommand{sim.elevator.MotorSpeed, sim.elevator.Direction}
 }
 
-func IO_read_bit(channel int) bool {
+//BreakMotor makes the motor ignore every command until it is repaired
+func (sim *Simulator) BreakMotor(broken bool) {
+	sim.elevator_mutex.Lock()
+	sim.motorBroken = broken
+	command := sim.motorCommand()
+	sim.elevator_mutex.Unlock()
+	sim.simulatedMotorChannel <- command
+}
+
+//JamMotor makes the motor keep running as it does now, whatever it is commanded, until it is unjammed
+func (sim *Simulator) JamMotor(jammed bool) {
+	sim.elevator_mutex.Lock()
+	if jammed && !sim.motorJammed {
+		sim.jammedCommand = sim.motorCommand()
+	}
+	sim.motorJammed = jammed
+	command := sim.motorCommand()
+	sim.elevator_mutex.Unlock()
+	sim.simulatedMotorChannel <- command
+}
+
+//SetObstruction turns the obstruction switch on or off. It stays as set, like the switch in the lab.
+func (sim *Simulator) SetObstruction(active bool) {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
+	sim.elevator.ObstructionButton = active
+}
+
+//BlankLights turns every lamp off, as a glitch or a reset of the hardware would
+func (sim *Simulator) BlankLights() {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
+	for floor := range sim.elevator.ButtonLightMatrix {
+		sim.elevator.ButtonLightMatrix[floor] = [3]bool{}
+	}
+	sim.elevator.StopButtonLight = false
+	sim.elevator.DoorOpen = false
+}
+
+func (sim *Simulator) ReadBit(channel int) bool {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
+	return sim.readBit(channel)
+}
+
+//ReadBits reads every channel at the same instant
+func (sim *Simulator) ReadBits(channels []int, values []bool) {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
+	for i, channel := range channels {
+		values[i] = sim.readBit(channel)
+	}
+}
+
+func (sim *Simulator) readBit(channel int) bool {
+	if debug {
+		log.Println("SIMULATOR:\t Reading discrete channel: ", channel)
+	}
 	switch channel {
-	case LIGHT_UP1:
-		return elevator.ButtonLightMatrix[0][0]
-	case LIGHT_UP2:
-		return elevator.ButtonLightMatrix[1][0]
-	case LIGHT_UP3:
-		return elevator.ButtonLightMatrix[2][0]
-	case LIGHT_DOWN2:
-		return elevator.ButtonLightMatrix[1][1]
-	case LIGHT_DOWN3:
-		return elevator.ButtonLightMatrix[2][1]
-	case LIGHT_DOWN4:
-		return elevator.ButtonLightMatrix[3][1]
-	case LIGHT_COMMAND1:
-		return elevator.ButtonLightMatrix[0][2]
-	case LIGHT_COMMAND2:
-		return elevator.ButtonLightMatrix[1][2]
-	case LIGHT_COMMAND3:
-		return elevator.ButtonLightMatrix[2][2]
-	case LIGHT_COMMAND4:
-		return elevator.ButtonLightMatrix[3][2]
 	case LIGHT_STOP:
-		return elevator.StopButtonLight
+		return sim.elevator.StopButtonLight
 	case LIGHT_DOOR_OPEN:
-		return elevator.DoorOpen
-	case BUTTON_UP1:
-		return elevator.ButtonMatrix[0][0]
-	case BUTTON_UP2:
-		return elevator.ButtonMatrix[1][0]
-	case BUTTON_UP3:
-		return elevator.ButtonMatrix[2][0]
-	case BUTTON_DOWN2:
-		return elevator.ButtonMatrix[1][1]
-	case BUTTON_DOWN3:
-		return elevator.ButtonMatrix[2][1]
-	case BUTTON_DOWN4:
-		return elevator.ButtonMatrix[3][1]
-	case BUTTON_COMMAND1:
-		return elevator.ButtonMatrix[0][2]
-	case BUTTON_COMMAND2:
-		return elevator.ButtonMatrix[1][2]
-	case BUTTON_COMMAND3:
-		return elevator.ButtonMatrix[2][2]
-	case BUTTON_COMMAND4:
-		return elevator.ButtonMatrix[3][2]
+		return sim.elevator.DoorOpen
 	case STOP_BUTTON:
-		return elevator.StopButton
+		return sim.elevator.StopButton
 	case OBSTRUCTION:
-		return elevator.ObstructionButton
-	case SENSOR_FLOOR1:
-		return elevator.FloorSensor[0]
-	case SENSOR_FLOOR2:
-		return elevator.FloorSensor[1]
-	case SENSOR_FLOOR3:
-		return elevator.FloorSensor[2]
-	case SENSOR_FLOOR4:
-		return elevator.FloorSensor[3]
+		return sim.elevator.ObstructionButton
 	case MOTORDIR:
-		if elevator.Direction == 1 {
-			return false
-		} else {
-			return true
-		}
-	case LIGHT_FLOOR_IND1:
-		if (elevator.LastFloor == 1) || (elevator.LastFloor == 3) {
-			return true
-		} else {
-			return false
-		}
-	case LIGHT_FLOOR_IND2:
-		if (elevator.LastFloor == 2) || (elevator.LastFloor == 3) {
-			return true
-		} else {
-			return false
-		}
+		return sim.elevator.Direction != UP
 	}
-	if debug {
-		log.Println("SIMULATOR:\t Reading discrete channel: ", channel)
+	if bit, ok := sim.floorIndicator[channel]; ok {
+		return sim.elevator.LastFloor&bit != 0
+	}
+	if button, ok := sim.buttons[channel]; ok {
+		return sim.elevator.ButtonMatrix[button.Floor][button.Type]
+	}
+	if lamp, ok := sim.lamps[channel]; ok {
+		return sim.elevator.ButtonLightMatrix[lamp.Floor][lamp.Type]
+	}
+	if floor, ok := sim.floorSensors[channel]; ok {
+		return sim.elevator.FloorSensor[floor]
 	}
 	return false
 }
 
-func IO_read_analog(channel int) int {
+func (sim *Simulator) ReadAnalog(channel int) int {
+	sim.elevator_mutex.Lock()
+	defer sim.elevator_mutex.Unlock()
 	switch channel {
 	case MOTOR:
-		return elevator.MotorSpeed
+		return sim.elevator.MotorSpeed
 	}
 	if debug {
 		log.Println("SIMULATOR:\t Reading analog channel: ", channel)
@@ -454,7 +566,6 @@ func IO_read_analog(channel int) int {
 	return 0
 }
 
-func printFloorSensors() {
-	log.Printf("SIMULATOR:\t FloorSensors: \t0:%v \t1:%v \t2:%v \t3:%v\n",
-		IO_read_bit(SENSOR_FLOOR1), IO_read_bit(SENSOR_FLOOR2), IO_read_bit(SENSOR_FLOOR3), IO_read_bit(SENSOR_FLOOR4))
+func (sim *Simulator) printFloorSensors() {
+	log.Printf("SIMULATOR:\t FloorSensors: %v\n", sim.elevator.FloorSensor)
 }
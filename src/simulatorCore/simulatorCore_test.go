@@ -0,0 +1,30 @@
+package simulator
+
+import (
+	. "../channels"
+	"testing"
+	"time"
+)
+
+//TestMotorCommands gives the motor more commands than it buffers while it is moving between the floors
+func TestMotorCommands(t *testing.T) {
+	sim := NewHeadless(1)
+	if err := sim.Init(4); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			sim.WriteAnalog(MOTOR, 2800)
+			sim.writeBit(MOTORDIR, i%2 == 0)
+			sim.JamMotor(i%3 == 0)
+			sim.BreakMotor(i%5 == 0)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the motor commands were not taken")
+	}
+}
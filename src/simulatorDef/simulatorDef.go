@@ -1,7 +1,5 @@
 package simulatorDef
 
-const N_FLOORS int = 4
-
 //Motor commands
 const UP = 1
 const STOP = 0
@@ -37,14 +35,14 @@ var MotorStates = [7]string{
 }
 
 type SimulatorElevator struct {
-	FloorSensor       [4]bool
-	ButtonMatrix      [4][3]bool
-	ButtonLightMatrix [4][3]bool
+	FloorSensor       []bool
+	ButtonMatrix      [][3]bool
+	ButtonLightMatrix [][3]bool
 	ObstructionButton bool
 	StopButton        bool
 	StopButtonLight   bool
 	Direction         int
 	MotorSpeed        int
 	DoorOpen          bool
-	LastFloor         int //0-3
+	LastFloor         int //0-(numFloors-1)
 }
@@ -7,7 +7,7 @@ import (
 	"time"
 )
 
-const N_FLOORS int = 4
+const DefaultNumFloors int = 4
 
 //Motor commands
 const UP = 1
@@ -44,6 +44,8 @@ const (
 	EvOrderDone
 	EvAckOrderDone
 	EvReassignOrder
+	EvReconcileState
+	EvOrderState
 )
 
 const ( //ElevOrder status
@@ -52,6 +54,24 @@ const ( //ElevOrder status
 	UnderExecution
 )
 
+const ( //ElevState behaviour
+	ElevInitializing = iota
+	ElevIdle
+	ElevMoving
+	ElevDoorOpen
+	ElevObstructed
+	ElevEmergencyStop
+)
+
+var ElevBehaviour = []string{
+	"ElevInitializing",
+	"ElevIdle",
+	"ElevMoving",
+	"ElevDoorOpen",
+	"ElevObstructed",
+	"ElevEmergencyStop",
+}
+
 var ElevOrderStatus = []string{
 	"NotActive",
 	"Awaiting",
@@ -81,51 +101,104 @@ var EventType = []string{
 	"EvOrderDone",
 	"EvAckOrderDone",
 	"EvReassignOrder",
+	"EvReconcileState",
+	"EvOrderState",
 }
 
 //------------DATA TYPES-------
 type ElevState struct {
-	LocalIP        string
+	ID             string
 	LastFloor      int
 	Direction      int
-	IsMoving       bool
-	DoorIsOpen bool
-	InternalOrders [N_FLOORS]bool
+	Behaviour      int
+	InternalOrders []bool
+	Degraded       bool        //the elevator has had a fault and must not be assigned external orders
+	Timing         TimingModel //measured by the elevator itself. Zero from elevators that do not measure it
+}
+
+//TimingModel is how long an elevator takes to do things. Each elevator measures its own
+//from the floor sensor and sends it with its state, so a slow shaft is given fewer orders.
+type TimingModel struct {
+	DoorWait      time.Duration //the doors are open at a stop
+	Travel        time.Duration //from leaving the sensor of a floor until the next floor is reached
+	Acceleration  time.Duration //from starting at a floor until its sensor is left
+	SensorPassage time.Duration //from reaching a floor until its sensor is left, when passing it
+}
+
+//DefaultTimingModel is used until an elevator has measured itself
+var DefaultTimingModel = TimingModel{
+	DoorWait:      3 * time.Second,
+	Travel:        1500 * time.Millisecond,
+	Acceleration:  500 * time.Millisecond,
+	SensorPassage: 500 * time.Millisecond,
 }
 
 type ExtendedElevState struct {
 	LocalState     ElevState
-	ExternalOrders [N_FLOORS][2]ElevOrder
+	ExternalOrders [][2]ElevOrder
 }
 
 type ElevOrder struct {
-	Status      int
-	AssignedTo  string
-	ConfirmedBy map[string]bool
-	Timer       *time.Timer `json:"-"`
+	Status       int
+	AssignedTo   string
+	ConfirmedBy  map[string]bool
+	Created      Stamp         //identifies the order. The last one served when the order is NotActive
+	Seen         VersionVector //every order there has been in this cell
+	Destinations FloorSet      //where the passengers waiting for the order are going, in destination dispatch
+}
+
+//FloorSet is a set of floors below MaxFloorSet
+type FloorSet uint64
+
+const MaxFloorSet = 64
+
+//Stamp is the Lamport time an order was created at, and the elevator that created it
+type Stamp struct {
+	Time uint64
+	Node string
 }
 
+//VersionVector holds the Time of the latest Stamp of every elevator
+type VersionVector map[string]uint64
+
 type ExtendedElevOrder struct {
 	Floor, Type int
 	Order       ElevOrder
-	OriginIP    string
+	OriginID    string
 }
 
 type ElevOrderMessage struct {
-	Floor      int
-	ButtonType int
-	AssignedTo string
-	OriginIP   string
-	SenderIP   string
-	Event      int
+	Floor        int
+	ButtonType   int
+	AssignedTo   string
+	OriginID     string
+	SenderID     string
+	Event        int
+	Created      Stamp
+	Destinations FloorSet
 }
 
 type ElevRestoreMessage struct {
-	AskerIP             string
-	ResponderIP         string
+	AskerID             string
+	ResponderID         string
 	Event               int
 	State               ElevState
-	ExternalOrderMatrix [N_FLOORS][2]ElevOrder
+	ExternalOrderMatrix [][2]ElevOrder
+}
+
+//ReliableMessage is sent to the peers in To until all of them have acknowledged it or the network
+//gives up. Msg is an ElevOrderMessage or an ElevRestoreMessage. Done is called with the outcome,
+//on a goroutine of the network, if it is not nil.
+type ReliableMessage struct {
+	Msg  interface{}
+	To   []string
+	Done func(DeliveryReport)
+}
+
+type DeliveryReport struct {
+	Msg       interface{}
+	Delivered []string //the peers that acknowledged the message
+	Missing   []string //the peers that did not
 }
 
 type Elevator struct {
@@ -135,13 +208,46 @@ type Elevator struct {
 
 //-------------HELP FUNCTIONS --------------------
 
+//Constructors
+func NewElevState(localID string, lastFloor, numFloors int) ElevState {
+	return ElevState{ID: localID, LastFloor: lastFloor, InternalOrders: make([]bool, numFloors)}
+}
+
+func NewExternalOrderMatrix(numFloors int) [][2]ElevOrder {
+	return make([][2]ElevOrder, numFloors)
+}
+
+//DestinationButton returns the hall button of a passenger going from floor to destination
+func DestinationButton(floor, destination int) int {
+	if destination > floor {
+		return BUTTON_CALL_UP
+	}
+	return BUTTON_CALL_DOWN
+}
+
 //Resolve
 func ResolveIAmAliveMessage(elev *Elevator) ElevRestoreMessage {
-	return ElevRestoreMessage{ResponderIP: elev.State.LocalIP, Event: EvIAmAlive, State: elev.State}
+	return ElevRestoreMessage{ResponderID: elev.State.ID, Event: EvIAmAlive, State: elev.State.Copy()}
 }
 
-func ResolveBackupState(elev *Elevator, externalOrderMatrix [N_FLOORS][2]ElevOrder) ElevRestoreMessage {
-	return ElevRestoreMessage{ResponderIP: elev.State.LocalIP, State: elev.State, Event: EvBackupState, ExternalOrderMatrix: externalOrderMatrix}
+func ResolveBackupState(elev *Elevator, externalOrderMatrix [][2]ElevOrder) ElevRestoreMessage {
+	return ElevRestoreMessage{ResponderID: elev.State.ID, State: elev.State.Copy(), Event: EvBackupState, ExternalOrderMatrix: CopyExternalOrderMatrix(externalOrderMatrix)}
+}
+
+//CopyExternalOrderMatrix copies the matrix so it can be handed to another goroutine.
+//ConfirmedBy is local bookkeeping and is not part of the copy.
+func CopyExternalOrderMatrix(externalOrderMatrix [][2]ElevOrder) [][2]ElevOrder {
+	matrix := NewExternalOrderMatrix(len(externalOrderMatrix))
+	for floor := range externalOrderMatrix {
+		for button := range externalOrderMatrix[floor] {
+			matrix[floor][button].Status = externalOrderMatrix[floor][button].Status
+			matrix[floor][button].AssignedTo = externalOrderMatrix[floor][button].AssignedTo
+			matrix[floor][button].Created = externalOrderMatrix[floor][button].Created
+			matrix[floor][button].Seen = externalOrderMatrix[floor][button].Seen.Copy()
+			matrix[floor][button].Destinations = externalOrderMatrix[floor][button].Destinations
+		}
+	}
+	return matrix
 }
 
 func ResolveElevator(state ElevState) *Elevator {
@@ -153,7 +259,7 @@ func (elev *Elevator) Print() {
 	elev.State.Print()
 }
 
-func (elev *Elevator) ResolveExtendedElevState(externalOrderMatrix [N_FLOORS][2]ElevOrder) ExtendedElevState {
+func (elev *Elevator) ResolveExtendedElevState(externalOrderMatrix [][2]ElevOrder) ExtendedElevState {
 	return ExtendedElevState{elev.State, externalOrderMatrix}
 }
 
@@ -188,22 +294,11 @@ func (elev *Elevator) SetDirection(direction int) {
 	elev.State.Direction = direction
 }
 
-func (elev *Elevator) SetMoving(moving bool) {
-	elev.State.IsMoving = moving
-}
-
 func (elev *Elevator) IsIdle() bool {
-	return !elev.State.IsMoving && elev.State.Direction == STOP
+	return !elev.State.IsMoving() && elev.State.Direction == STOP
 }
 
 //TYPE ElevOrder
-func (o *ElevOrder) StopTimer() bool {
-	if o.Timer != nil {
-		return o.Timer.Stop()
-	}
-	return false
-}
-
 func (order *ElevOrder) DeleteConfirmedBy() {
 	for key := range order.ConfirmedBy {
 		delete(order.ConfirmedBy, key)
@@ -211,10 +306,123 @@ func (order *ElevOrder) DeleteConfirmedBy() {
 	order.ConfirmedBy = make(map[string]bool)
 }
 
+//SetCreated makes created the order of the cell
+func (order *ElevOrder) SetCreated(created Stamp) {
+	order.Created = created
+	order.Saw(created)
+}
+
+//Saw records that the cell has had the order created
+func (order *ElevOrder) Saw(created Stamp) {
+	if created.IsZero() {
+		return
+	}
+	if order.Seen == nil {
+		order.Seen = make(VersionVector)
+	}
+	if created.Time > order.Seen[created.Node] {
+		order.Seen[created.Node] = created.Time
+	}
+}
+
+//MergeSeen records that the cell has had the orders in seen
+func (order *ElevOrder) MergeSeen(seen VersionVector) {
+	for node, time := range seen {
+		order.Saw(Stamp{Time: time, Node: node})
+	}
+}
+
 func (o ElevOrder) Print() {
 	fmt.Println("Status:\t", o.Status)
 	fmt.Println("AssignedTo:\t", o.AssignedTo)
 	fmt.Println("ConfirmedBy:\t", o.ConfirmedBy)
+	fmt.Println("Destinations:\t", o.Destinations.Floors())
+}
+
+//TYPE FloorSet
+func (s FloorSet) Has(floor int) bool {
+	return floor >= 0 && floor < MaxFloorSet && s&(1<<uint(floor)) != 0
+}
+
+//With returns s with floor added. Floors from MaxFloorSet on can not be added.
+func (s FloorSet) With(floor int) FloorSet {
+	if floor < 0 || floor >= MaxFloorSet {
+		return s
+	}
+	return s | 1<<uint(floor)
+}
+
+//Floors returns the floors in s from the bottom up
+func (s FloorSet) Floors() []int {
+	floors := []int{}
+	for floor := 0; floor < MaxFloorSet; floor++ {
+		if s.Has(floor) {
+			floors = append(floors, floor)
+		}
+	}
+	return floors
+}
+
+//Within is true if every floor in s is in a building with numFloors floors
+func (s FloorSet) Within(numFloors int) bool {
+	return numFloors >= MaxFloorSet || s>>uint(numFloors) == 0
+}
+
+//TYPE Stamp
+//The zero Stamp is on the orders of elevators from before the stamps
+func (s Stamp) IsZero() bool {
+	return s.Time == 0 && s.Node == ""
+}
+
+//Before orders the stamps by Time, and by Node when they were taken at the same time
+func (s Stamp) Before(other Stamp) bool {
+	if s.Time != other.Time {
+		return s.Time < other.Time
+	}
+	return s.Node < other.Node
+}
+
+//TYPE VersionVector
+//Covers returns true if the order created at s is one of the orders in v
+func (v VersionVector) Covers(s Stamp) bool {
+	return !s.IsZero() && v[s.Node] >= s.Time
+}
+
+func (v VersionVector) Copy() VersionVector {
+	if v == nil {
+		return nil
+	}
+	c := make(VersionVector, len(v))
+	for node, time := range v {
+		c[node] = time
+	}
+	return c
+}
+
+//Max returns the latest Time in v
+func (v VersionVector) Max() uint64 {
+	max := uint64(0)
+	for _, time := range v {
+		if time > max {
+			max = time
+		}
+	}
+	return max
+}
+
+//TYPE TimingModel
+func (t TimingModel) IsZero() bool {
+	return t == TimingModel{}
+}
+
+//FloorTime is the time it takes to pass a floor without stopping
+func (t TimingModel) FloorTime() time.Duration {
+	return t.Travel + t.SensorPassage
+}
+
+//StopTime is the time a stop adds, from reaching the floor until it is left again
+func (t TimingModel) StopTime() time.Duration {
+	return t.DoorWait + t.Acceleration
 }
 
 //TYPE ExtendedElevOrder
@@ -226,32 +434,72 @@ func (o ExtendedElevOrder) Print() {
 }
 
 //TYPE ElevState
+func (s ElevState) NumFloors() int {
+	return len(s.InternalOrders)
+}
+
+func (s ElevState) IsMoving() bool {
+	return s.Behaviour == ElevMoving
+}
+
+func (s ElevState) DoorIsOpen() bool {
+	return s.Behaviour == ElevDoorOpen || s.Behaviour == ElevObstructed
+}
+
+//TimingModel returns the timing the elevator has measured, or the default when it has sent none
+func (s ElevState) TimingModel() TimingModel {
+	if s.Timing.IsZero() {
+		return DefaultTimingModel
+	}
+	return s.Timing
+}
+
+func (s ElevState) Copy() ElevState {
+	c := s
+	c.InternalOrders = make([]bool, len(s.InternalOrders))
+	copy(c.InternalOrders, s.InternalOrders)
+	return c
+}
+
+//isValid is true for the state of an elevator on a shaft of numFloors floors. Every restore event
+//but EvRequestingState carries one.
+func (s ElevState) isValid(numFloors int) bool {
+	return len(s.InternalOrders) == numFloors && s.LastFloor >= 0 && s.LastFloor < numFloors
+}
+
 func (s ElevState) Print() {
-	fmt.Println("ElevState to:\t ", s.LocalIP)
+	fmt.Println("ElevState to:\t ", s.ID)
 	fmt.Println("LastFloor:\t ", s.LastFloor)
 	fmt.Println("Direction:\t ", s.Direction)
+	fmt.Println("Behaviour:\t ", ElevBehaviour[s.Behaviour])
 	fmt.Printf("Internal orders: %v\n", s.InternalOrders)
+	fmt.Println("Degraded:\t ", s.Degraded)
+	fmt.Printf("Timing:\t\t  %+v\n", s.Timing)
 }
 
 //TYPE ElevOrderMessage
 func (m ElevOrderMessage) Print() {
 	fmt.Println("ElevOrderMessage")
-	fmt.Println("SenderIP:\t", m.SenderIP)
-	fmt.Println("OriginIP:\t", m.OriginIP)
+	fmt.Println("SenderID:\t", m.SenderID)
+	fmt.Println("OriginID:\t", m.OriginID)
 	fmt.Println("AssignedTo:\t", m.AssignedTo)
 	fmt.Println("Event:\t\t", EventType[m.Event])
 	fmt.Println("ButtonType:\t", ButtonType[m.ButtonType])
 	fmt.Println("Floor:\t\t", m.Floor)
+	fmt.Println("Destinations:\t", m.Destinations.Floors())
 }
 
-func (m ElevOrderMessage) IsValid() bool {
-	if m.Floor > N_FLOORS || m.Floor < -1 {
+func (m ElevOrderMessage) IsValid(numFloors int) bool {
+	if m.Floor >= numFloors || m.Floor < 0 {
+		return false
+	}
+	if !m.Destinations.Within(numFloors) {
 		return false
 	}
 	if m.ButtonType > 2 || m.ButtonType < 0 {
 		return false
 	}
-	if m.Event > 10 || m.Event < 4 {
+	if m.Event > EvReassignOrder || m.Event < EvNewOrder {
 		return false
 	}
 	return true
@@ -260,8 +508,8 @@ func (m ElevOrderMessage) IsValid() bool {
 //TYPE ElevRestoreMessage
 func (m ElevRestoreMessage) Print() {
 	fmt.Println("Event:\t\t", EventType[m.Event])
-	fmt.Println("AskerIP:\t", m.AskerIP)
-	fmt.Println("ResponderIP:\t", m.ResponderIP)
+	fmt.Println("AskerID:\t", m.AskerID)
+	fmt.Println("ResponderID:\t", m.ResponderID)
 	if !reflect.DeepEqual(m.State, ExtendedElevState{}) {
 		m.State.Print()
 	} else {
@@ -269,14 +517,25 @@ func (m ElevRestoreMessage) Print() {
 	}
 }
 
-func (m ElevRestoreMessage) IsValid() bool {
-	if m.AskerIP == m.ResponderIP {
+func (m ElevRestoreMessage) IsValid(numFloors int) bool {
+	if m.AskerID == m.ResponderID {
 		return false
 	}
-	if m.Event > 3 || m.Event < 0 {
+	if m.Event != EvRequestingState && !m.State.isValid(numFloors) {
 		return false
 	}
-	return true
+	if len(m.ExternalOrderMatrix) != 0 && len(m.ExternalOrderMatrix) != numFloors {
+		return false
+	}
+	if m.State.Behaviour < 0 || m.State.Behaviour >= len(ElevBehaviour) {
+		return false
+	}
+	return IsRestoreEvent(m.Event)
+}
+
+//IsRestoreEvent is true for the events of ElevRestoreMessages
+func IsRestoreEvent(event int) bool {
+	return (event >= EvIAmAlive && event <= EvRestoredStateReturned) || event == EvReconcileState || event == EvOrderState
 }
 
 //TYPE ExtendedElevState
@@ -286,19 +545,19 @@ func (s ExtendedElevState) Print() {
 }
 
 func (e ExtendedElevState) IsIdle() bool {
-	return !e.LocalState.IsMoving &&
+	return !e.LocalState.IsMoving() &&
 		e.LocalState.Direction == STOP &&
 		!e.HaveOrders()
 }
 
 func (s ExtendedElevState) LengthToOrder(orderFloor, orderType int) (int, int) {
-	localIP := s.LocalState.LocalIP
+	localID := s.LocalState.ID
 	dir := s.LocalState.Direction
 	lastFloor := s.LocalState.LastFloor
 	numbersOfFloors := 0
 	numbersOfStops := 0
 
-	if dir == STOP && !s.LocalState.IsMoving && lastFloor == orderFloor { //Is idle
+	if dir == STOP && !s.LocalState.IsMoving() && lastFloor == orderFloor { //Is idle
 		return 0, 0
 	}
 
@@ -312,10 +571,11 @@ func (s ExtendedElevState) LengthToOrder(orderFloor, orderType int) (int, int) {
 		}
 	}
 
-	for floor := lastFloor + dir; floor < N_FLOORS && floor >= 0; floor += dir {
+	numFloors := s.LocalState.NumFloors()
+	for floor := lastFloor + dir; floor < numFloors && floor >= 0; floor += dir {
 		numbersOfFloors++
 		if floor == orderFloor {
-			if floor == 0 || floor == N_FLOORS-1 {
+			if floor == 0 || floor == numFloors-1 {
 				return numbersOfFloors, numbersOfStops
 			} else if (dir == DOWN && orderType == BUTTON_CALL_DOWN) ||
 				(dir == UP && orderType == BUTTON_CALL_UP) ||
@@ -332,7 +592,7 @@ func (s ExtendedElevState) LengthToOrder(orderFloor, orderType int) (int, int) {
 		}
 		for button := BUTTON_CALL_UP; button == BUTTON_CALL_DOWN || button == BUTTON_CALL_UP; button++ {
 			if s.ExternalOrders[floor][button].Status == UnderExecution &&
-				localIP == s.ExternalOrders[floor][button].AssignedTo {
+				localID == s.ExternalOrders[floor][button].AssignedTo {
 				numbersOfStops++
 				break
 			} else if s.LocalState.InternalOrders[floor] {
@@ -341,7 +601,7 @@ func (s ExtendedElevState) LengthToOrder(orderFloor, orderType int) (int, int) {
 			}
 		}
 
-		if floor == N_FLOORS-1 {
+		if floor == numFloors-1 {
 			dir = DOWN
 		} else if floor == 0 {
 			dir = UP
@@ -351,7 +611,7 @@ func (s ExtendedElevState) LengthToOrder(orderFloor, orderType int) (int, int) {
 }
 
 func (s ExtendedElevState) ShouldStop() bool {
-	localIP := s.LocalState.LocalIP
+	localID := s.LocalState.ID
 	floor := s.LocalState.LastFloor
 	switch s.LocalState.Direction {
 	case STOP:
@@ -359,13 +619,13 @@ func (s ExtendedElevState) ShouldStop() bool {
 	case UP:
 		return !s.HaveOrdersAbove() ||
 			s.LocalState.InternalOrders[floor] ||
-			(s.ExternalOrders[floor][BUTTON_CALL_UP].Status == UnderExecution && s.ExternalOrders[floor][BUTTON_CALL_UP].AssignedTo == localIP) ||
+			(s.ExternalOrders[floor][BUTTON_CALL_UP].Status == UnderExecution && s.ExternalOrders[floor][BUTTON_CALL_UP].AssignedTo == localID) ||
 			s.LocalState.InternalOrders[floor] ||
-			floor == N_FLOORS-1
+			floor == s.LocalState.NumFloors()-1
 	case DOWN:
 		return !s.HaveOrdersBelow() ||
 			s.LocalState.InternalOrders[floor] ||
-			(s.ExternalOrders[floor][BUTTON_CALL_DOWN].Status == UnderExecution && s.ExternalOrders[floor][BUTTON_CALL_DOWN].AssignedTo == localIP) ||
+			(s.ExternalOrders[floor][BUTTON_CALL_DOWN].Status == UnderExecution && s.ExternalOrders[floor][BUTTON_CALL_DOWN].AssignedTo == localID) ||
 			floor == 0
 	}
 	log.Fatal("MAIN:\t iShouldStop was run with an invalid elev.State.Direction")
@@ -373,13 +633,13 @@ func (s ExtendedElevState) ShouldStop() bool {
 }
 
 func (s ExtendedElevState) HaveOrdersAbove() bool {
-	localIP := s.LocalState.LocalIP
-	for floor := N_FLOORS - 1; floor > s.LocalState.LastFloor; floor-- {
+	localID := s.LocalState.ID
+	for floor := s.LocalState.NumFloors() - 1; floor > s.LocalState.LastFloor; floor-- {
 		if s.LocalState.InternalOrders[floor] {
 			return true
 		}
 		for _, order := range s.ExternalOrders[floor] {
-			if order.Status == UnderExecution && order.AssignedTo == localIP {
+			if order.Status == UnderExecution && order.AssignedTo == localID {
 				return true
 			}
 		}
@@ -388,13 +648,13 @@ func (s ExtendedElevState) HaveOrdersAbove() bool {
 }
 
 func (s ExtendedElevState) HaveOrdersBelow() bool {
-	localIP := s.LocalState.LocalIP
+	localID := s.LocalState.ID
 	for floor := 0; floor < s.LocalState.LastFloor; floor++ {
 		if s.LocalState.InternalOrders[floor] {
 			return true
 		}
 		for _, order := range s.ExternalOrders[floor] {
-			if order.Status == UnderExecution && order.AssignedTo == localIP {
+			if order.Status == UnderExecution && order.AssignedTo == localID {
 				return true
 			}
 		}
@@ -404,12 +664,12 @@ func (s ExtendedElevState) HaveOrdersBelow() bool {
 
 func (s ExtendedElevState) HaveOrdersAtCurrentFloor() bool {
 	floor := s.LocalState.LastFloor
-	localIP := s.LocalState.LocalIP
+	localID := s.LocalState.ID
 	if s.LocalState.InternalOrders[floor] {
 		return true
 	}
 	for _, order := range s.ExternalOrders[floor] {
-		if order.Status == UnderExecution && order.AssignedTo == localIP {
+		if order.Status == UnderExecution && order.AssignedTo == localID {
 			return true
 		}
 	}
@@ -433,7 +693,7 @@ func (s ExtendedElevState) GetNextDirection() int {
 	}
 	switch s.LocalState.Direction {
 	case UP:
-		if s.HaveOrdersAbove() && s.LocalState.LastFloor != N_FLOORS-1 {
+		if s.HaveOrdersAbove() && s.LocalState.LastFloor != s.LocalState.NumFloors()-1 {
 			return UP
 		}
 		fallthrough
@@ -464,17 +724,17 @@ func (e ExtendedElevState) GetNextButtonDirection() int {
 }
 
 func (s ExtendedElevState) FindExternalOrdersAtCurrentFloor() []ExtendedElevOrder {
-	localIP := s.LocalState.LocalIP
+	localID := s.LocalState.ID
 	list := []ExtendedElevOrder{}
 	floor := s.LocalState.LastFloor
-	if o := s.ExternalOrders[floor][BUTTON_CALL_UP]; o.Status == UnderExecution && o.AssignedTo == localIP {
+	if o := s.ExternalOrders[floor][BUTTON_CALL_UP]; o.Status == UnderExecution && o.AssignedTo == localID {
 		list = append(list, ExtendedElevOrder{
 			Floor: floor,
 			Type:  BUTTON_CALL_UP,
 			Order: s.ExternalOrders[floor][BUTTON_CALL_UP],
 		})
 	}
-	if o := s.ExternalOrders[floor][BUTTON_CALL_DOWN]; o.Status == UnderExecution && o.AssignedTo == localIP {
+	if o := s.ExternalOrders[floor][BUTTON_CALL_DOWN]; o.Status == UnderExecution && o.AssignedTo == localID {
 		list = append(list, ExtendedElevOrder{
 			Floor: floor,
 			Type:  BUTTON_CALL_DOWN,
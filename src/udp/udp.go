@@ -154,3 +154,43 @@ func udpConnectionReader(conn *net.UDPConn, messageSize int, rcv_ch chan<- UDPMe
 		}
 	}
 }
+
+//InitLoopback lets several nodes share one host. Every node listens on its own port on localhost,
+//and a broadcast is sent to each of the peer ports (the local one included).
+//The local address returned is "127.0.0.1:port" since the IP alone no longer identifies a node.
+func InitLoopback(localListenPort int, peerPorts []int, messageSize int, sendChannel <-chan UDPMessage, receiveChannel chan<- UDPMessage) (localAddr string, err error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: localListenPort})
+	if err != nil {
+		log.Println("UDP:\t Could not create a UDP loopback socket on port", localListenPort)
+		return "", err
+	}
+	peers := make([]*net.UDPAddr, len(peerPorts))
+	for i, port := range peerPorts {
+		peers[i] = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	}
+	go udpConnectionReader(conn, messageSize, receiveChannel)
+	go loopbackTransmittServer(conn, peers, sendChannel)
+	return conn.LocalAddr().String(), nil
+}
+
+func loopbackTransmittServer(conn *net.UDPConn, peers []*net.UDPAddr, sendChannel <-chan UDPMessage) {
+	for msg := range sendChannel {
+		if msg.Raddr == "broadcast" {
+			for _, peer := range peers {
+				if _, err := conn.WriteToUDP(msg.Data, peer); err != nil && debug {
+					log.Println("UDPTransmitServer:\t Error sending to", peer.String(), err)
+				}
+			}
+		} else {
+			raddr, err := net.ResolveUDPAddr("udp4", msg.Raddr)
+			if err != nil {
+				log.Println("UDPTransmitServer:\t Could not resolve raddr", msg.Raddr)
+				continue
+			}
+			if _, err := conn.WriteToUDP(msg.Data, raddr); err != nil {
+				log.Println("UDPTransmitServer:\t Error: Sending p2p message")
+				log.Println(err)
+			}
+		}
+	}
+}